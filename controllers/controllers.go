@@ -86,6 +86,9 @@ func NewResponseWithError(c *gin.Context, code int, err string) {
 }
 
 func NewResponseWithErrorResponse(c *gin.Context, response foundation.BaseResponse) {
+	if response.Code == 0 {
+		response.Code = foundation.ErrorStatusCode(response.Error)
+	}
 	if response.Code == 0 {
 		response.Code = http.StatusInternalServerError
 	}
@@ -260,6 +263,7 @@ func ManageModels(c *gin.Context, request *services.ServiceRequest) *HttpError {
 func newServiceRequestFromContext(c *gin.Context, model interface{}) (*services.ServiceRequest, error) {
 
 	request := &services.ServiceRequest{}
+	request.Context = c.Request.Context()
 
 	webToken := c.GetHeader("Authorization")
 
@@ -348,6 +352,13 @@ func FillParams(c *gin.Context, request *services.ServiceRequest) error {
 	}
 	request.CurrentPage = currentPage
 
+	// paging=cursor starts keyset pagination, next pages send the cursor returned
+	request.Cursor = c.Query("cursor")
+	request.CursorPaging = c.Query("paging") == "cursor" || request.Cursor != ""
+	request.SkipCount = c.Query("skipCount") == "true"
+	// IncludeDeleted is not a query param, soft deleted documents are only
+	// read by the services that set it
+
 	request.Order = &foundation.Orders{}
 
 	field := c.Query("order")
@@ -365,6 +376,10 @@ func FillParams(c *gin.Context, request *services.ServiceRequest) error {
 		searchTerms := strings.Split(c.Query("searchTerm"), ";")
 		request.SearchTerms = searchTerms
 	}
+	if c.Query("searchMode") == string(foundation.SearchModeText) {
+		request.SearchMode = foundation.SearchModeText
+	}
+	request.Fields = utils.StringToArrayString(c.Query("fields"))
 	txtLabels := c.Query("labels")
 	if !utils.IsEmptyStr(txtLabels) {
 		labels := utils.StringToArrayString(txtLabels)
@@ -378,6 +393,8 @@ func FillParams(c *gin.Context, request *services.ServiceRequest) error {
 	location := c.Param("location")
 	request.Location = location
 
+	request.CheckVersion = c.Query("checkVersion") == "true"
+
 	dateRange := utils.StringToArrayString(c.Query("dateRange"))
 	request.DateRange.Set(dateRange)
 
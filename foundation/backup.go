@@ -0,0 +1,432 @@
+package foundation
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/weitecit/pkg/log"
+	"github.com/weitecit/pkg/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// BackupOptions of RepoBackup and RepoRestore. The archive is a gzip of BSON
+// entries: each collection with its indexes followed by its documents.
+type BackupOptions struct {
+	// Name of the archive, required
+	ID string
+	// Storage of the archive, FileRepoLocal in "backup/<database>" by default
+	FileRepoType FileRepoType
+	Folder       string
+	// RepoRestore only runs when Environment is the ENVIRONMENT it runs in,
+	// and never in production unless AllowProduction
+	Environment     string
+	AllowProduction bool
+	// RepoRestore only reads the archive and lists its collections
+	DryRun bool
+}
+
+// Values of ENVIRONMENT that RepoRestore refuses without AllowProduction
+var productionEnvironments = []string{"pro", "prod", "production"}
+
+type BackupCollection struct {
+	Name      string  `json:"name" bson:"name"`
+	Documents int64   `json:"documents" bson:"documents"`
+	Indexes   []Index `json:"indexes,omitempty" bson:"indexes,omitempty"`
+}
+
+// BackupInfo is returned in RepoResponse.List by RepoBackup and RepoRestore
+type BackupInfo struct {
+	ID          string             `json:"id" bson:"id"`
+	Database    string             `json:"database" bson:"database"`
+	Time        time.Time          `json:"time" bson:"time"`
+	Collections []BackupCollection `json:"collections" bson:"collections"`
+	DryRun      bool               `json:"dry_run,omitempty" bson:"-"`
+}
+
+func (m BackupInfo) totalDocuments() int64 {
+	total := int64(0)
+	for _, collection := range m.Collections {
+		total += collection.Documents
+	}
+	return total
+}
+
+func (m BackupOptions) Validate() error {
+	if m.ID == "" {
+		return errors.New("BackupOptions.Validate: ID can not be empty")
+	}
+	if strings.ContainsAny(m.ID, "/\\") {
+		return errors.New("BackupOptions.Validate: invalid ID: " + m.ID)
+	}
+	return nil
+}
+
+// checkEnvironment is the guard of RepoRestore
+func (m BackupOptions) checkEnvironment() error {
+	if m.DryRun {
+		return nil
+	}
+
+	environment := utils.GetEnv("ENVIRONMENT")
+	if environment == "" {
+		return errors.New("RepoRestore: ENVIRONMENT is not set")
+	}
+	if m.Environment != environment {
+		return errors.New("RepoRestore: the restore is for the environment \"" + m.Environment + "\", this is \"" + environment + "\"")
+	}
+	if utils.ArrayContentStr(productionEnvironments, strings.ToLower(environment)) && !m.AllowProduction {
+		return errors.New("RepoRestore: restoring in " + environment + " needs AllowProduction")
+	}
+	return nil
+}
+
+func (m BackupOptions) fileRequest(request RepoRequest, database string, file io.Reader) FileRepoRequest {
+	fileRequest := FileRepoRequest{
+		FileID:   m.ID + ".bson.gz",
+		Folder:   m.Folder,
+		RepoType: m.FileRepoType,
+		User:     request.User,
+		File:     file,
+	}
+	if fileRequest.Folder == "" {
+		fileRequest.Folder = "backup/" + database
+	}
+	if fileRequest.RepoType == "" {
+		fileRequest.RepoType = FileRepoLocal
+	}
+	return fileRequest
+}
+
+type backupEntryType string
+
+const (
+	backupEntryBackup     backupEntryType = "backup"
+	backupEntryCollection backupEntryType = "collection"
+	backupEntryDocument   backupEntryType = "document"
+	backupEntryEnd        backupEntryType = "end"
+	// Last entry, an archive without it is truncated
+	backupEntryDone backupEntryType = "done"
+)
+
+type backupEntry struct {
+	Type       backupEntryType `bson:"type"`
+	Backup     *BackupInfo     `bson:"backup,omitempty"`
+	Collection string          `bson:"collection,omitempty"`
+	Indexes    []Index         `bson:"indexes,omitempty"`
+	Document   bson.Raw        `bson:"document,omitempty"`
+	Documents  int64           `bson:"documents,omitempty"`
+}
+
+// backupWriter writes the entries of an archive
+type backupWriter struct {
+	gzip    *gzip.Writer
+	info    BackupInfo
+	current *BackupCollection
+}
+
+func newBackupWriter(w io.Writer, id string, database string) (*backupWriter, error) {
+	m := &backupWriter{
+		gzip: gzip.NewWriter(w),
+		info: BackupInfo{ID: id, Database: database, Time: time.Now(), Collections: []BackupCollection{}},
+	}
+	return m, m.write(backupEntry{Type: backupEntryBackup, Backup: &BackupInfo{ID: id, Database: database, Time: m.info.Time}})
+}
+
+func (m *backupWriter) write(entry backupEntry) error {
+	raw, err := bson.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = m.gzip.Write(raw)
+	return err
+}
+
+// collection starts the documents of a collection, ending the previous one
+func (m *backupWriter) collection(name string, indexes []Index) error {
+	err := m.end()
+	if err != nil {
+		return err
+	}
+	m.current = &BackupCollection{Name: name, Indexes: indexes}
+	return m.write(backupEntry{Type: backupEntryCollection, Collection: name, Indexes: indexes})
+}
+
+func (m *backupWriter) document(document bson.Raw) error {
+	if m.current == nil {
+		return errors.New("backupWriter.document: no collection started")
+	}
+	m.current.Documents++
+	return m.write(backupEntry{Type: backupEntryDocument, Document: document})
+}
+
+func (m *backupWriter) end() error {
+	if m.current == nil {
+		return nil
+	}
+	collection := *m.current
+	m.current = nil
+	m.info.Collections = append(m.info.Collections, collection)
+	return m.write(backupEntry{Type: backupEntryEnd, Collection: collection.Name, Documents: collection.Documents})
+}
+
+func (m *backupWriter) Close() error {
+	err := m.end()
+	if err == nil {
+		err = m.write(backupEntry{Type: backupEntryDone, Documents: m.info.totalDocuments()})
+	}
+	if err != nil {
+		return err
+	}
+	return m.gzip.Close()
+}
+
+// isBackupCollection reports whether a collection is saved by RepoBackup,
+// the system.* collections belong to the server
+func isBackupCollection(name string) bool {
+	return name != "" && !strings.HasPrefix(name, "system.")
+}
+
+// backupTarget receives the collections of an archive read by readBackup
+type backupTarget interface {
+	collection(name string, indexes []Index) error
+	document(collection string, document bson.Raw) error
+	end(collection BackupCollection) error
+}
+
+// readBackup reads an archive into target, or only checks it when target is
+// nil, and returns its contents
+func readBackup(r io.Reader, target backupTarget) (BackupInfo, error) {
+	info := BackupInfo{Collections: []BackupCollection{}}
+
+	reader, err := gzip.NewReader(r)
+	if err != nil {
+		return info, errors.New("readBackup: " + err.Error())
+	}
+	defer reader.Close()
+
+	var current *BackupCollection
+	names := map[string]bool{}
+	started, done := false, false
+	for {
+		raw, err := bson.NewFromIOReader(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return info, errors.New("readBackup: " + err.Error())
+		}
+
+		entry := backupEntry{}
+		err = bson.Unmarshal(raw, &entry)
+		if err != nil {
+			return info, errors.New("readBackup: " + err.Error())
+		}
+
+		if !started && entry.Type != backupEntryBackup {
+			return info, errors.New("readBackup: not a backup archive")
+		}
+		if done {
+			return info, errors.New("readBackup: entries after the end of the archive")
+		}
+
+		switch entry.Type {
+		case backupEntryBackup:
+			if started || entry.Backup == nil {
+				return info, errors.New("readBackup: invalid backup entry")
+			}
+			started = true
+			info.ID, info.Database, info.Time = entry.Backup.ID, entry.Backup.Database, entry.Backup.Time
+		case backupEntryCollection:
+			if current != nil {
+				return info, errors.New("readBackup: " + current.Name + " is not ended")
+			}
+			if !isBackupCollection(entry.Collection) || names[entry.Collection] {
+				return info, errors.New("readBackup: invalid collection: " + entry.Collection)
+			}
+			names[entry.Collection] = true
+			current = &BackupCollection{Name: entry.Collection, Indexes: entry.Indexes}
+			if target != nil {
+				err = target.collection(entry.Collection, entry.Indexes)
+			}
+		case backupEntryDocument:
+			if current == nil {
+				return info, errors.New("readBackup: document out of a collection")
+			}
+			current.Documents++
+			if target != nil {
+				err = target.document(current.Name, entry.Document)
+			}
+		case backupEntryEnd:
+			if current == nil || current.Name != entry.Collection || current.Documents != entry.Documents {
+				return info, errors.New("readBackup: " + entry.Collection + " is incomplete")
+			}
+			info.Collections = append(info.Collections, *current)
+			if target != nil {
+				err = target.end(*current)
+			}
+			current = nil
+		case backupEntryDone:
+			if current != nil || entry.Documents != info.totalDocuments() {
+				return info, errors.New("readBackup: the archive is incomplete")
+			}
+			done = true
+		default:
+			return info, errors.New("readBackup: unknown entry: " + string(entry.Type))
+		}
+		if err != nil {
+			return info, err
+		}
+	}
+
+	if !done {
+		return info, errors.New("readBackup: the archive is truncated")
+	}
+
+	return info, nil
+}
+
+// saveBackup streams the archive written by fn to the file repository of the
+// backup
+func saveBackup(request RepoRequest, backup BackupOptions, database string, fn func(archive *backupWriter) error) RepoResponse {
+	err := backup.Validate()
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	reader, writer := io.Pipe()
+	files, err := NewFileRepository(backup.fileRequest(request, database, reader))
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	saved := make(chan FileRepoResponse, 1)
+	go func() {
+		response := files.Save()
+		// unblocks the writer if Save did not read everything
+		reader.CloseWithError(errors.New("RepoBackup: the file repository stopped reading"))
+		saved <- response
+	}()
+
+	archive, err := newBackupWriter(writer, backup.ID, database)
+	if err == nil {
+		err = fn(archive)
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	writer.CloseWithError(err)
+
+	response := <-saved
+	if err == nil {
+		err = response.Error
+	}
+	if err != nil {
+		err = errors.New("RepoBackup: " + err.Error())
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	return RepoResponse{TotalRows: archive.info.totalDocuments(), List: archive.info}
+}
+
+// restoreBackup reads the archive of the backup into a local copy, checking
+// it is complete, and then, unless it is a dry run, restores that copy into
+// the target returned by prepare, which clears the database. Nothing is
+// cleared until the whole archive has been read and checked.
+func restoreBackup(request RepoRequest, backup BackupOptions, database string, prepare func() (backupTarget, error)) RepoResponse {
+	err := backup.Validate()
+	if err == nil {
+		err = backup.checkEnvironment()
+	}
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	var spool *os.File
+	if !backup.DryRun {
+		spool, err = os.CreateTemp("", "restore-*.bson.gz")
+		if err != nil {
+			err = errors.New("RepoRestore: " + err.Error())
+			log.Err(err)
+			return RepoResponse{Error: err}
+		}
+		defer func() {
+			spool.Close()
+			os.Remove(spool.Name())
+		}()
+	}
+
+	var copied io.Writer
+	if spool != nil {
+		copied = spool
+	}
+	info, err := copyBackup(request, backup, database, copied)
+	if err == nil && spool != nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		err = errors.New("RepoRestore: " + err.Error())
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+	if backup.DryRun {
+		info.DryRun = true
+		return RepoResponse{TotalRows: info.totalDocuments(), List: info}
+	}
+
+	target, err := prepare()
+	if err == nil {
+		info, err = readBackup(spool, target)
+	}
+	if err != nil {
+		err = errors.New("RepoRestore: " + err.Error())
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	return RepoResponse{TotalRows: info.totalDocuments(), List: info}
+}
+
+// copyBackup checks the archive of the backup and copies it into spool when
+// it is not nil
+func copyBackup(request RepoRequest, backup BackupOptions, database string, spool io.Writer) (BackupInfo, error) {
+	files, err := NewFileRepository(backup.fileRequest(request, database, nil))
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	opened := files.Open()
+	if opened.Error != nil {
+		return BackupInfo{}, opened.Error
+	}
+	defer func() {
+		if closer, ok := files.GetFile().(io.Closer); ok {
+			closer.Close()
+		}
+		files.Close()
+	}()
+	if files.GetFile() == nil {
+		return BackupInfo{}, errors.New("backup not found: " + backup.ID)
+	}
+
+	var file io.Reader = files.GetFile()
+	if spool != nil {
+		file = io.TeeReader(file, spool)
+	}
+	info, err := readBackup(file, nil)
+	if err != nil {
+		return info, err
+	}
+	// readBackup stops at the end of the gzip stream, the copy must be whole
+	if spool != nil {
+		_, err = io.Copy(io.Discard, file)
+	}
+	return info, err
+}
@@ -0,0 +1,90 @@
+package foundation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryRepositoryBackupAndRestore(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("ENVIRONMENT", "test")
+
+	// the file repository needs a valid user
+	user := newMemoryTestUser()
+	user.Username = "backup"
+	repo := newMemoryTestRepo(t, "memory_test_backup", "memory_test", false)
+	seedMemoryTestModels(t, repo, user)
+	unique := Index{Keys: []IndexKey{{Field: "name", Type: IndexKeyAsc}}, Unique: true}
+	if response := repo.EnsureIndexes(RepoRequest{}, []Index{unique}); response.Error != nil {
+		t.Fatalf("EnsureIndexes(): %v", response.Error)
+	}
+
+	backup := BackupOptions{ID: "daily", Environment: "test"}
+	response := repo.RepoBackup(RepoRequest{User: user}, backup)
+	if response.Error != nil || response.TotalRows != 3 {
+		t.Fatalf("RepoBackup() = %+v", response)
+	}
+
+	extra := &memoryTestModel{Name: "Encina"}
+	if response := repo.Update(RepoRequest{Model: extra, User: user}); response.Error != nil {
+		t.Fatalf("Update(): %v", response.Error)
+	}
+
+	count := func() int64 {
+		t.Helper()
+		return repo.Count(RepoRequest{Model: &memoryTestModel{}}).TotalRows
+	}
+
+	dryRun := backup
+	dryRun.DryRun = true
+	response = repo.RepoRestore(RepoRequest{User: user}, dryRun)
+	if response.Error != nil || response.TotalRows != 3 || count() != 4 {
+		t.Fatalf("RepoRestore() dry run = %+v, count %d", response, count())
+	}
+	info := response.List.(BackupInfo)
+	if len(info.Collections) != 1 || info.Collections[0].Name != "memory_test" || len(info.Collections[0].Indexes) != 1 {
+		t.Fatalf("RepoRestore() dry run info = %+v", info)
+	}
+
+	wrong := backup
+	wrong.Environment = "local"
+	if response := repo.RepoRestore(RepoRequest{User: user}, wrong); response.Error == nil || count() != 4 {
+		t.Fatalf("RepoRestore() for another environment should fail")
+	}
+
+	// a truncated archive is refused before anything is dropped
+	archive := filepath.Join("file_repository", "backup", "memory_test_backup", "daily.bson.gz")
+	content, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatalf("ReadFile(): %v", err)
+	}
+	truncated := BackupOptions{ID: "truncated", Environment: "test"}
+	err = os.WriteFile(filepath.Join("file_repository", "backup", "memory_test_backup", "truncated.bson.gz"), content[:len(content)-20], 0o644)
+	if err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	if response := repo.RepoRestore(RepoRequest{User: user}, truncated); response.Error == nil || count() != 4 {
+		t.Fatalf("RepoRestore() of a truncated archive = %+v, count %d", response, count())
+	}
+
+	response = repo.RepoRestore(RepoRequest{User: user}, backup)
+	if response.Error != nil || count() != 3 {
+		t.Fatalf("RepoRestore() = %+v, count %d", response, count())
+	}
+	duplicated := &memoryTestModel{Name: "Olivo"}
+	if response := repo.Update(RepoRequest{Model: duplicated, User: user}); response.Error == nil {
+		t.Fatalf("Update() should fail on the restored unique index")
+	}
+
+	t.Setenv("ENVIRONMENT", "pro")
+	production := backup
+	production.Environment = "pro"
+	if response := repo.RepoRestore(RepoRequest{User: user}, production); response.Error == nil {
+		t.Fatalf("RepoRestore() in production without AllowProduction should fail")
+	}
+
+	if response := repo.RepoRestore(RepoRequest{User: user}, BackupOptions{ID: "missing", DryRun: true}); response.Error == nil {
+		t.Fatalf("RepoRestore() of a missing backup should fail")
+	}
+}
@@ -258,6 +258,14 @@ func (m *BaseModel) SetUpdated(user User) {
 	m.UpdatedBy = user.GetUserLog()
 }
 
+func (m *BaseModel) GetVersion() int {
+	return m.Version
+}
+
+func (m *BaseModel) SetVersion(version int) {
+	m.Version = version
+}
+
 func (m *BaseModel) ValidateBase() error {
 	// if m.FirmID == nil {
 	// 	return errors.New("ValidateBase: FirmID is empty")
@@ -301,9 +309,18 @@ type Model interface {
 	ToRaw()
 }
 
+// BulkList groups the items of Repository.BulkWrite: NewList is inserted,
+// UpdateList is upserted by ID or ExternalID and DeleteList is deleted.
 type BulkList struct {
 	NewList    []interface{}
 	UpdateList []interface{}
+	DeleteList []interface{}
+	// Stops at the first item that fails, otherwise every item is tried
+	Ordered bool
+	// Items sent to the server per request, DefaultBulkBatchSize when zero
+	BatchSize int
+	// NewList is inserted as it is, set by CreateMany
+	keepModels bool
 }
 
 // newbulks
@@ -311,6 +328,7 @@ func NewBulkList() *BulkList {
 	return &BulkList{
 		NewList:    make([]interface{}, 0),
 		UpdateList: make([]interface{}, 0),
+		DeleteList: make([]interface{}, 0),
 	}
 }
 
@@ -578,10 +596,23 @@ func (m *BaseModel) BaseFind(request *BaseRequest) BaseResponse {
 
 	result := request.Repo.Find(repoRequest)
 
-	// Enable for logs bbdd indexes
-	// println("•••••••••••••••••••••••••••••••••")
-	// fmt.Println("repoRequest.ToJSON()", repoRequest.ToJSON())
-	// println("•••••••••••••••••••••••••••••••••")
+	response := NewBaseResponseFromRepoResponse(result)
+
+	return response
+}
+
+// BaseFindStream is BaseFind passing the models to fn one at a time instead
+// of loading them in the response, for very large results
+func (m *BaseModel) BaseFindStream(request *BaseRequest, fn StreamFunc) BaseResponse {
+
+	err := request.Validate()
+	if err != nil {
+		return NewBaseResponseFromError(err)
+	}
+
+	repoRequest := request.GetRepoRequest()
+
+	result := request.Repo.FindStream(repoRequest, fn)
 
 	response := NewBaseResponseFromRepoResponse(result)
 
@@ -606,6 +637,45 @@ func (m *BaseModel) BaseCount(request *BaseRequest) BaseResponse {
 	return response
 }
 
+// BaseDistinct returns the values of field in the models of the request
+func (m *BaseModel) BaseDistinct(request *BaseRequest, field string) BaseResponse {
+
+	err := request.Validate()
+	if err != nil {
+		return NewBaseResponseFromError(err)
+	}
+
+	request.PageSize = 0
+
+	repoRequest := request.GetRepoRequest()
+
+	result := request.Repo.Distinct(repoRequest, field)
+
+	response := NewBaseResponseFromRepoResponse(result)
+
+	return response
+}
+
+// BaseCountFacets returns the Facets of the models of the request, for the
+// counts of the filters of a list
+func (m *BaseModel) BaseCountFacets(request *BaseRequest, facets FacetOptions) BaseResponse {
+
+	err := request.Validate()
+	if err != nil {
+		return NewBaseResponseFromError(err)
+	}
+
+	request.PageSize = 0
+
+	repoRequest := request.GetRepoRequest()
+
+	result := request.Repo.CountFacets(repoRequest, facets)
+
+	response := NewBaseResponseFromRepoResponse(result)
+
+	return response
+}
+
 func (m *BaseModel) BaseFindOne(request BaseRequest) BaseResponse {
 
 	response := NewBaseResponse()
@@ -647,12 +717,12 @@ func (m *BaseModel) BaseUpdate(request BaseRequest) BaseResponse {
 	}
 
 	repoRequest := RepoRequest{
-		Model: request.Model,
-		User:  request.User,
+		Model:        request.Model,
+		User:         request.User,
+		Context:      request.ctx,
+		CheckVersion: request.CheckVersion,
 	}
 
-	m.Version++
-
 	repoResponse := request.Repo.Update(repoRequest)
 
 	response := NewBaseResponseFromRepoResponse(repoResponse)
@@ -660,6 +730,21 @@ func (m *BaseModel) BaseUpdate(request BaseRequest) BaseResponse {
 	return response
 }
 
+func (m *BaseModel) BaseBulkWrite(request BaseRequest, list BulkList) BaseResponse {
+
+	if request.Repo == nil {
+		return BaseResponse{Error: errors.New("BaseModel.BaseBulkWrite: Repo is required")}
+	}
+
+	repoRequest := request.GetRepoRequest()
+
+	repoResponse := request.Repo.BulkWrite(repoRequest, list)
+
+	response := NewBaseResponseFromRepoResponse(repoResponse)
+
+	return response
+}
+
 func (m *BaseModel) BaseUpdateMany(request BaseRequest, values map[string]interface{}) BaseResponse {
 
 	if request.Repo == nil {
@@ -670,6 +755,7 @@ func (m *BaseModel) BaseUpdateMany(request BaseRequest, values map[string]interf
 		Model:       request.Model,
 		User:        request.User,
 		FindOptions: request.findOptions,
+		Context:     request.ctx,
 	}
 
 	repoResponse := request.Repo.UpdateMany(repoRequest, values)
@@ -689,6 +775,7 @@ func (m *BaseModel) BaseUpdateField(request BaseRequest, field string, value int
 		Model:       request.Model,
 		User:        request.User,
 		FindOptions: request.findOptions,
+		Context:     request.ctx,
 	}
 
 	repoResponse := request.Repo.UpdateField(repoRequest, field, value)
@@ -705,8 +792,9 @@ func (m *BaseModel) BaseSwitchItemInArray(request *BaseRequest, field string, va
 	}
 
 	repoRequest := RepoRequest{
-		User: request.User,
-		ID:   m.GetIDStr(),
+		User:    request.User,
+		ID:      m.GetIDStr(),
+		Context: request.ctx,
 	}
 
 	result := request.Repo.SwitchItemInArray(repoRequest, field, value)
@@ -726,8 +814,9 @@ func (m *BaseModel) BaseRemoveItemInArray(request *BaseRequest, field string, va
 	}
 
 	repoRequest := RepoRequest{
-		User: request.User,
-		ID:   m.GetIDStr(),
+		User:    request.User,
+		ID:      m.GetIDStr(),
+		Context: request.ctx,
 	}
 
 	result := request.Repo.RemoveItemInArray(repoRequest, field, value)
@@ -747,8 +836,9 @@ func (m *BaseModel) BaseAddItemInArray(request *BaseRequest) BaseResponse {
 	}
 
 	repoRequest := RepoRequest{
-		User: request.User,
-		ID:   m.GetIDStr(),
+		User:    request.User,
+		ID:      m.GetIDStr(),
+		Context: request.ctx,
 	}
 
 	result := request.Repo.AddItemInArray(repoRequest, "notifications", request.ID.Hex())
@@ -802,6 +892,29 @@ func (m *BaseModel) BaseDeleteSoft(request BaseRequest) BaseResponse {
 
 }
 
+// BaseRestore undoes BaseDeleteSoft on the documents of the request filter
+func (m *BaseModel) BaseRestore(request BaseRequest) BaseResponse {
+
+	response := NewBaseResponse()
+
+	err := request.Validate()
+	if err != nil {
+		response.Error = err
+		return *response
+	}
+
+	m.SetRecover(request.User)
+
+	repoRequest := request.GetRepoRequest()
+
+	result := request.Repo.Restore(repoRequest)
+
+	response.Error = result.Error
+	response.TotalRows = result.TotalRows
+
+	return *response
+}
+
 func (m *BaseModel) BaseRemoveField(request BaseRequest, field string) BaseResponse {
 
 	response := NewBaseResponse()
@@ -1,6 +1,7 @@
 package foundation
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 
@@ -39,6 +40,18 @@ type BaseRequest struct {
 	Min        int
 	Total      int
 	Message    string
+	// Update fails with ConflictError when the stored version changed
+	CheckVersion bool
+	// Keyset pagination, see RepoRequest.CursorPaging
+	CursorPaging bool
+	Cursor       string
+	SkipCount    bool
+	// How SearchTerms are searched, SearchModeRegex by default
+	SearchMode SearchMode
+	// Fields returned by the reads, "-field" excludes it. See NewProjection.
+	Fields []string
+	// Context of the caller (e.g. the HTTP request) passed down to the driver
+	ctx context.Context
 }
 
 type SearchTerms []string
@@ -193,17 +206,43 @@ func (m *BaseRequest) GetFindOptions() *FindOptions {
 	return &m.findOptions
 }
 
+func (m *BaseRequest) SetContext(ctx context.Context) {
+	m.ctx = ctx
+}
+
+// GetContext returns the request context or context.Background if none was set
+func (m *BaseRequest) GetContext() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
 func (m *BaseRequest) GetRepoRequest() RepoRequest {
 
+	findOptions := m.findOptions
+	if findOptions.Projection.IsEmpty() && len(m.Fields) > 0 {
+		findOptions.Projection = NewProjection(m.Fields...)
+	}
+
 	return RepoRequest{
 		PageSize:         m.PageSize,
 		CurrentPage:      m.CurrentPage,
 		User:             m.User,
 		Model:            m.Model,
-		FindOptions:      m.findOptions,
+		FindOptions:      findOptions,
 		List:             m.List,
 		Pipeline:         m.findOptions.Pipeline,
 		TargetCollection: m.TargetCollection,
+		Context:          m.ctx,
+		CheckVersion:     m.CheckVersion,
+		CursorPaging:     m.CursorPaging,
+		Cursor:           m.Cursor,
+		SkipCount:        m.SkipCount,
+		IncludeDeleted:   m.IncludeDeleted,
+		SearchTerms:      m.SearchTerms,
+		SearchFields:     getSearchFields(m.Model),
+		SearchMode:       m.SearchMode,
 	}
 }
 
@@ -223,11 +262,17 @@ func (m *BaseRequest) Clone(model RepositoryModel) (*BaseRequest, error) {
 	cloneRequest.IDs = m.IDs
 	cloneRequest.ExcludedIDs = m.ExcludedIDs
 	cloneRequest.IncludeDeleted = m.IncludeDeleted
+	cloneRequest.CheckVersion = m.CheckVersion
 	cloneRequest.Language = m.Language
 	cloneRequest.Order = m.Order
 	cloneRequest.PageSize = m.PageSize
 	cloneRequest.CurrentPage = m.CurrentPage
+	cloneRequest.CursorPaging = m.CursorPaging
+	cloneRequest.Cursor = m.Cursor
+	cloneRequest.SkipCount = m.SkipCount
 	cloneRequest.SearchTerms = m.SearchTerms
+	cloneRequest.SearchMode = m.SearchMode
+	cloneRequest.Fields = m.Fields
 	cloneRequest.SourceID = m.SourceID
 	cloneRequest.findOptions = m.findOptions
 	cloneRequest.QueryField = m.QueryField
@@ -237,6 +282,7 @@ func (m *BaseRequest) Clone(model RepositoryModel) (*BaseRequest, error) {
 	cloneRequest.Min = m.Min
 	cloneRequest.DateRange = m.DateRange
 	cloneRequest.HTTPClient = m.HTTPClient
+	cloneRequest.ctx = m.ctx
 
 	return cloneRequest, nil
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"reflect"
 
 	"github.com/weitecit/pkg/log"
@@ -26,6 +27,8 @@ type BaseResponse struct {
 	Token         string      `json:"token"`
 	ExternalToken string      `json:"external_token"`
 	Status        string      `json:"status"`
+	// Continuation token of the next page when paging by cursor
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 func (m *BaseResponse) ToJSON() string {
@@ -46,10 +49,25 @@ func NewBaseResponseFromRepoResponse(repoResponse RepoResponse) BaseResponse {
 	baseResponse.PageSize = repoResponse.PageSize
 	baseResponse.CurrentPage = repoResponse.CurrentPage
 	baseResponse.List = repoResponse.List
+	baseResponse.NextCursor = repoResponse.NextCursor
+
+	baseResponse.Code = ErrorStatusCode(repoResponse.Error)
 
 	return *baseResponse
 }
 
+// ErrorStatusCode returns the HTTP status of the repository errors that have
+// one, 0 for the rest
+func ErrorStatusCode(err error) int {
+	if IsConflictError(err) {
+		return http.StatusConflict
+	}
+	if IsRecordLockedError(err) {
+		return http.StatusLocked
+	}
+	return 0
+}
+
 func NewBaseResponseFromError(err error) BaseResponse {
 	baseResponse := NewBaseResponse()
 	baseResponse.SetError(err)
@@ -0,0 +1,226 @@
+package foundation
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/weitecit/pkg/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const DefaultBulkBatchSize = 1000
+
+type BulkOperation utils.Enum
+
+const (
+	BulkOperationInsert BulkOperation = "insert"
+	BulkOperationUpsert BulkOperation = "upsert"
+	BulkOperationDelete BulkOperation = "delete"
+)
+
+// BulkResult is the outcome of one item of a BulkList. Index is the position
+// of the item in its list (NewList, UpdateList or DeleteList).
+type BulkResult struct {
+	Operation BulkOperation `json:"operation"`
+	Index     int           `json:"index"`
+	ID        string        `json:"id,omitempty"`
+	// The upsert inserted a new document
+	Upserted bool  `json:"upserted,omitempty"`
+	Error    error `json:"error,omitempty"`
+}
+
+// BulkItemError is the error of one item of a BulkList, returned in
+// RepoResponse.Errors
+type BulkItemError struct {
+	Operation BulkOperation
+	Index     int
+	Err       error
+}
+
+func (m *BulkItemError) Error() string {
+	return fmt.Sprintf("Repository.BulkWrite: %s %d: %s", m.Operation, m.Index, m.Err.Error())
+}
+
+func (m *BulkItemError) Unwrap() error {
+	return m.Err
+}
+
+// bulkItem is a BulkList item ready to be written by any repository
+type bulkItem struct {
+	operation BulkOperation
+	index     int
+	model     RepositoryModel
+	// Document of an insert, or the $set of an upsert
+	document bson.M
+	// Fields only written when an upsert inserts
+	onInsert bson.M
+	// Selects the document of an upsert or a delete
+	filter   bson.M
+	upserted bool
+	err      error
+}
+
+func (m *bulkItem) result() BulkResult {
+	result := BulkResult{
+		Operation: m.operation,
+		Index:     m.index,
+	}
+
+	ids := []interface{}{m.document["_id"], m.filter["_id"]}
+	if m.upserted {
+		result.Upserted = true
+		ids = append(ids, m.onInsert["_id"])
+	}
+
+	for _, id := range ids {
+		switch id := id.(type) {
+		case *primitive.ObjectID:
+			result.ID = id.Hex()
+			return result
+		case primitive.ObjectID:
+			result.ID = id.Hex()
+			return result
+		}
+	}
+
+	return result
+}
+
+// prepareBulkItems calls the hooks of the models, stamps their UserLogs and
+// builds the items in the order they are written: inserts, upserts and
+// deletes. A hook error fails its item.
+func prepareBulkItems(request RepoRequest, list BulkList) []bulkItem {
+	items := []bulkItem{}
+	user := request.User
+
+	for i, model := range list.NewList {
+		item := bulkItem{operation: BulkOperationInsert, index: i}
+		if repoModel, ok := model.(RepositoryModel); ok && list.keepModels {
+			// only the models never stored get an ID and a CreatedBy
+			if repoModel.IsNew() {
+				repoModel.SetCreated(user)
+			}
+			item.model = repoModel
+		} else if ok {
+			if hook, ok := repoModel.(BeforeCreateHook); ok {
+				request.Model = repoModel
+				if err := hookError("BeforeCreate", hook.BeforeCreate(request)); err != nil {
+					item.err = err
+					items = append(items, item)
+					continue
+				}
+			}
+			increaseVersion(repoModel)
+			repoModel.SetUpdated(user)
+			repoModel.SetCreated(user)
+			item.model = repoModel
+		}
+		item.document, item.err = toMemoryDocument(model)
+		if item.err == nil {
+			if _, ok := item.document["_id"]; !ok {
+				item.document["_id"] = primitive.NewObjectID()
+			}
+		}
+		items = append(items, item)
+	}
+
+	for i, model := range list.UpdateList {
+		item := bulkItem{operation: BulkOperationUpsert, index: i}
+		item.model, item.filter, item.err = bulkFilter(model)
+		if hook, ok := item.model.(BeforeUpdateHook); ok && item.err == nil {
+			request.Model = item.model
+			item.err = hookError("BeforeUpdate", hook.BeforeUpdate(request))
+		}
+		if item.err == nil {
+			item.model.SetUpdated(user)
+			item.document, item.onInsert, item.err = bulkUpsertDocument(item.model, user)
+		}
+		items = append(items, item)
+	}
+
+	for i, model := range list.DeleteList {
+		item := bulkItem{operation: BulkOperationDelete, index: i}
+		item.model, item.filter, item.err = bulkFilter(model)
+		if hook, ok := item.model.(BeforeDeleteHook); ok && item.err == nil {
+			request.Model = item.model
+			item.err = hookError("BeforeDelete", hook.BeforeDelete(request))
+		}
+		items = append(items, item)
+	}
+
+	return items
+}
+
+// bulkFilter selects a model by its ID or, when it has none, its ExternalID
+func bulkFilter(model interface{}) (RepositoryModel, bson.M, error) {
+	repoModel, ok := model.(RepositoryModel)
+	if !ok {
+		return nil, nil, errors.New("item is not a RepositoryModel")
+	}
+
+	id, err := repoModel.GetID()
+	if err == nil {
+		return repoModel, bson.M{"_id": id}, nil
+	}
+
+	if synchronizable, ok := model.(interface{ GetExternalID() string }); ok && synchronizable.GetExternalID() != "" {
+		return repoModel, bson.M{"external_id": synchronizable.GetExternalID()}, nil
+	}
+
+	return repoModel, nil, errors.New("item needs an ID or an ExternalID")
+}
+
+// bulkUpsertDocument splits the model in the fields to $set and the ones only
+// set when the upsert inserts. Version is increased apart with $inc.
+func bulkUpsertDocument(model RepositoryModel, user User) (bson.M, bson.M, error) {
+	document, err := toMemoryDocument(model)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	onInsert := bson.M{
+		"created_by": user.GetUserLog(),
+	}
+	if document["_id"] == nil {
+		onInsert["_id"] = primitive.NewObjectID()
+	}
+
+	delete(document, "_id")
+	delete(document, "created_by")
+	delete(document, "version")
+
+	return document, onInsert, nil
+}
+
+// setUpserted marks an upsert that inserted, and gives its model the new ID
+func (m *bulkItem) setUpserted() {
+	m.upserted = true
+	if id, ok := m.onInsert["_id"].(primitive.ObjectID); ok {
+		m.model.SetID(id.Hex())
+	}
+}
+
+// bulkResponse returns the results of the items written, with the errors of
+// the failed ones also in RepoResponse.Errors
+func bulkResponse(items []bulkItem, written int) RepoResponse {
+	response := RepoResponse{
+		Errors: []error{},
+	}
+
+	results := []BulkResult{}
+	for _, item := range items[:written] {
+		result := item.result()
+		if item.err != nil {
+			result.Error = item.err
+			response.Errors = append(response.Errors, &BulkItemError{Operation: item.operation, Index: item.index, Err: item.err})
+		} else {
+			response.TotalRows++
+		}
+		results = append(results, result)
+	}
+	response.List = results
+
+	return response
+}
@@ -0,0 +1,171 @@
+package foundation
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// cursorToken is the content of the opaque continuation token used by keyset
+// pagination: the sort keys of the query and the values of the last row.
+type cursorToken struct {
+	Keys   []string `bson:"k"`
+	Values bson.A   `bson:"v"`
+}
+
+// cursorOrders returns the orders of a keyset query. "id" is mapped to "_id"
+// and _id is always the last key so every row has a unique position.
+func cursorOrders(findOptions FindOptions) []Order {
+	orders := []Order{}
+	hasID := false
+
+	if findOptions.Order != nil {
+		for _, order := range findOptions.Order.List() {
+			if order.Field == "id" {
+				order.Field = "_id"
+			}
+			if order.Direction == 0 {
+				order.Direction = 1
+			}
+			if order.Field == "_id" {
+				hasID = true
+			}
+			orders = append(orders, order)
+		}
+	}
+
+	if !hasID {
+		orders = append(orders, Order{Field: "_id", Direction: 1})
+	}
+
+	return orders
+}
+
+// cursorSort keeps the order of the keys, which a map can not
+func cursorSort(orders []Order) bson.D {
+	result := bson.D{}
+	for _, order := range orders {
+		result = append(result, bson.E{Key: order.Field, Value: order.Direction})
+	}
+	return result
+}
+
+func cursorKeys(orders []Order) []string {
+	keys := []string{}
+	for _, order := range orders {
+		keys = append(keys, order.Field+":"+strconv.Itoa(order.Direction))
+	}
+	return keys
+}
+
+func encodeCursor(orders []Order, values bson.A) (string, error) {
+	raw, err := bson.Marshal(cursorToken{Keys: cursorKeys(orders), Values: values})
+	if err != nil {
+		return "", errors.New("Cursor.Encode: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func decodeCursor(orders []Order, cursor string) (bson.A, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.New("Cursor.Decode: invalid cursor")
+	}
+
+	token := cursorToken{}
+	err = bson.Unmarshal(raw, &token)
+	if err != nil {
+		return nil, errors.New("Cursor.Decode: invalid cursor")
+	}
+
+	keys := cursorKeys(orders)
+	if len(token.Keys) != len(keys) || len(token.Values) != len(keys) {
+		return nil, errors.New("Cursor.Decode: cursor does not match the order of the query")
+	}
+	for i, key := range keys {
+		if token.Keys[i] != key {
+			return nil, errors.New("Cursor.Decode: cursor does not match the order of the query")
+		}
+	}
+
+	return token.Values, nil
+}
+
+// cursorFilter returns the filter of the rows after the cursor, or nil when
+// there is no cursor. Missing and null values sort first, as in MongoDB.
+func cursorFilter(orders []Order, cursor string) (bson.M, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	values, err := decodeCursor(orders, cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	branches := bson.A{}
+	for i, order := range orders {
+		branch := bson.A{}
+		for j := 0; j < i; j++ {
+			branch = append(branch, bson.M{orders[j].Field: values[j]})
+		}
+
+		value := values[i]
+		switch {
+		case order.Direction > 0 && value == nil:
+			branch = append(branch, bson.M{order.Field: bson.M{"$ne": nil}})
+		case order.Direction > 0:
+			branch = append(branch, bson.M{order.Field: bson.M{"$gt": value}})
+		case value == nil:
+			// nothing sorts after null in descending order
+			continue
+		default:
+			branch = append(branch, bson.M{"$or": bson.A{
+				bson.M{order.Field: bson.M{"$lt": value}},
+				bson.M{order.Field: nil},
+			}})
+		}
+
+		branches = append(branches, bson.M{"$and": branch})
+	}
+
+	return bson.M{"$or": branches}, nil
+}
+
+// nextCursor trims a list fetched with pageSize+1 rows to pageSize and returns
+// the token of its last row, or "" when there are no more rows. The values of
+// the token are read from documents, the rows as stored, since the decoded
+// list loses the fields a model omits when empty or does not have.
+func nextCursor(orders []Order, documents []bson.M, list interface{}, pageSize int64) (interface{}, string, error) {
+	if pageSize <= 0 {
+		return list, "", nil
+	}
+
+	value := reflect.ValueOf(list)
+	if value.Kind() != reflect.Slice || int64(value.Len()) <= pageSize {
+		return list, "", nil
+	}
+	if len(documents) != value.Len() {
+		return list, "", errors.New("Cursor.Next: the rows do not match the list")
+	}
+
+	value = value.Slice(0, int(pageSize))
+
+	last := documents[pageSize-1]
+	values := bson.A{}
+	for _, order := range orders {
+		// a missing field sorts as null, as in MongoDB
+		item, _ := lookupMemoryPath(last, order.Field)
+		values = append(values, item)
+	}
+
+	cursor, err := encodeCursor(orders, values)
+	if err != nil {
+		return list, "", err
+	}
+
+	return value.Interface(), cursor, nil
+}
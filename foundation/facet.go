@@ -0,0 +1,270 @@
+package foundation
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// FacetOptions are the counts CountFacets returns for the documents of a
+// query, e.g. for the filters of a list with "draft (12), completed (40)"
+type FacetOptions struct {
+	// Count per label of BaseModel.Labels
+	Labels bool `json:"labels,omitempty"`
+	// Count per key and value of BaseModel.Tags
+	Tags bool `json:"tags,omitempty"`
+	// Count per value of each field. The items of an array field are counted
+	// one by one, like Distinct does.
+	Fields []string `json:"fields,omitempty"`
+}
+
+func (m FacetOptions) Validate() error {
+	for _, field := range m.Fields {
+		if field == "" {
+			return errors.New("FacetOptions.Validate: field can not be empty")
+		}
+	}
+	return nil
+}
+
+// FacetCount is the number of documents with a value
+type FacetCount struct {
+	Value interface{} `json:"value"`
+	Count int64       `json:"count"`
+}
+
+type TagFacetCount struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// Facets is returned in RepoResponse.List by CountFacets. The counts are
+// sorted by Count, the highest first.
+type Facets struct {
+	Total  int64                   `json:"total"`
+	Labels []FacetCount            `json:"labels,omitempty"`
+	Tags   []TagFacetCount         `json:"tags,omitempty"`
+	Fields map[string][]FacetCount `json:"fields,omitempty"`
+}
+
+// stages of the $facet that counts the options, the fields by position since
+// their path can not name an output
+func (m FacetOptions) stages() bson.M {
+	stages := bson.M{"total": bson.A{bson.M{"$count": "count"}}}
+	if m.Labels {
+		stages["labels"] = facetFieldStages("labels")
+	}
+	if m.Tags {
+		stages["tags"] = bson.A{
+			bson.M{"$unwind": "$tags"},
+			bson.M{"$group": bson.M{"_id": bson.M{"key": "$tags.key", "value": "$tags.value"}, "count": bson.M{"$sum": 1}}},
+		}
+	}
+	for i, field := range m.Fields {
+		stages["field_"+strconv.Itoa(i)] = facetFieldStages(field)
+	}
+	return stages
+}
+
+// facetFieldStages count the values of a field. The $project resolves paths
+// through arrays, e.g. "tags.key", and the $unwind counts the items.
+func facetFieldStages(field string) bson.A {
+	return bson.A{
+		bson.M{"$project": bson.M{"value": "$" + field}},
+		bson.M{"$unwind": "$value"},
+		bson.M{"$group": bson.M{"_id": "$value", "count": bson.M{"$sum": 1}}},
+	}
+}
+
+// facets reads the result of the $facet of stages
+func (m FacetOptions) facets(result bson.M) Facets {
+	groups := func(name string) []bson.M {
+		items, _ := asMemoryArray(result[name])
+		list := []bson.M{}
+		for _, item := range items {
+			if group, ok := asMemoryDocument(item); ok {
+				list = append(list, group)
+			}
+		}
+		return list
+	}
+	count := func(group bson.M) int64 {
+		count, _ := asMemoryNumber(group["count"])
+		return int64(count)
+	}
+
+	facets := Facets{}
+	for _, group := range groups("total") {
+		facets.Total = count(group)
+	}
+
+	counter := func(name string) []FacetCount {
+		counter := &facetCounter{}
+		for _, group := range groups(name) {
+			counter.add(group["_id"], count(group))
+		}
+		return counter.sorted()
+	}
+
+	if m.Labels {
+		facets.Labels = counter("labels")
+	}
+	if m.Tags {
+		tags := &tagFacetCounter{}
+		for _, group := range groups("tags") {
+			tag, _ := asMemoryDocument(group["_id"])
+			tags.add(tag, count(group))
+		}
+		facets.Tags = tags.sorted()
+	}
+	if len(m.Fields) > 0 {
+		facets.Fields = map[string][]FacetCount{}
+		for i, field := range m.Fields {
+			facets.Fields[field] = counter("field_" + strconv.Itoa(i))
+		}
+	}
+	return facets
+}
+
+// countFacets counts the options over documents, the way the $facet of stages
+// does
+func (m FacetOptions) countFacets(documents []bson.M) Facets {
+	facets := Facets{Total: int64(len(documents))}
+
+	count := func(field string) []FacetCount {
+		counter := &facetCounter{}
+		for _, document := range documents {
+			for _, value := range fieldValues(document, field) {
+				counter.add(value, 1)
+			}
+		}
+		return counter.sorted()
+	}
+
+	if m.Labels {
+		facets.Labels = count("labels")
+	}
+	if m.Tags {
+		tags := &tagFacetCounter{}
+		for _, document := range documents {
+			items, _ := asMemoryArray(document["tags"])
+			for _, item := range items {
+				tag, _ := asMemoryDocument(item)
+				tags.add(tag, 1)
+			}
+		}
+		facets.Tags = tags.sorted()
+	}
+	if len(m.Fields) > 0 {
+		facets.Fields = map[string][]FacetCount{}
+		for _, field := range m.Fields {
+			facets.Fields[field] = count(field)
+		}
+	}
+	return facets
+}
+
+// fieldValues returns the values of a field of a document, the items of an
+// array one by one. Missing and null values are left out.
+func fieldValues(document bson.M, field string) []interface{} {
+	value, found := lookupMemoryPath(document, field)
+	if !found || value == nil {
+		return nil
+	}
+	items, ok := asMemoryArray(value)
+	if !ok {
+		return []interface{}{value}
+	}
+	values := []interface{}{}
+	for _, item := range items {
+		if item != nil {
+			values = append(values, item)
+		}
+	}
+	return values
+}
+
+// distinctValues returns the values without repeating them, sorted
+func distinctValues(values []interface{}) []interface{} {
+	distinct := []interface{}{}
+	for _, value := range values {
+		repeated := false
+		for _, seen := range distinct {
+			if memoryValuesEqual(seen, value) {
+				repeated = true
+				break
+			}
+		}
+		if !repeated {
+			distinct = append(distinct, value)
+		}
+	}
+	sort.SliceStable(distinct, func(i, j int) bool {
+		return compareMemoryValues(distinct[i], distinct[j]) < 0
+	})
+	return distinct
+}
+
+type facetCounter struct {
+	counts []FacetCount
+}
+
+func (m *facetCounter) add(value interface{}, count int64) {
+	if value == nil {
+		return
+	}
+	for i := range m.counts {
+		if memoryValuesEqual(m.counts[i].Value, value) {
+			m.counts[i].Count += count
+			return
+		}
+	}
+	m.counts = append(m.counts, FacetCount{Value: value, Count: count})
+}
+
+func (m *facetCounter) sorted() []FacetCount {
+	counts := append([]FacetCount{}, m.counts...)
+	sort.SliceStable(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return compareMemoryValues(counts[i].Value, counts[j].Value) < 0
+	})
+	return counts
+}
+
+type tagFacetCounter struct {
+	counts []TagFacetCount
+}
+
+func (m *tagFacetCounter) add(tag bson.M, count int64) {
+	key, _ := tag["key"].(string)
+	value, _ := tag["value"].(string)
+	if key == "" {
+		return
+	}
+	for i := range m.counts {
+		if m.counts[i].Key == key && m.counts[i].Value == value {
+			m.counts[i].Count += count
+			return
+		}
+	}
+	m.counts = append(m.counts, TagFacetCount{Key: key, Value: value, Count: count})
+}
+
+func (m *tagFacetCounter) sorted() []TagFacetCount {
+	counts := append([]TagFacetCount{}, m.counts...)
+	sort.SliceStable(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		if counts[i].Key != counts[j].Key {
+			return counts[i].Key < counts[j].Key
+		}
+		return counts[i].Value < counts[j].Value
+	})
+	return counts
+}
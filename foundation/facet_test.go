@@ -0,0 +1,42 @@
+package foundation
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestFacetOptionsReadsFacetResult(t *testing.T) {
+	options := FacetOptions{Labels: true, Tags: true, Fields: []string{"status"}}
+
+	stages := options.stages()
+	for _, name := range []string{"total", "labels", "tags", "field_0"} {
+		if _, ok := stages[name]; !ok {
+			t.Fatalf("stages() = %v, want the %s facet", stages, name)
+		}
+	}
+
+	result := bson.M{
+		"total":  bson.A{bson.M{"count": int32(52)}},
+		"labels": bson.A{bson.M{"_id": "draft", "count": int32(12)}, bson.M{"_id": "completed", "count": int32(40)}},
+		"tags": bson.A{
+			bson.M{"_id": bson.M{"key": "crop", "value": "olive"}, "count": int32(3)},
+			bson.M{"_id": bson.M{"key": "crop", "value": "almond"}, "count": int32(9)},
+		},
+		"field_0": bson.A{bson.M{"_id": "open", "count": int32(7)}},
+	}
+
+	facets := options.facets(result)
+	if facets.Total != 52 {
+		t.Fatalf("Total = %d, want 52", facets.Total)
+	}
+	if len(facets.Labels) != 2 || facets.Labels[0] != (FacetCount{Value: "completed", Count: 40}) {
+		t.Fatalf("Labels = %v, want completed (40) first", facets.Labels)
+	}
+	if len(facets.Tags) != 2 || facets.Tags[0] != (TagFacetCount{Key: "crop", Value: "almond", Count: 9}) {
+		t.Fatalf("Tags = %v, want crop=almond (9) first", facets.Tags)
+	}
+	if status := facets.Fields["status"]; len(status) != 1 || status[0] != (FacetCount{Value: "open", Count: 7}) {
+		t.Fatalf("Fields = %v, want open (7)", facets.Fields)
+	}
+}
@@ -0,0 +1,114 @@
+package foundation
+
+import (
+	"errors"
+
+	"github.com/weitecit/pkg/utils"
+)
+
+type FilterGroup utils.Enum
+
+const (
+	FilterGroupAnd FilterGroup = "and"
+	FilterGroupOr  FilterGroup = "or"
+	FilterGroupNot FilterGroup = "not"
+)
+
+// FilterNode is a node of a filter tree: a Filter, or a group of nodes
+// combined with AND, OR or NOT. Groups nest at any depth, e.g.
+//
+//	NewAndFilter(
+//		NewFilterNode("status", FilterOperatorEquals, "open"),
+//		NewOrFilter(
+//			NewFilterNode("title", FilterOperatorContains, "texto"),
+//			NewNotFilter(NewFilterNode("reference", FilterOperatorNil, nil)),
+//		),
+//	)
+type FilterNode struct {
+	// Empty for a Filter
+	Group  FilterGroup  `json:"group,omitempty"`
+	Filter *Filter      `json:"filter,omitempty"`
+	Nodes  []FilterNode `json:"nodes,omitempty"`
+}
+
+func NewFilterNode(key string, operator FilterOperator, value interface{}) FilterNode {
+	filter := NewFilter(key, operator, value)
+	return FilterNode{Filter: &filter}
+}
+
+func NewAndFilter(nodes ...FilterNode) FilterNode {
+	return FilterNode{Group: FilterGroupAnd, Nodes: nodes}
+}
+
+func NewOrFilter(nodes ...FilterNode) FilterNode {
+	return FilterNode{Group: FilterGroupOr, Nodes: nodes}
+}
+
+func NewNotFilter(node FilterNode) FilterNode {
+	return FilterNode{Group: FilterGroupNot, Nodes: []FilterNode{node}}
+}
+
+func (m FilterNode) IsGroup() bool {
+	return m.Group != ""
+}
+
+func (m FilterNode) Validate() error {
+	if !m.IsGroup() {
+		if m.Filter == nil || m.Filter.Key == "" {
+			return errors.New("FilterNode.Validate: filter needs a key")
+		}
+		return nil
+	}
+
+	switch m.Group {
+	case FilterGroupAnd, FilterGroupOr:
+		if len(m.Nodes) == 0 {
+			return errors.New("FilterNode.Validate: " + string(m.Group) + " group without filters")
+		}
+	case FilterGroupNot:
+		if len(m.Nodes) != 1 {
+			return errors.New("FilterNode.Validate: not group needs one filter")
+		}
+	default:
+		return errors.New("FilterNode.Validate: unknown group: " + string(m.Group))
+	}
+
+	for _, node := range m.Nodes {
+		err := node.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isEmpty tells whether the tree has no filter
+func (m *FilterNode) isEmpty() bool {
+	return m == nil || (m.Filter == nil && len(m.Nodes) == 0)
+}
+
+// hasKey tells whether some filter of the tree is on key
+func (m FilterNode) hasKey(key string) bool {
+	if m.Filter != nil && m.Filter.Key == key {
+		return true
+	}
+	for _, node := range m.Nodes {
+		if node.hasKey(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddTree adds a filter tree, ANDed with the Filters, FiltersOr and the trees
+// already added
+func (m *FindOptions) AddTree(node FilterNode) {
+	if m.Tree == nil {
+		m.Tree = &node
+		return
+	}
+
+	tree := NewAndFilter(*m.Tree, node)
+	m.Tree = &tree
+}
@@ -0,0 +1,217 @@
+package foundation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/weitecit/pkg/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// FilterValueType is how the value of a Filter is interpreted. A slice value
+// of a scalar type (e.g. the ObjectIDs of an "in") converts each item.
+type FilterValueType utils.Enum
+
+const (
+	FilterValueString   FilterValueType = "string"
+	FilterValueDate     FilterValueType = "date"
+	FilterValueObjectID FilterValueType = "objectid"
+	FilterValueNumber   FilterValueType = "number"
+	FilterValueBool     FilterValueType = "bool"
+	// The items are used as they are
+	FilterValueArray FilterValueType = "array"
+)
+
+// Layouts of the FilterValueDate strings
+var filterDateLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"}
+
+// NewFilter returns a filter typed after its value, so it keeps its meaning
+// after a JSON round trip
+func NewFilter(key string, operator FilterOperator, value interface{}) Filter {
+	return Filter{Key: key, Operator: operator, Value: value, Type: filterValueType(value)}
+}
+
+func filterValueType(value interface{}) FilterValueType {
+	switch value.(type) {
+	case nil:
+		return ""
+	case time.Time, *time.Time:
+		return FilterValueDate
+	case primitive.ObjectID, *primitive.ObjectID:
+		return FilterValueObjectID
+	case json.Number:
+		return FilterValueNumber
+	case bson.D, []byte:
+		return ""
+	}
+
+	reflected := reflect.ValueOf(value)
+	switch {
+	case reflected.Kind() == reflect.String:
+		return FilterValueString
+	case reflected.Kind() == reflect.Bool:
+		return FilterValueBool
+	case isFilterNumber(reflected):
+		return FilterValueNumber
+	case reflected.Kind() == reflect.Slice:
+		// all the items of the same type, otherwise as they are
+		itemType := FilterValueType("")
+		for i := 0; i < reflected.Len(); i++ {
+			current := filterValueType(reflected.Index(i).Interface())
+			if current == "" || current == FilterValueArray || i > 0 && current != itemType {
+				return FilterValueArray
+			}
+			itemType = current
+		}
+		if itemType == "" {
+			return FilterValueArray
+		}
+		return itemType
+	}
+
+	return ""
+}
+
+func isFilterNumber(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// GetValue returns the value converted to Type. Without Type the value is used
+// as it is.
+func (m Filter) GetValue() (interface{}, error) {
+	if m.Type == "" || m.Value == nil {
+		return m.Value, nil
+	}
+
+	if m.Type == FilterValueArray {
+		return filterValueArray(m.Value)
+	}
+
+	reflected := reflect.ValueOf(m.Value)
+	if reflected.Kind() == reflect.Slice {
+		values := bson.A{}
+		for i := 0; i < reflected.Len(); i++ {
+			value, err := convertFilterValue(m.Type, reflected.Index(i).Interface())
+			if err != nil {
+				return nil, m.valueError(err)
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+
+	value, err := convertFilterValue(m.Type, m.Value)
+	if err != nil {
+		return nil, m.valueError(err)
+	}
+	return value, nil
+}
+
+func (m Filter) valueError(err error) error {
+	return errors.New("Filter.GetValue: " + m.Key + ": " + err.Error())
+}
+
+func filterValueArray(value interface{}) (interface{}, error) {
+	reflected := reflect.ValueOf(value)
+	if reflected.Kind() != reflect.Slice {
+		return nil, errors.New("Filter.GetValue: array value is not a list")
+	}
+	values := bson.A{}
+	for i := 0; i < reflected.Len(); i++ {
+		values = append(values, reflected.Index(i).Interface())
+	}
+	return values, nil
+}
+
+func convertFilterValue(valueType FilterValueType, value interface{}) (interface{}, error) {
+	switch valueType {
+	case FilterValueString:
+		if text, ok := value.(string); ok {
+			return text, nil
+		}
+		return fmt.Sprint(value), nil
+
+	case FilterValueDate:
+		switch date := value.(type) {
+		case time.Time:
+			return date, nil
+		case *time.Time:
+			return date, nil
+		case string:
+			for _, layout := range filterDateLayouts {
+				parsed, err := time.Parse(layout, date)
+				if err == nil {
+					return parsed, nil
+				}
+			}
+			return nil, errors.New("invalid date: " + date)
+		}
+
+	case FilterValueObjectID:
+		switch id := value.(type) {
+		case primitive.ObjectID:
+			return id, nil
+		case *primitive.ObjectID:
+			return id, nil
+		case string:
+			objectID, err := primitive.ObjectIDFromHex(id)
+			if err != nil {
+				return nil, errors.New("invalid ObjectID: " + id)
+			}
+			return objectID, nil
+		}
+
+	case FilterValueNumber:
+		switch number := value.(type) {
+		case json.Number:
+			if integer, err := number.Int64(); err == nil {
+				return integer, nil
+			}
+			return number.Float64()
+		case string:
+			if integer, err := strconv.ParseInt(number, 10, 64); err == nil {
+				return integer, nil
+			}
+			float, err := strconv.ParseFloat(number, 64)
+			if err != nil {
+				return nil, errors.New("invalid number: " + number)
+			}
+			return float, nil
+		}
+		if isFilterNumber(reflect.ValueOf(value)) {
+			return value, nil
+		}
+
+	case FilterValueBool:
+		switch boolean := value.(type) {
+		case bool:
+			return boolean, nil
+		case string:
+			parsed, err := strconv.ParseBool(boolean)
+			if err != nil {
+				return nil, errors.New("invalid bool: " + boolean)
+			}
+			return parsed, nil
+		}
+		if reflect.ValueOf(value).Kind() == reflect.Bool {
+			return value, nil
+		}
+
+	default:
+		return nil, errors.New("unknown value type: " + string(valueType))
+	}
+
+	return nil, fmt.Errorf("%T is not a valid %s", value, valueType)
+}
@@ -0,0 +1,677 @@
+package foundation
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/weitecit/pkg/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type GeometryType utils.Enum
+
+const (
+	GeometryPoint           GeometryType = "Point"
+	GeometryMultiPoint      GeometryType = "MultiPoint"
+	GeometryLineString      GeometryType = "LineString"
+	GeometryMultiLineString GeometryType = "MultiLineString"
+	GeometryPolygon         GeometryType = "Polygon"
+	GeometryMultiPolygon    GeometryType = "MultiPolygon"
+)
+
+// Radius of the Earth in meters, the one of the WGS84 ellipsoid
+const earthRadius = 6378137.0
+
+// Geometry is a GeoJSON geometry, the way MongoDB stores it for the 2dsphere
+// indexes (see NewGeoIndex). Positions are [longitude, latitude]. Models keep
+// it in a field like:
+//
+//	Location *Geometry `json:"location,omitempty" bson:"location,omitempty"`
+type Geometry struct {
+	Type        GeometryType `json:"type" bson:"type"`
+	Coordinates interface{}  `json:"coordinates" bson:"coordinates"`
+}
+
+func NewPoint(longitude float64, latitude float64) Geometry {
+	return Geometry{Type: GeometryPoint, Coordinates: []float64{longitude, latitude}}
+}
+
+func NewLineString(positions ...[]float64) Geometry {
+	return Geometry{Type: GeometryLineString, Coordinates: positions}
+}
+
+// NewPolygon returns a polygon of rings of positions, the first one the outer
+// ring and the others its holes. Rings that are not closed are closed.
+func NewPolygon(rings ...[][]float64) Geometry {
+	return Geometry{Type: GeometryPolygon, Coordinates: closeGeoRings(rings)}
+}
+
+func NewMultiPolygon(polygons ...[][][]float64) Geometry {
+	coordinates := [][][][]float64{}
+	for _, rings := range polygons {
+		coordinates = append(coordinates, closeGeoRings(rings))
+	}
+	return Geometry{Type: GeometryMultiPolygon, Coordinates: coordinates}
+}
+
+func closeGeoRings(rings [][][]float64) [][][]float64 {
+	closed := [][][]float64{}
+	for _, ring := range rings {
+		if len(ring) > 0 && !reflect.DeepEqual(ring[0], ring[len(ring)-1]) {
+			ring = append(append([][]float64{}, ring...), ring[0])
+		}
+		closed = append(closed, ring)
+	}
+	return closed
+}
+
+func (m Geometry) Validate() error {
+	shape, err := m.shape()
+	if err != nil {
+		return err
+	}
+
+	for _, position := range shape.positions() {
+		if position[0] < -180 || position[0] > 180 || position[1] < -90 || position[1] > 90 {
+			return errors.New("Geometry.Validate: position out of range: " + position.String())
+		}
+	}
+	for _, line := range shape.lines {
+		if len(line) < 2 {
+			return errors.New("Geometry.Validate: a line needs 2 positions")
+		}
+	}
+	for _, polygon := range shape.polygons {
+		for _, ring := range polygon {
+			if len(ring) < 4 || ring[0] != ring[len(ring)-1] {
+				return errors.New("Geometry.Validate: a ring needs 4 positions and to be closed")
+			}
+		}
+	}
+	return nil
+}
+
+// Area of the polygons of the geometry in square meters, without their holes.
+// Points and lines have no area.
+func (m Geometry) Area() (float64, error) {
+	shape, err := m.shape()
+	if err != nil {
+		return 0, err
+	}
+
+	area := 0.0
+	for _, polygon := range shape.polygons {
+		for i, ring := range polygon {
+			if i == 0 {
+				area += ring.area()
+			} else {
+				area -= ring.area()
+			}
+		}
+	}
+	return area, nil
+}
+
+// Centroid of the geometry as a Point: the center of mass of the polygons,
+// the middle of the lines or the mean of the points. It is computed on the
+// plane of the coordinates, which is close enough for fields and plots.
+func (m Geometry) Centroid() (Geometry, error) {
+	shape, err := m.shape()
+	if err != nil {
+		return Geometry{}, err
+	}
+
+	var x, y, weight float64
+	add := func(position geoPosition, w float64) {
+		x += position[0] * w
+		y += position[1] * w
+		weight += w
+	}
+
+	for _, polygon := range shape.polygons {
+		for i, ring := range polygon {
+			center, area := ring.centroid()
+			if i > 0 {
+				area = -area
+			}
+			add(center, area)
+		}
+	}
+	if weight == 0 {
+		for _, line := range shape.lines {
+			for i := 1; i < len(line); i++ {
+				length := math.Hypot(line[i][0]-line[i-1][0], line[i][1]-line[i-1][1])
+				add(geoPosition{(line[i][0] + line[i-1][0]) / 2, (line[i][1] + line[i-1][1]) / 2}, length)
+			}
+		}
+	}
+	if weight == 0 {
+		// degenerate shapes fall back to the mean of their positions
+		for _, position := range shape.positions() {
+			add(position, 1)
+		}
+	}
+	if weight == 0 {
+		return Geometry{}, errors.New("Geometry.Centroid: geometry has no positions")
+	}
+
+	return NewPoint(x/weight, y/weight), nil
+}
+
+// GeoNear is the value of FilterOperatorNear
+type GeoNear struct {
+	Point Geometry `json:"point" bson:"point"`
+	// In meters, no limit when 0
+	MaxDistance float64 `json:"max_distance,omitempty" bson:"max_distance,omitempty"`
+	MinDistance float64 `json:"min_distance,omitempty" bson:"min_distance,omitempty"`
+}
+
+// toGeometry reads a geometry from a filter value or a stored document. A
+// legacy [longitude, latitude] pair is a Point.
+func toGeometry(value interface{}) (Geometry, error) {
+	switch geometry := value.(type) {
+	case Geometry:
+		return geometry, nil
+	case *Geometry:
+		if geometry == nil {
+			return Geometry{}, errors.New("geometry is nil")
+		}
+		return *geometry, nil
+	}
+
+	if _, ok := asMemoryDocument(value); !ok {
+		if _, ok := geoList(value); ok {
+			return Geometry{Type: GeometryPoint, Coordinates: value}, nil
+		}
+	}
+
+	geometry := Geometry{}
+	err := convertGeoValue(value, &geometry)
+	if err != nil || geometry.Type == "" {
+		return Geometry{}, errors.New("invalid geometry")
+	}
+	return geometry, nil
+}
+
+func toGeoNear(value interface{}) (GeoNear, error) {
+	switch near := value.(type) {
+	case GeoNear:
+		return near, nil
+	case *GeoNear:
+		if near == nil {
+			return GeoNear{}, errors.New("near is nil")
+		}
+		return *near, nil
+	}
+
+	near := GeoNear{}
+	err := convertGeoValue(value, &near)
+	if err != nil {
+		return GeoNear{}, errors.New("invalid near")
+	}
+	return near, nil
+}
+
+// convertGeoValue decodes a document, e.g. a filter value after a JSON round
+// trip, into target
+func convertGeoValue(value interface{}, target interface{}) error {
+	raw, err := bson.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, target)
+}
+
+// geoFilterItem translates the geo operators for getFilterItem
+func geoFilterItem(filter Filter) (interface{}, error) {
+	if filter.Operator == FilterOperatorNear {
+		near, err := toGeoNear(filter.Value)
+		if err != nil {
+			return nil, errors.New("MongoRepository.getFilterItem: " + filter.Key + ": " + err.Error())
+		}
+		condition := bson.M{"$geometry": near.Point}
+		if near.MaxDistance > 0 {
+			condition["$maxDistance"] = near.MaxDistance
+		}
+		if near.MinDistance > 0 {
+			condition["$minDistance"] = near.MinDistance
+		}
+		return bson.M{"$near": condition}, nil
+	}
+
+	geometry, err := toGeometry(filter.Value)
+	if err != nil {
+		return nil, errors.New("MongoRepository.getFilterItem: " + filter.Key + ": " + err.Error())
+	}
+	operator := "$geoWithin"
+	if filter.Operator == FilterOperatorGeoIntersects {
+		operator = "$geoIntersects"
+	}
+	return bson.M{operator: bson.M{"$geometry": geometry}}, nil
+}
+
+// countFilter returns the filter for CountDocuments, which runs an
+// aggregation where $near is not allowed. Each $near is rewritten as a
+// $geoWithin of a $centerSphere of its $maxDistance, outside the one of its
+// $minDistance. filter is not changed.
+func countFilter(filter map[string]interface{}) map[string]interface{} {
+	result, _ := countFilterValue(bson.M(filter)).(bson.M)
+	return result
+}
+
+func countFilterValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case bson.M:
+		return countFilterDocument(value)
+	case map[string]interface{}:
+		return countFilterDocument(value)
+	case []bson.M:
+		list := []bson.M{}
+		for _, item := range value {
+			list = append(list, countFilterDocument(item))
+		}
+		return list
+	case bson.A:
+		list := bson.A{}
+		for _, item := range value {
+			list = append(list, countFilterValue(item))
+		}
+		return list
+	case []interface{}:
+		list := bson.A{}
+		for _, item := range value {
+			list = append(list, countFilterValue(item))
+		}
+		return list
+	}
+	return value
+}
+
+func countFilterDocument(document map[string]interface{}) bson.M {
+	result := bson.M{}
+	clauses := bson.A{}
+	for key, value := range document {
+		if condition, ok := asMemoryDocument(value); ok && !strings.HasPrefix(key, "$") {
+			if near, ok := asMemoryDocument(condition["$near"]); ok {
+				clauses = append(clauses, nearCountClauses(key, near)...)
+				continue
+			}
+		}
+		result[key] = countFilterValue(value)
+	}
+	if len(clauses) == 0 {
+		return result
+	}
+	if len(result) > 0 {
+		clauses = append(bson.A{result}, clauses...)
+	}
+	return bson.M{"$and": clauses}
+}
+
+// nearCountClauses match the documents a $near on field matches
+func nearCountClauses(field string, near bson.M) bson.A {
+	clauses := bson.A{bson.M{field: bson.M{"$exists": true}}}
+
+	geometry, err := toGeometry(near["$geometry"])
+	if err != nil {
+		return clauses
+	}
+	point, err := parseGeoPosition(geometry.Coordinates)
+	if err != nil {
+		return clauses
+	}
+
+	sphere := func(distance float64) bson.M {
+		return bson.M{"$geoWithin": bson.M{"$centerSphere": bson.A{bson.A{point[0], point[1]}, distance / earthRadius}}}
+	}
+	if maxDistance, ok := asMemoryNumber(near["$maxDistance"]); ok && maxDistance > 0 {
+		clauses = append(clauses, bson.M{field: sphere(maxDistance)})
+	}
+	if minDistance, ok := asMemoryNumber(near["$minDistance"]); ok && minDistance > 0 {
+		clauses = append(clauses, bson.M{"$nor": bson.A{bson.M{field: sphere(minDistance)}}})
+	}
+	return clauses
+}
+
+// geoPosition is [longitude, latitude]
+type geoPosition [2]float64
+
+func (m geoPosition) String() string {
+	return "[" + strconv.FormatFloat(m[0], 'f', -1, 64) + ", " + strconv.FormatFloat(m[1], 'f', -1, 64) + "]"
+}
+
+// distance in meters along the surface of the Earth
+func (m geoPosition) distance(other geoPosition) float64 {
+	lat1, lat2 := geoRadians(m[1]), geoRadians(other[1])
+	dLat := lat2 - lat1
+	dLng := geoRadians(other[0] - m[0])
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+type geoRing []geoPosition
+
+// area on the sphere, in square meters
+func (m geoRing) area() float64 {
+	area := 0.0
+	for i := 0; i+1 < len(m); i++ {
+		area += geoRadians(m[i+1][0]-m[i][0]) * (2 + math.Sin(geoRadians(m[i][1])) + math.Sin(geoRadians(m[i+1][1])))
+	}
+	return math.Abs(area * earthRadius * earthRadius / 2)
+}
+
+// centroid on the plane, with the area of the ring on the plane as weight
+func (m geoRing) centroid() (geoPosition, float64) {
+	var x, y, area float64
+	for i := 0; i+1 < len(m); i++ {
+		cross := m[i][0]*m[i+1][1] - m[i+1][0]*m[i][1]
+		area += cross
+		x += (m[i][0] + m[i+1][0]) * cross
+		y += (m[i][1] + m[i+1][1]) * cross
+	}
+	if area == 0 {
+		return geoPosition{}, 0
+	}
+	return geoPosition{x / (3 * area), y / (3 * area)}, math.Abs(area / 2)
+}
+
+// contains tells whether the position is inside the ring, on the plane
+func (m geoRing) contains(position geoPosition) bool {
+	inside := false
+	for i, j := 0, len(m)-1; i < len(m); j, i = i, i+1 {
+		a, b := m[i], m[j]
+		if (a[1] > position[1]) != (b[1] > position[1]) &&
+			position[0] < (b[0]-a[0])*(position[1]-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+type geoPolygon []geoRing
+
+func (m geoPolygon) contains(position geoPosition) bool {
+	if len(m) == 0 || !m[0].contains(position) {
+		return false
+	}
+	for _, hole := range m[1:] {
+		if hole.contains(position) {
+			return false
+		}
+	}
+	return true
+}
+
+// geoShape is a parsed Geometry
+type geoShape struct {
+	points   []geoPosition
+	lines    [][]geoPosition
+	polygons []geoPolygon
+}
+
+func (m Geometry) shape() (geoShape, error) {
+	shape := geoShape{}
+	var err error
+
+	switch m.Type {
+	case GeometryPoint:
+		var point geoPosition
+		point, err = parseGeoPosition(m.Coordinates)
+		shape.points = []geoPosition{point}
+	case GeometryMultiPoint:
+		shape.points, err = parseGeoLine(m.Coordinates)
+	case GeometryLineString:
+		var line []geoPosition
+		line, err = parseGeoLine(m.Coordinates)
+		shape.lines = [][]geoPosition{line}
+	case GeometryMultiLineString:
+		items, _ := geoList(m.Coordinates)
+		for _, item := range items {
+			line, lineErr := parseGeoLine(item)
+			if lineErr != nil {
+				err = lineErr
+				break
+			}
+			shape.lines = append(shape.lines, line)
+		}
+	case GeometryPolygon:
+		var polygon geoPolygon
+		polygon, err = parseGeoPolygon(m.Coordinates)
+		shape.polygons = []geoPolygon{polygon}
+	case GeometryMultiPolygon:
+		items, _ := geoList(m.Coordinates)
+		for _, item := range items {
+			polygon, polygonErr := parseGeoPolygon(item)
+			if polygonErr != nil {
+				err = polygonErr
+				break
+			}
+			shape.polygons = append(shape.polygons, polygon)
+		}
+	default:
+		return shape, errors.New("Geometry: unsupported type: " + string(m.Type))
+	}
+
+	if err != nil {
+		return shape, errors.New("Geometry: " + string(m.Type) + ": " + err.Error())
+	}
+	return shape, nil
+}
+
+func (m geoShape) positions() []geoPosition {
+	positions := append([]geoPosition{}, m.points...)
+	for _, line := range m.lines {
+		positions = append(positions, line...)
+	}
+	for _, polygon := range m.polygons {
+		for _, ring := range polygon {
+			positions = append(positions, ring...)
+		}
+	}
+	return positions
+}
+
+// segments of the lines and the rings
+func (m geoShape) segments() [][2]geoPosition {
+	segments := [][2]geoPosition{}
+	add := func(line []geoPosition) {
+		for i := 1; i < len(line); i++ {
+			segments = append(segments, [2]geoPosition{line[i-1], line[i]})
+		}
+	}
+	for _, line := range m.lines {
+		add(line)
+	}
+	for _, polygon := range m.polygons {
+		for _, ring := range polygon {
+			add(ring)
+		}
+	}
+	return segments
+}
+
+func (m geoShape) contains(position geoPosition) bool {
+	for _, polygon := range m.polygons {
+		if polygon.contains(position) {
+			return true
+		}
+	}
+	return false
+}
+
+// within tells whether all the positions of the shape are inside the
+// polygons of other, the way $geoWithin matches
+func (m geoShape) within(other geoShape) bool {
+	positions := m.positions()
+	if len(positions) == 0 || len(other.polygons) == 0 {
+		return false
+	}
+	for _, position := range positions {
+		if !other.contains(position) {
+			return false
+		}
+	}
+	return true
+}
+
+// intersects tells whether the shapes share some position, the way
+// $geoIntersects matches
+func (m geoShape) intersects(other geoShape) bool {
+	for _, position := range m.positions() {
+		if other.contains(position) || other.touches(position) {
+			return true
+		}
+	}
+	for _, position := range other.positions() {
+		if m.contains(position) || m.touches(position) {
+			return true
+		}
+	}
+	for _, a := range m.segments() {
+		for _, b := range other.segments() {
+			if geoSegmentsIntersect(a, b) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// touches tells whether the position is one of the points of the shape or on
+// one of its segments
+func (m geoShape) touches(position geoPosition) bool {
+	for _, point := range m.points {
+		if point == position {
+			return true
+		}
+	}
+	for _, segment := range m.segments() {
+		if geoOrientation(segment[0], segment[1], position) == 0 && geoOnSegment(segment, position) {
+			return true
+		}
+	}
+	return false
+}
+
+// distance in meters from the position to the shape, 0 inside its polygons
+func (m geoShape) distance(position geoPosition) float64 {
+	if m.contains(position) {
+		return 0
+	}
+	distance := math.Inf(1)
+	for _, other := range m.positions() {
+		distance = math.Min(distance, position.distance(other))
+	}
+	return distance
+}
+
+func geoSegmentsIntersect(a [2]geoPosition, b [2]geoPosition) bool {
+	o1 := geoOrientation(a[0], a[1], b[0])
+	o2 := geoOrientation(a[0], a[1], b[1])
+	o3 := geoOrientation(b[0], b[1], a[0])
+	o4 := geoOrientation(b[0], b[1], a[1])
+	if o1 != o2 && o3 != o4 {
+		return true
+	}
+	return o1 == 0 && geoOnSegment(a, b[0]) || o2 == 0 && geoOnSegment(a, b[1]) ||
+		o3 == 0 && geoOnSegment(b, a[0]) || o4 == 0 && geoOnSegment(b, a[1])
+}
+
+func geoOrientation(a geoPosition, b geoPosition, c geoPosition) int {
+	value := (b[1]-a[1])*(c[0]-b[0]) - (b[0]-a[0])*(c[1]-b[1])
+	switch {
+	case value > 0:
+		return 1
+	case value < 0:
+		return -1
+	}
+	return 0
+}
+
+// geoOnSegment tells whether a position in line with the segment is on it
+func geoOnSegment(segment [2]geoPosition, position geoPosition) bool {
+	return position[0] >= math.Min(segment[0][0], segment[1][0]) && position[0] <= math.Max(segment[0][0], segment[1][0]) &&
+		position[1] >= math.Min(segment[0][1], segment[1][1]) && position[1] <= math.Max(segment[0][1], segment[1][1])
+}
+
+func geoRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+func parseGeoPosition(value interface{}) (geoPosition, error) {
+	items, ok := geoList(value)
+	if !ok || len(items) < 2 {
+		return geoPosition{}, errors.New("a position needs a longitude and a latitude")
+	}
+	longitude, ok := geoNumber(items[0])
+	if !ok {
+		return geoPosition{}, errors.New("longitude is not a number")
+	}
+	latitude, ok := geoNumber(items[1])
+	if !ok {
+		return geoPosition{}, errors.New("latitude is not a number")
+	}
+	return geoPosition{longitude, latitude}, nil
+}
+
+func parseGeoLine(value interface{}) ([]geoPosition, error) {
+	items, ok := geoList(value)
+	if !ok {
+		return nil, errors.New("positions must be a list")
+	}
+	line := []geoPosition{}
+	for _, item := range items {
+		position, err := parseGeoPosition(item)
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, position)
+	}
+	return line, nil
+}
+
+func parseGeoPolygon(value interface{}) (geoPolygon, error) {
+	items, ok := geoList(value)
+	if !ok || len(items) == 0 {
+		return nil, errors.New("a polygon needs rings")
+	}
+	polygon := geoPolygon{}
+	for _, item := range items {
+		ring, err := parseGeoLine(item)
+		if err != nil {
+			return nil, err
+		}
+		polygon = append(polygon, ring)
+	}
+	return polygon, nil
+}
+
+// geoList returns the items of the coordinates, whether they were built with
+// typed slices or decoded from BSON or JSON
+func geoList(value interface{}) ([]interface{}, bool) {
+	reflected := reflect.ValueOf(value)
+	if !reflected.IsValid() || reflected.Kind() != reflect.Slice && reflected.Kind() != reflect.Array {
+		return nil, false
+	}
+	items := make([]interface{}, reflected.Len())
+	for i := range items {
+		items[i] = reflected.Index(i).Interface()
+	}
+	return items, true
+}
+
+func geoNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case float32:
+		return float64(number), true
+	case json.Number:
+		result, err := number.Float64()
+		return result, err == nil
+	}
+	return asMemoryNumber(value)
+}
@@ -0,0 +1,146 @@
+package foundation
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestGeometryAreaAndCentroid(t *testing.T) {
+	// 0.01 degrees of side at the equator, about 1113 m
+	square := NewPolygon([][]float64{{0, 0}, {0.01, 0}, {0.01, 0.01}, {0, 0.01}})
+	if err := square.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	area, err := square.Area()
+	if err != nil {
+		t.Fatalf("Area() error = %v", err)
+	}
+	if math.Abs(area-1.2392e6)/1.2392e6 > 0.01 {
+		t.Fatalf("Area() = %f, want about 1.2392e6", area)
+	}
+
+	withHole := NewPolygon(
+		[][]float64{{0, 0}, {0.01, 0}, {0.01, 0.01}, {0, 0.01}},
+		[][]float64{{0, 0}, {0.005, 0}, {0.005, 0.01}, {0, 0.01}},
+	)
+	holed, _ := withHole.Area()
+	if math.Abs(holed-area/2)/area > 0.01 {
+		t.Fatalf("Area() with a hole = %f, want about %f", holed, area/2)
+	}
+
+	centroid, err := withHole.Centroid()
+	if err != nil {
+		t.Fatalf("Centroid() error = %v", err)
+	}
+	position, _ := parseGeoPosition(centroid.Coordinates)
+	if math.Abs(position[0]-0.0075) > 1e-9 || math.Abs(position[1]-0.005) > 1e-9 {
+		t.Fatalf("Centroid() = %v, want [0.0075, 0.005]", position)
+	}
+
+	if err := NewPoint(200, 0).Validate(); err == nil {
+		t.Fatalf("Validate() of a longitude out of range should fail")
+	}
+}
+
+func TestGeoFilterItems(t *testing.T) {
+	repo := &MongoRepository{}
+
+	findOptions := NewFindOptions()
+	findOptions.AddComplex("location", FilterOperatorNear, GeoNear{Point: NewPoint(-1.1, 37.9), MaxDistance: 5000})
+	findOptions.AddComplex("area", FilterOperatorGeoWithin, NewPolygon([][]float64{{0, 0}, {1, 0}, {1, 1}}))
+
+	// the filters keep their meaning after a JSON round trip
+	raw, err := json.Marshal(findOptions)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	decoded := FindOptions{}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+
+	for _, options := range []FindOptions{*findOptions, decoded} {
+		filter, err := repo.GetFilter(options)
+		if err != nil {
+			t.Fatalf("GetFilter() error = %v", err)
+		}
+		and, _ := filter["$and"].([]bson.M)
+		if len(and) != 2 {
+			t.Fatalf("GetFilter() = %v, want 2 conditions", filter)
+		}
+
+		near := and[0]["location"].(bson.M)["$near"].(bson.M)
+		point, err := toGeometry(near["$geometry"])
+		if err != nil || point.Type != GeometryPoint || near["$maxDistance"] != 5000.0 {
+			t.Fatalf("$near = %v, want the point and $maxDistance 5000", near)
+		}
+
+		within := and[1]["area"].(bson.M)["$geoWithin"].(bson.M)
+		polygon, err := toGeometry(within["$geometry"])
+		if err != nil || polygon.Type != GeometryPolygon {
+			t.Fatalf("$geoWithin = %v, want a polygon", within)
+		}
+		if err := polygon.Validate(); err != nil {
+			t.Fatalf("$geoWithin polygon: %v", err)
+		}
+	}
+}
+
+func TestCountFilterRewritesNear(t *testing.T) {
+	repo := &MongoRepository{}
+
+	findOptions := NewFindOptions()
+	findOptions.AddEquals("name", "Dentro")
+	findOptions.AddComplex("location", FilterOperatorNear, GeoNear{Point: NewPoint(-1.1, 37.9), MaxDistance: 5000, MinDistance: 100})
+
+	filter, err := repo.GetFilter(*findOptions)
+	if err != nil {
+		t.Fatalf("GetFilter() error = %v", err)
+	}
+	filter = searchFilter(notDeletedFilter(filter, RepoRequest{}), RepoRequest{})
+
+	count := countFilter(filter)
+	raw, err := json.Marshal(count)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	text := string(raw)
+	if strings.Contains(text, "$near") {
+		t.Fatalf("countFilter() = %s, still has $near", text)
+	}
+	for _, want := range []string{`"$centerSphere":[[-1.1,37.9],` + strconv.FormatFloat(5000/earthRadius, 'g', -1, 64) + `]`, `"$nor"`, `"name":"Dentro"`, `"deleted_by"`} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("countFilter() = %s, want %s", text, want)
+		}
+	}
+
+	// the filter of the find keeps its $near
+	raw, _ = json.Marshal(filter)
+	if !strings.Contains(string(raw), "$near") {
+		t.Fatalf("countFilter() changed the find filter: %s", raw)
+	}
+
+	// the count filter also runs on the memory matcher
+	memory := &MemoryRepository{}
+	normalized, err := memory.normalizeFilter(count)
+	if err != nil {
+		t.Fatalf("normalizeFilter() error = %v", err)
+	}
+	location := NewPoint(-1.12, 37.9)
+	document, _ := toMemoryDocument(bson.M{"name": "Dentro", "location": location})
+	if matched, err := matchMemoryDocument(document, normalized); err != nil || !matched {
+		t.Fatalf("count filter matched = %v, %v, want true", matched, err)
+	}
+	for _, location := range []Geometry{NewPoint(-1.03, 37.9), NewPoint(-1.1, 37.9)} {
+		document, _ := toMemoryDocument(bson.M{"name": "Dentro", "location": location})
+		if matched, err := matchMemoryDocument(document, normalized); err != nil || matched {
+			t.Fatalf("count filter matched %v = %v, %v, want false past the max and within the min distance", location.Coordinates, matched, err)
+		}
+	}
+}
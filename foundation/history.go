@@ -0,0 +1,297 @@
+package foundation
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/weitecit/pkg/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type HistoryOperation utils.Enum
+
+const (
+	HistoryOperationCreate      HistoryOperation = "create"
+	HistoryOperationUpdate      HistoryOperation = "update"
+	HistoryOperationUpdateField HistoryOperation = "update_field"
+	HistoryOperationUpdateMany  HistoryOperation = "update_many"
+	HistoryOperationDeleteSoft  HistoryOperation = "delete_soft"
+	HistoryOperationDelete      HistoryOperation = "delete"
+)
+
+// HistoricalModel is implemented by models that keep a History record of
+// every write made with them as RepoRequest.Model
+type HistoricalModel interface {
+	KeepHistory() bool
+}
+
+func keepsHistory(model RepositoryModel) bool {
+	historical, ok := model.(HistoricalModel)
+	return ok && historical.KeepHistory()
+}
+
+// Fields not compared by the diff of a History, they change on every write or,
+// like the edit lock, are not data
+var historyIgnoredFields = []string{"updated_by", "version", "locked_by"}
+
+// HistoryChange is the value of a field before and after a write
+type HistoryChange struct {
+	Field  string      `json:"field" bson:"field"`
+	Before interface{} `json:"before,omitempty" bson:"before,omitempty"`
+	After  interface{} `json:"after,omitempty" bson:"after,omitempty"`
+}
+
+// History is a write of a document of a HistoricalModel, kept in the
+// collection of the model with the "_history" suffix
+type History struct {
+	BaseModel       `bson:",inline"`
+	DocumentID      string           `json:"document_id" bson:"document_id"`
+	Operation       HistoryOperation `json:"operation" bson:"operation"`
+	Actor           *UserLog         `json:"actor" bson:"actor"`
+	DocumentVersion int              `json:"document_version" bson:"document_version"`
+	Changes         []HistoryChange  `json:"changes,omitempty" bson:"changes,omitempty"`
+	// The document after the write, or before it for deletes
+	Document   bson.M `json:"document" bson:"document"`
+	collection string
+	isGlobal   bool
+}
+
+// NewHistory returns a History of the collection of model, to use as the
+// model of its repository
+func NewHistory(model RepositoryModel) *History {
+	collection, isGlobal := model.GetCollection()
+	return &History{collection: collection, isGlobal: isGlobal}
+}
+
+func (m *History) GetCollection() (name string, isGlobal bool) {
+	return historyCollection(m.collection), m.isGlobal
+}
+
+func (m *History) GetRepoType() RepoType {
+	return RepoTypeMongoDB
+}
+
+func historyCollection(collection string) string {
+	return collection + "_history"
+}
+
+// historyIDs returns the _id of the documents
+func historyIDs(documents []bson.M) bson.A {
+	ids := bson.A{}
+	for _, document := range documents {
+		ids = append(ids, document["_id"])
+	}
+	return ids
+}
+
+// newHistories returns the History records of a write from the documents it
+// changed, read before and after it. Documents only in after are created and
+// only in before are deleted.
+func newHistories(operation HistoryOperation, user User, before []bson.M, after []bson.M) []interface{} {
+	actor := user.GetUserLog()
+
+	previous := map[string]bson.M{}
+	for _, document := range before {
+		previous[memoryIDKey(document["_id"])] = document
+	}
+
+	records := []interface{}{}
+	for _, document := range after {
+		id := memoryIDKey(document["_id"])
+		old, found := previous[id]
+		delete(previous, id)
+
+		record := &History{DocumentID: id, Operation: operation, Actor: actor, Document: document}
+		record.ID = utils.NewID()
+		record.DocumentVersion = historyVersion(document)
+		if !found {
+			record.Operation = HistoryOperationCreate
+			records = append(records, record)
+			continue
+		}
+
+		record.Changes = diffHistory(old, document)
+		if len(record.Changes) > 0 {
+			records = append(records, record)
+		}
+	}
+
+	for _, document := range before {
+		id := memoryIDKey(document["_id"])
+		if _, deleted := previous[id]; !deleted {
+			continue
+		}
+		record := &History{DocumentID: id, Operation: HistoryOperationDelete, Actor: actor, Document: document}
+		record.ID = utils.NewID()
+		record.DocumentVersion = historyVersion(document)
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func historyVersion(document bson.M) int {
+	version, _ := asMemoryNumber(document["version"])
+	return int(version)
+}
+
+// diffHistory returns the top level fields that differ, sorted by name
+func diffHistory(before bson.M, after bson.M) []HistoryChange {
+	fields := []string{}
+	for field := range before {
+		fields = append(fields, field)
+	}
+	for field := range after {
+		if _, ok := before[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := []HistoryChange{}
+	for _, field := range fields {
+		if utils.ArrayContentStr(historyIgnoredFields, field) {
+			continue
+		}
+		if !memoryValuesEqual(before[field], after[field]) {
+			changes = append(changes, HistoryChange{Field: field, Before: before[field], After: after[field]})
+		}
+	}
+	return changes
+}
+
+// FindHistory returns in RepoResponse.List the History records of the
+// document request.ID of the collection of request.Model, the newest first
+func FindHistory(repo Repository, request RepoRequest) RepoResponse {
+	if repo == nil || request.Model == nil {
+		return RepoResponse{Error: errors.New("FindHistory: repository and model are required")}
+	}
+	if request.ID == "" {
+		return RepoResponse{Error: errors.New("FindHistory: ID can not be empty")}
+	}
+
+	historyRepo, err := CloneRepository(repo, NewHistory(request.Model))
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	findOptions := NewFindOptions()
+	findOptions.AddEquals("document_id", request.ID)
+	findOptions.AddOrderDesc("actor.time", "_id")
+
+	return historyRepo.Find(RepoRequest{
+		Model:       NewHistory(request.Model),
+		FindOptions: *findOptions,
+		List:        []*History{},
+		Context:     request.Context,
+		PageSize:    request.PageSize,
+		CurrentPage: request.CurrentPage,
+	})
+}
+
+// RestoreHistory updates request.Model, with the ID of the document, to the
+// last record of its History with the given version. The restore is an
+// Update, so it gets a new version and its own History record. Deleted
+// documents can not be restored.
+func RestoreHistory(repo Repository, request RepoRequest, version int) RepoResponse {
+	if request.Model == nil {
+		return RepoResponse{Error: errors.New("RestoreHistory: model can not be empty")}
+	}
+
+	id, err := request.Model.GetID()
+	if err != nil {
+		return RepoResponse{Error: errors.New("RestoreHistory: " + err.Error())}
+	}
+	request.ID = memoryIDKey(historyObjectID(id))
+	request.PageSize = 0
+	request.CurrentPage = 0
+
+	response := FindHistory(repo, request)
+	if response.Error != nil {
+		return response
+	}
+	records, _ := response.List.([]*History)
+	if len(records) == 0 {
+		return RepoResponse{Error: errors.New("RestoreHistory: " + request.ID + " has no history")}
+	}
+
+	current := records[0]
+	if current.Operation == HistoryOperationDelete {
+		return RepoResponse{Error: errors.New("RestoreHistory: " + request.ID + " is deleted")}
+	}
+
+	var target *History
+	for _, record := range records {
+		if record.DocumentVersion == version && record.Operation != HistoryOperationDelete {
+			target = record
+			break
+		}
+	}
+	if target == nil {
+		return RepoResponse{Error: errors.New("RestoreHistory: " + request.ID + " has no version " + strconv.Itoa(version))}
+	}
+
+	raw, err := bson.Marshal(target.Document)
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
+	// fields missing in the record are empty in the restored model
+	model := reflect.ValueOf(request.Model)
+	if model.Kind() == reflect.Ptr && !model.IsNil() {
+		model.Elem().Set(reflect.Zero(model.Elem().Type()))
+	}
+	err = bson.Unmarshal(raw, request.Model)
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	// Update increases the current version, not the restored one
+	restoreVersion(request.Model, current.DocumentVersion)
+	request.CheckVersion = false
+
+	return repo.Update(request)
+}
+
+func historyObjectID(id interface{}) interface{} {
+	if objectID, ok := id.(*primitive.ObjectID); ok && objectID != nil {
+		return *objectID
+	}
+	return id
+}
+
+// BaseHistory lists the History of the model, see FindHistory
+func (m *BaseModel) BaseHistory(request BaseRequest) BaseResponse {
+	if request.Repo == nil {
+		return BaseResponse{Error: errors.New("BaseModel.BaseHistory: Repo is required")}
+	}
+
+	repoRequest := RepoRequest{
+		ID:          m.GetIDStr(),
+		Model:       request.Model,
+		Context:     request.ctx,
+		PageSize:    request.PageSize,
+		CurrentPage: request.CurrentPage,
+	}
+
+	return NewBaseResponseFromRepoResponse(FindHistory(request.Repo, repoRequest))
+}
+
+// BaseRestoreHistory restores request.Model to a version of its History, see
+// RestoreHistory
+func (m *BaseModel) BaseRestoreHistory(request BaseRequest, version int) BaseResponse {
+	if request.Repo == nil {
+		return BaseResponse{Error: errors.New("BaseModel.BaseRestoreHistory: Repo is required")}
+	}
+
+	repoRequest := RepoRequest{
+		Model:   request.Model,
+		User:    request.User,
+		Context: request.ctx,
+	}
+
+	return NewBaseResponseFromRepoResponse(RestoreHistory(request.Repo, repoRequest, version))
+}
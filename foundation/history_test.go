@@ -0,0 +1,97 @@
+package foundation
+
+import (
+	"testing"
+)
+
+type memoryHistoryModel struct {
+	BaseModel `bson:",inline"`
+	Name      string `json:"name" bson:"name"`
+	Amount    int    `json:"amount" bson:"amount"`
+}
+
+func (m *memoryHistoryModel) GetCollection() (name string, isGlobal bool) {
+	return "memory_test", false
+}
+
+func (m *memoryHistoryModel) GetRepoType() RepoType {
+	return RepoTypeMemory
+}
+
+func (m *memoryHistoryModel) KeepHistory() bool {
+	return true
+}
+
+func TestMemoryRepositoryHistory(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_history", "memory_test", false)
+
+	model := &memoryHistoryModel{}
+	model.Name = "Almendro"
+	model.Amount = 10
+	if response := repo.Update(RepoRequest{Model: model, User: user}); response.Error != nil {
+		t.Fatalf("Update(): %v", response.Error)
+	}
+	model.Amount = 20
+	if response := repo.Update(RepoRequest{Model: model, User: user}); response.Error != nil {
+		t.Fatalf("Update(): %v", response.Error)
+	}
+
+	findOptions := NewFindOptions()
+	findOptions.AddEquals("_id", model.ID)
+	if response := repo.UpdateField(RepoRequest{Model: model, User: user, FindOptions: *findOptions}, "name", "Olivo"); response.Error != nil {
+		t.Fatalf("UpdateField(): %v", response.Error)
+	}
+
+	// models without history do not write it
+	if response := repo.Update(RepoRequest{Model: &memoryTestModel{Name: "Viña"}, User: user}); response.Error != nil {
+		t.Fatalf("Update(): %v", response.Error)
+	}
+
+	history := func() []*History {
+		t.Helper()
+		response := FindHistory(repo, RepoRequest{Model: model, ID: model.GetIDStr()})
+		if response.Error != nil {
+			t.Fatalf("FindHistory(): %v", response.Error)
+		}
+		return response.List.([]*History)
+	}
+
+	records := history()
+	if len(records) != 3 {
+		t.Fatalf("FindHistory() = %d records, want 3", len(records))
+	}
+	operations := []HistoryOperation{HistoryOperationUpdateField, HistoryOperationUpdate, HistoryOperationCreate}
+	for i, record := range records {
+		if record.Operation != operations[i] || record.Actor == nil || record.Actor.User != user.GetIDStr() {
+			t.Fatalf("FindHistory()[%d] = %+v", i, record)
+		}
+	}
+	changes := records[1].Changes
+	if len(changes) != 1 || changes[0].Field != "amount" || records[1].DocumentVersion != 2 {
+		t.Fatalf("Update history = %+v", records[1])
+	}
+	if before, _ := asMemoryNumber(changes[0].Before); before != 10 {
+		t.Fatalf("Update history before = %v, want 10", changes[0].Before)
+	}
+
+	restored := &memoryHistoryModel{}
+	restored.ID = model.ID
+	if response := RestoreHistory(repo, RepoRequest{Model: restored, User: user}, 1); response.Error != nil {
+		t.Fatalf("RestoreHistory(): %v", response.Error)
+	}
+	if restored.Name != "Almendro" || restored.Amount != 10 || restored.Version != 3 {
+		t.Fatalf("RestoreHistory() = %+v", restored)
+	}
+
+	if response := repo.Delete(RepoRequest{Model: model, User: user}); response.Error != nil || len(response.Errors) > 0 {
+		t.Fatalf("Delete() = %+v", response)
+	}
+	records = history()
+	if len(records) != 5 || records[0].Operation != HistoryOperationDelete || records[0].Document["name"] != "Almendro" {
+		t.Fatalf("Delete history = %+v", records[0])
+	}
+	if response := RestoreHistory(repo, RepoRequest{Model: restored, User: user}, 1); response.Error == nil {
+		t.Fatalf("RestoreHistory() of a deleted document should fail")
+	}
+}
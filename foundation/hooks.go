@@ -0,0 +1,133 @@
+package foundation
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Hooks are optional interfaces of the models that the repositories call
+// around their operations. An error of a Before hook aborts the write.
+
+// BeforeCreateHook is called by Update, before inserting a new model, and by
+// BulkWrite for the models of NewList
+type BeforeCreateHook interface {
+	BeforeCreate(request RepoRequest) error
+}
+
+// BeforeUpdateHook is called by Update, before writing an existing model,
+// and by BulkWrite for the models of UpdateList
+type BeforeUpdateHook interface {
+	BeforeUpdate(request RepoRequest) error
+}
+
+// BeforeUpdateManyHook is called on request.Model by the writes by filter:
+// UpdateMany, UpdateField and RemoveField. It can change the values set.
+type BeforeUpdateManyHook interface {
+	BeforeUpdateMany(request RepoRequest, values map[string]interface{}) error
+}
+
+// BeforeDeleteHook is called on request.Model by Delete and DeleteSoft, and
+// by BulkWrite for the models of DeleteList
+type BeforeDeleteHook interface {
+	BeforeDelete(request RepoRequest) error
+}
+
+// AfterFindHook is called on every model read by FindOne, Find and
+// FindStream. Its error is the error of the read.
+type AfterFindHook interface {
+	AfterFind(request RepoRequest) error
+}
+
+// HookError is the error returned by a hook
+type HookError struct {
+	Hook string
+	Err  error
+}
+
+func (m *HookError) Error() string {
+	return fmt.Sprintf("Repository.%s: %s", m.Hook, m.Err.Error())
+}
+
+func (m *HookError) Unwrap() error {
+	return m.Err
+}
+
+// beforeSave calls the BeforeCreate or BeforeUpdate hook of request.Model
+func beforeSave(request RepoRequest) error {
+	if request.Model.IsNew() {
+		if hook, ok := request.Model.(BeforeCreateHook); ok {
+			return hookError("BeforeCreate", hook.BeforeCreate(request))
+		}
+		return nil
+	}
+	if hook, ok := request.Model.(BeforeUpdateHook); ok {
+		return hookError("BeforeUpdate", hook.BeforeUpdate(request))
+	}
+	return nil
+}
+
+func beforeUpdateMany(request RepoRequest, values map[string]interface{}) error {
+	if hook, ok := request.Model.(BeforeUpdateManyHook); ok {
+		return hookError("BeforeUpdateMany", hook.BeforeUpdateMany(request, values))
+	}
+	return nil
+}
+
+func beforeDelete(request RepoRequest) error {
+	if hook, ok := request.Model.(BeforeDeleteHook); ok {
+		return hookError("BeforeDelete", hook.BeforeDelete(request))
+	}
+	return nil
+}
+
+func afterFind(request RepoRequest, model interface{}) error {
+	if hook, ok := model.(AfterFindHook); ok {
+		return hookError("AfterFind", hook.AfterFind(request))
+	}
+	return nil
+}
+
+// afterFindList calls the AfterFind hook of the models of a List decoded by
+// Find
+func afterFindList(request RepoRequest, list interface{}) error {
+	value := reflect.ValueOf(list)
+	if value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+	if value.Kind() == reflect.Interface {
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Slice {
+		return nil
+	}
+
+	for i := 0; i < value.Len(); i++ {
+		item := value.Index(i)
+		if item.Kind() != reflect.Ptr && item.Kind() != reflect.Interface && item.CanAddr() {
+			item = item.Addr()
+		}
+		err := afterFind(request, item.Interface())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// afterFindStream calls the AfterFind hook of the rows before fn
+func afterFindStream(request RepoRequest, fn StreamFunc) StreamFunc {
+	return func(item interface{}) error {
+		err := afterFind(request, item)
+		if err != nil {
+			return err
+		}
+		return fn(item)
+	}
+}
+
+func hookError(hook string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &HookError{Hook: hook, Err: err}
+}
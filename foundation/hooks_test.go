@@ -0,0 +1,118 @@
+package foundation
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type memoryHookModel struct {
+	BaseModel `bson:",inline"`
+	Name      string `json:"name" bson:"name"`
+	Slug      string `json:"slug" bson:"slug"`
+	Amount    int    `json:"amount" bson:"amount"`
+	found     bool
+}
+
+func (m *memoryHookModel) GetCollection() (name string, isGlobal bool) {
+	return "memory_test", false
+}
+
+func (m *memoryHookModel) GetRepoType() RepoType {
+	return RepoTypeMemory
+}
+
+func (m *memoryHookModel) BeforeCreate(request RepoRequest) error {
+	if m.Name == "" {
+		return errors.New("name is required")
+	}
+	m.Slug = strings.ToLower(m.Name)
+	return nil
+}
+
+func (m *memoryHookModel) BeforeUpdate(request RepoRequest) error {
+	m.Slug = strings.ToLower(m.Name)
+	return nil
+}
+
+func (m *memoryHookModel) BeforeUpdateMany(request RepoRequest, values map[string]interface{}) error {
+	if amount, ok := values["amount"].(int); ok && amount < 0 {
+		return errors.New("amount can not be negative")
+	}
+	return nil
+}
+
+func (m *memoryHookModel) BeforeDelete(request RepoRequest) error {
+	if m.Name == "Protegido" {
+		return errors.New("protected")
+	}
+	return nil
+}
+
+func (m *memoryHookModel) AfterFind(request RepoRequest) error {
+	m.found = true
+	return nil
+}
+
+func TestMemoryRepositoryHooks(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_hooks", "memory_test", false)
+
+	var hookErr *HookError
+	if response := repo.Update(RepoRequest{Model: &memoryHookModel{}, User: user}); !errors.As(response.Error, &hookErr) || hookErr.Hook != "BeforeCreate" {
+		t.Fatalf("Update() without name = %v, want a BeforeCreate HookError", response.Error)
+	}
+	if total := repo.Count(RepoRequest{Model: &memoryHookModel{}}).TotalRows; total != 0 {
+		t.Fatalf("Count() after a rejected create = %d, want 0", total)
+	}
+
+	model := &memoryHookModel{Name: "Almendro"}
+	if response := repo.Update(RepoRequest{Model: model, User: user}); response.Error != nil || model.Slug != "almendro" {
+		t.Fatalf("Update() = %v, slug %q", response.Error, model.Slug)
+	}
+	model.Name = "Olivo"
+	if response := repo.Update(RepoRequest{Model: model, User: user}); response.Error != nil || model.Slug != "olivo" {
+		t.Fatalf("Update() of an existing model = %v, slug %q", response.Error, model.Slug)
+	}
+
+	response := repo.BulkWrite(RepoRequest{User: user}, BulkList{NewList: []interface{}{&memoryHookModel{Name: "Viña"}, &memoryHookModel{}}})
+	if response.TotalRows != 1 || len(response.Errors) != 1 || !errors.As(response.Errors[0], &hookErr) {
+		t.Fatalf("BulkWrite() = %+v", response)
+	}
+
+	findOptions := NewFindOptions()
+	findOptions.AddEquals("name", "Olivo")
+	if response := repo.UpdateMany(RepoRequest{Model: &memoryHookModel{}, FindOptions: *findOptions, User: user}, map[string]interface{}{"amount": -1}); response.Error == nil {
+		t.Fatalf("UpdateMany() with a negative amount should fail")
+	}
+
+	found := repo.Find(RepoRequest{Model: &memoryHookModel{}, List: []*memoryHookModel{}})
+	list := found.List.([]*memoryHookModel)
+	if found.Error != nil || len(list) != 2 || !list[0].found || !list[1].found || list[1].Slug != "viña" {
+		t.Fatalf("Find() = %+v", found)
+	}
+
+	one := &memoryHookModel{BaseModel: BaseModel{ID: model.ID}}
+	if response := repo.FindOne(RepoRequest{Model: one}); response.Error != nil || !one.found || one.Amount != 0 {
+		t.Fatalf("FindOne() = %v, %+v", response.Error, one)
+	}
+
+	streamed := 0
+	repo.FindStream(RepoRequest{Model: &memoryHookModel{}, List: []*memoryHookModel{}}, func(item interface{}) error {
+		if item.(*memoryHookModel).found {
+			streamed++
+		}
+		return nil
+	})
+	if streamed != 2 {
+		t.Fatalf("FindStream() rows with AfterFind = %d, want 2", streamed)
+	}
+
+	protected := &memoryHookModel{BaseModel: BaseModel{ID: model.ID}, Name: "Protegido"}
+	if response := repo.Delete(RepoRequest{Model: protected, User: user}); response.Error == nil {
+		t.Fatalf("Delete() of a protected model should fail")
+	}
+	if response := repo.Delete(RepoRequest{Model: model, User: user}); response.Error != nil {
+		t.Fatalf("Delete(): %v", response.Error)
+	}
+}
@@ -0,0 +1,298 @@
+package foundation
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/weitecit/pkg/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type IndexKeyType utils.Enum
+
+const (
+	IndexKeyAsc      IndexKeyType = "asc"
+	IndexKeyDesc     IndexKeyType = "desc"
+	IndexKeyText     IndexKeyType = "text"
+	IndexKey2DSphere IndexKeyType = "2dsphere"
+)
+
+type IndexKey struct {
+	Field string       `json:"field"`
+	Type  IndexKeyType `json:"type"`
+}
+
+// Index is an index declared by a model, see IndexedModel. Several keys make
+// a compound index.
+type Index struct {
+	// Defaults to the name MongoDB gives, e.g. "username_1"
+	Name   string     `json:"name,omitempty"`
+	Keys   []IndexKey `json:"keys"`
+	Unique bool       `json:"unique,omitempty"`
+	Sparse bool       `json:"sparse,omitempty"`
+	// TTL: documents expire this long after the date of the key
+	ExpireAfter time.Duration `json:"expire_after,omitempty"`
+	// Partial: only the documents matching the filter are indexed
+	PartialFilter map[string]interface{} `json:"partial_filter,omitempty"`
+	// Weights of the fields of a text index
+	Weights map[string]int `json:"weights,omitempty"`
+}
+
+// IndexedModel is implemented by the models that declare the indexes of their
+// collection. EnsureIndexes creates them.
+type IndexedModel interface {
+	GetIndexes() []Index
+}
+
+func NewIndex(keys ...IndexKey) Index {
+	return Index{Keys: keys}
+}
+
+// NewGeoIndex returns the 2dsphere index of a Geometry field, needed by the
+// geo filter operators
+func NewGeoIndex(field string) Index {
+	return NewIndex(IndexKey{Field: field, Type: IndexKey2DSphere})
+}
+
+func (m Index) GetName() string {
+	if m.Name != "" {
+		return m.Name
+	}
+
+	parts := []string{}
+	for _, key := range m.Keys {
+		parts = append(parts, key.Field, fmt.Sprint(key.value()))
+	}
+	return strings.Join(parts, "_")
+}
+
+func (m IndexKey) value() interface{} {
+	switch m.Type {
+	case IndexKeyDesc:
+		return -1
+	case IndexKeyText:
+		return "text"
+	case IndexKey2DSphere:
+		return "2dsphere"
+	default:
+		return 1
+	}
+}
+
+func (m Index) isText() bool {
+	for _, key := range m.Keys {
+		if key.Type == IndexKeyText {
+			return true
+		}
+	}
+	return false
+}
+
+func (m Index) Validate() error {
+	if len(m.Keys) == 0 {
+		return errors.New("Index.Validate: " + m.Name + " needs at least one key")
+	}
+	for _, key := range m.Keys {
+		if key.Field == "" {
+			return errors.New("Index.Validate: " + m.Name + " has a key without field")
+		}
+	}
+	if m.ExpireAfter > 0 && len(m.Keys) > 1 {
+		return errors.New("Index.Validate: TTL index " + m.GetName() + " can only have one key")
+	}
+	return nil
+}
+
+// mongoKeys keeps the order of the keys, which is part of the index
+func (m Index) mongoKeys() bson.D {
+	keys := bson.D{}
+	for _, key := range m.Keys {
+		keys = append(keys, bson.E{Key: key.Field, Value: key.value()})
+	}
+	return keys
+}
+
+// mongoModel is the index as created in MongoDB
+func (m Index) mongoModel() mongo.IndexModel {
+	indexOptions := options.Index().SetName(m.GetName())
+
+	if m.Unique {
+		indexOptions.SetUnique(true)
+	}
+	if m.Sparse {
+		indexOptions.SetSparse(true)
+	}
+	if m.ExpireAfter > 0 {
+		indexOptions.SetExpireAfterSeconds(int32(m.ExpireAfter.Seconds()))
+	}
+	if len(m.PartialFilter) > 0 {
+		indexOptions.SetPartialFilterExpression(m.PartialFilter)
+	}
+	if len(m.Weights) > 0 {
+		weights := bson.M{}
+		for field, weight := range m.Weights {
+			weights[field] = weight
+		}
+		indexOptions.SetWeights(weights)
+	}
+
+	return mongo.IndexModel{Keys: m.mongoKeys(), Options: indexOptions}
+}
+
+// mongoIndexSpec is an index as listed by MongoDB
+type mongoIndexSpec struct {
+	Name                    string      `bson:"name"`
+	Key                     bson.D      `bson:"key"`
+	Unique                  bool        `bson:"unique"`
+	Sparse                  bool        `bson:"sparse"`
+	ExpireAfterSeconds      interface{} `bson:"expireAfterSeconds"`
+	PartialFilterExpression bson.M      `bson:"partialFilterExpression"`
+	Weights                 bson.M      `bson:"weights"`
+}
+
+// index is the declaration of the listed index
+func (m mongoIndexSpec) index() Index {
+	index := Index{Name: m.Name, Unique: m.Unique, Sparse: m.Sparse, PartialFilter: m.PartialFilterExpression}
+
+	if seconds, ok := asMemoryNumber(m.ExpireAfterSeconds); ok {
+		index.ExpireAfter = time.Duration(seconds) * time.Second
+	}
+
+	// text indexes are stored as _fts keys with the fields in the weights
+	for _, key := range m.Key {
+		switch key.Key {
+		case "_fts":
+			fields := []string{}
+			for field := range m.Weights {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			index.Weights = map[string]int{}
+			for _, field := range fields {
+				weight, _ := asMemoryNumber(m.Weights[field])
+				index.Keys = append(index.Keys, IndexKey{Field: field, Type: IndexKeyText})
+				index.Weights[field] = int(weight)
+			}
+		case "_ftsx":
+		default:
+			keyType := IndexKeyAsc
+			switch value := key.Value.(type) {
+			case string:
+				keyType = IndexKeyType(value)
+			default:
+				if number, _ := asMemoryNumber(value); number < 0 {
+					keyType = IndexKeyDesc
+				}
+			}
+			index.Keys = append(index.Keys, IndexKey{Field: key.Key, Type: keyType})
+		}
+	}
+
+	return index
+}
+
+// sameAs tells whether the index listed by MongoDB matches the declared one
+func (m mongoIndexSpec) sameAs(index Index) bool {
+	if m.Unique != index.Unique || m.Sparse != index.Sparse {
+		return false
+	}
+
+	seconds, _ := asMemoryNumber(m.ExpireAfterSeconds)
+	if int64(seconds) != int64(index.ExpireAfter.Seconds()) {
+		return false
+	}
+
+	partialFilter, err := toMemoryDocument(index.PartialFilter)
+	if err != nil || (len(partialFilter) > 0 || len(m.PartialFilterExpression) > 0) && !memoryValuesEqual(partialFilter, m.PartialFilterExpression) {
+		return false
+	}
+
+	// text indexes are stored as _fts keys with the fields in the weights
+	if index.isText() {
+		fields := 0
+		for _, key := range index.Keys {
+			if key.Type != IndexKeyText {
+				continue
+			}
+			fields++
+			weight, ok := index.Weights[key.Field]
+			if !ok {
+				weight = 1
+			}
+			stored, _ := asMemoryNumber(m.Weights[key.Field])
+			if int(stored) != weight {
+				return false
+			}
+		}
+		return fields == len(m.Weights)
+	}
+
+	if len(m.Key) != len(index.Keys) {
+		return false
+	}
+	for i, key := range index.Keys {
+		value, err := normalizeMemoryValue(key.value())
+		if err != nil || m.Key[i].Key != key.Field || !memoryValuesEqual(m.Key[i].Value, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// indexChangedError reports an index whose definition is not the declared one.
+// It is not dropped to create it again: if the new definition can not be
+// built, e.g. a unique index over repeated values, the collection would be
+// left without the index.
+func indexChangedError(operation string, collection string, name string) error {
+	return errors.New(operation + ": " + collection + "." + name + " exists with another definition, drop it to create the declared one")
+}
+
+// EnsureIndexes creates the indexes declared by every model that
+// implements IndexedModel, each one in the database and collection where repo
+// stores it. Errors of a model do not stop the others and are returned in
+// RepoResponse.Errors.
+func EnsureIndexes(repo Repository, models ...RepositoryModel) RepoResponse {
+	response := RepoResponse{}
+
+	if repo == nil {
+		response.Error = errors.New("Repository.EnsureIndexes: repository is nil")
+		return response
+	}
+
+	for _, model := range models {
+		indexedModel, ok := model.(IndexedModel)
+		if !ok {
+			continue
+		}
+
+		modelRepo, err := CloneRepository(repo, model)
+		if err != nil {
+			response.Errors = append(response.Errors, err)
+			continue
+		}
+
+		result := modelRepo.EnsureIndexes(RepoRequest{Model: model}, indexedModel.GetIndexes())
+		if result.Error != nil {
+			response.Errors = append(response.Errors, result.Error)
+		}
+		response.Errors = append(response.Errors, result.Errors...)
+		response.TotalRows += result.TotalRows
+	}
+
+	return response
+}
+
+// IsDuplicateKeyError tells whether err was caused by a unique index
+func IsDuplicateKeyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return mongo.IsDuplicateKeyError(err) || strings.Contains(err.Error(), "E11000")
+}
@@ -75,6 +75,7 @@ func (m *LocalFileRepository) Save() FileRepoResponse {
 		response.Error = err
 		return *response
 	}
+	defer destination.Close()
 
 	_, err = io.Copy(destination, m.File)
 	if err != nil {
@@ -0,0 +1,276 @@
+package foundation
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Time a record lock lasts when Lock gets no TTL
+const DefaultRecordLockTTL = 15 * time.Minute
+
+// RecordLockedError is returned by Update, Lock, RefreshLock and Unlock when
+// another user holds the edit lock of the document
+type RecordLockedError struct {
+	Collection string
+	ID         string
+	User       string
+	Since      time.Time
+	ExpiresAt  *time.Time
+}
+
+func (m *RecordLockedError) Error() string {
+	return fmt.Sprintf("Repository: %s %s is locked by %s since %s", m.Collection, m.ID, m.User, m.Since.Format(time.RFC3339))
+}
+
+func NewRecordLockedError(collection string, id interface{}, lock *UserLog) *RecordLockedError {
+	return &RecordLockedError{
+		Collection: collection,
+		ID:         formatID(id),
+		User:       lock.User,
+		Since:      lock.Time,
+		ExpiresAt:  lock.ExpiresAt,
+	}
+}
+
+func IsRecordLockedError(err error) bool {
+	var locked *RecordLockedError
+	return errors.As(err, &locked)
+}
+
+// lockedFor tells whether the lock keeps user from writing the document: it
+// is held by another user and has not expired
+func lockedFor(lock *UserLog, user string, now time.Time) bool {
+	return lock != nil && lock.User != user && (lock.ExpiresAt == nil || !lock.ExpiresAt.Before(now))
+}
+
+// unlockedFilter matches the documents user can write at now, the
+// conditions of lockedFor as an $or
+func unlockedFilter(user string, now time.Time) bson.A {
+	return bson.A{
+		bson.M{"locked_by": nil},
+		bson.M{"locked_by.user": user},
+		bson.M{"locked_by.expires_at": bson.M{"$lt": now}},
+	}
+}
+
+// documentLock returns the lock of a stored document
+func documentLock(document bson.M) *UserLog {
+	raw, err := bson.Marshal(bson.M{"locked_by": document["locked_by"]})
+	if err != nil {
+		return nil
+	}
+	logs := UserLogs{}
+	if bson.Unmarshal(raw, &logs) != nil {
+		return nil
+	}
+	return logs.LockedBy
+}
+
+// updateDocument returns the values Update sets. The lock of the model is
+// left out, it is only written by the lock operations, so a model read before
+// an Unlock does not bring its lock back.
+func updateDocument(model RepositoryModel) (bson.M, error) {
+	document, err := toMemoryDocument(model)
+	if err != nil {
+		return nil, err
+	}
+	delete(document, "locked_by")
+	return document, nil
+}
+
+// recordLocker runs a lock operation on the document of request.Model
+type recordLocker struct {
+	operation  string
+	repo       Repository
+	request    RepoRequest
+	collection string
+	id         interface{}
+	user       string
+	now        time.Time
+}
+
+func newRecordLocker(operation string, repo Repository, request RepoRequest) (*recordLocker, error) {
+	if repo == nil {
+		return nil, errors.New(operation + ": repository is nil")
+	}
+	if request.Model == nil {
+		return nil, errors.New(operation + ": model can not be empty")
+	}
+	id, err := request.Model.GetID()
+	if err != nil {
+		return nil, errors.New(operation + ": " + err.Error())
+	}
+
+	collection, _ := request.Model.GetCollection()
+	return &recordLocker{
+		operation:  operation,
+		repo:       repo,
+		request:    request,
+		collection: collection,
+		id:         id,
+		user:       request.User.GetIDStr(),
+		now:        time.Now(),
+	}, nil
+}
+
+func (m *recordLocker) errorf(msg string) error {
+	return errors.New(m.operation + ": " + m.collection + " " + formatID(m.id) + " " + msg)
+}
+
+func (m *recordLocker) findOptions(nodes ...FilterNode) FindOptions {
+	findOptions := NewFindOptions()
+	findOptions.AddEquals("_id", m.id)
+	for _, node := range nodes {
+		findOptions.AddTree(node)
+	}
+	return *findOptions
+}
+
+// set writes the lock of the document if it matches findOptions. Nothing
+// modified does not mean nothing matched, an unchanged lock is not counted,
+// so the result is read back.
+func (m *recordLocker) set(findOptions FindOptions, field string, value interface{}) error {
+	request := RepoRequest{FindOptions: findOptions, User: m.request.User, Context: m.request.Context}
+	return m.repo.UpdateField(request, field, value).Error
+}
+
+// read returns the lock of the document
+func (m *recordLocker) read() (*UserLog, error) {
+	found := false
+	var lock *UserLog
+
+	request := RepoRequest{Model: m.request.Model, FindOptions: m.findOptions(), Context: m.request.Context}
+	response := m.repo.FindStream(request, func(item interface{}) error {
+		document, ok := item.(bson.M)
+		if !ok {
+			return errors.New("unexpected row")
+		}
+		found = true
+		lock = documentLock(document)
+		return nil
+	})
+	if response.Error != nil {
+		return nil, response.Error
+	}
+	if !found {
+		return nil, m.errorf("not found")
+	}
+	return lock, nil
+}
+
+// owned reads the lock back and returns it if user holds it
+func (m *recordLocker) owned() RepoResponse {
+	lock, err := m.read()
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
+	if lockedFor(lock, m.user, m.now) {
+		return RepoResponse{Error: NewRecordLockedError(m.collection, m.id, lock)}
+	}
+	if lock == nil || lock.User != m.user || (lock.ExpiresAt != nil && lock.ExpiresAt.Before(m.now)) {
+		return RepoResponse{Error: m.errorf("is not locked by " + m.user)}
+	}
+	return RepoResponse{TotalRows: 1, List: lock}
+}
+
+func getRecordLockTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return DefaultRecordLockTTL
+	}
+	return ttl
+}
+
+// Lock gives request.User the edit lock of the document of request.Model for
+// ttl, DefaultRecordLockTTL when it is 0. It fails with a RecordLockedError
+// while another user holds it. Update rejects the writes of other users until
+// the lock is released or expires. RepoResponse.List has the *UserLog of the
+// lock.
+func Lock(repo Repository, request RepoRequest, ttl time.Duration) RepoResponse {
+	m, err := newRecordLocker("Lock", repo, request)
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
+	if m.user == "" {
+		return RepoResponse{Error: errors.New("Lock: user is required")}
+	}
+
+	expiresAt := m.now.Add(getRecordLockTTL(ttl))
+	lock := &UserLog{User: m.user, Time: m.now, ExpiresAt: &expiresAt}
+	err = m.set(m.findOptions(NewOrFilter(
+		NewFilterNode("locked_by", FilterOperatorEquals, nil),
+		NewFilterNode("locked_by.user", FilterOperatorEquals, m.user),
+		NewFilterNode("locked_by.expires_at", FilterOperatorLess, m.now),
+	)), "locked_by", lock)
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	return m.owned()
+}
+
+// RefreshLock extends the lock of request.User for ttl from now. It fails if
+// the user does not hold the lock or it already expired.
+func RefreshLock(repo Repository, request RepoRequest, ttl time.Duration) RepoResponse {
+	m, err := newRecordLocker("RefreshLock", repo, request)
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	findOptions := m.findOptions()
+	findOptions.AddEquals("locked_by.user", m.user)
+	findOptions.AddComplex("locked_by.expires_at", FilterOperatorGreatOrEqual, m.now)
+	err = m.set(findOptions, "locked_by.expires_at", m.now.Add(getRecordLockTTL(ttl)))
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	return m.owned()
+}
+
+// Unlock releases the lock of request.User. A document that is not locked,
+// or whose lock expired, is left as it is.
+func Unlock(repo Repository, request RepoRequest) RepoResponse {
+	m, err := newRecordLocker("Unlock", repo, request)
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	findOptions := m.findOptions()
+	findOptions.AddEquals("locked_by.user", m.user)
+	err = m.set(findOptions, "locked_by", nil)
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	lock, err := m.read()
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
+	if lockedFor(lock, m.user, m.now) {
+		return RepoResponse{Error: NewRecordLockedError(m.collection, m.id, lock)}
+	}
+	return RepoResponse{TotalRows: 1}
+}
+
+// ForceUnlock releases the lock of the document whoever holds it, e.g. for an
+// administrator when an editor left without unlocking
+func ForceUnlock(repo Repository, request RepoRequest) RepoResponse {
+	m, err := newRecordLocker("ForceUnlock", repo, request)
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	err = m.set(m.findOptions(), "locked_by", nil)
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	_, err = m.read()
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
+	return RepoResponse{TotalRows: 1}
+}
@@ -0,0 +1,814 @@
+package foundation
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The memory matcher evaluates the MongoDB query documents produced by
+// MongoRepository.GetFilter against documents decoded as bson.M, following
+// the MongoDB semantics for arrays, missing fields and type brackets.
+
+func normalizeMemoryValue(value interface{}) (interface{}, error) {
+	raw, err := bson.Marshal(bson.M{"value": value})
+	if err != nil {
+		return nil, err
+	}
+
+	document := bson.M{}
+	err = bson.Unmarshal(raw, &document)
+	if err != nil {
+		return nil, err
+	}
+
+	return document["value"], nil
+}
+
+func toMemoryDocument(value interface{}) (bson.M, error) {
+	raw, err := bson.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	document := bson.M{}
+	err = bson.Unmarshal(raw, &document)
+	if err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+func asMemoryDocument(value interface{}) (bson.M, bool) {
+	switch document := value.(type) {
+	case bson.M:
+		return document, true
+	case map[string]interface{}:
+		return bson.M(document), true
+	case bson.D:
+		result := bson.M{}
+		for _, element := range document {
+			result[element.Key] = element.Value
+		}
+		return result, true
+	default:
+		return nil, false
+	}
+}
+
+func asMemoryArray(value interface{}) (bson.A, bool) {
+	switch array := value.(type) {
+	case bson.A:
+		return array, true
+	case []interface{}:
+		return bson.A(array), true
+	default:
+		return nil, false
+	}
+}
+
+func asMemoryNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case int32:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	case int:
+		return float64(number), true
+	case float64:
+		return number, true
+	case primitive.Decimal128:
+		result, err := strconv.ParseFloat(number.String(), 64)
+		return result, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func asMemoryBool(value interface{}) bool {
+	if value == nil {
+		return false
+	}
+	if boolean, ok := value.(bool); ok {
+		return boolean
+	}
+	if number, ok := asMemoryNumber(value); ok {
+		return number != 0
+	}
+	return true
+}
+
+func memoryTypeOrder(value interface{}) int {
+	switch value.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return 1
+	case int32, int64, int, float64, primitive.Decimal128:
+		return 2
+	case string, primitive.Symbol:
+		return 3
+	case bson.M, bson.D, map[string]interface{}:
+		return 4
+	case bson.A, []interface{}:
+		return 5
+	case primitive.Binary:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime:
+		return 9
+	case primitive.Timestamp:
+		return 10
+	case primitive.Regex:
+		return 11
+	default:
+		return 12
+	}
+}
+
+func compareMemoryInts(a, b int64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+func compareMemoryValues(a, b interface{}) int {
+	orderA, orderB := memoryTypeOrder(a), memoryTypeOrder(b)
+	if orderA != orderB {
+		return compareMemoryInts(int64(orderA), int64(orderB))
+	}
+
+	switch orderA {
+	case 2:
+		x, _ := asMemoryNumber(a)
+		y, _ := asMemoryNumber(b)
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+		return 0
+	case 3:
+		return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+	case 4:
+		x, _ := asMemoryDocument(a)
+		y, _ := asMemoryDocument(b)
+		rawX, _ := bson.Marshal(x)
+		rawY, _ := bson.Marshal(y)
+		return bytes.Compare(rawX, rawY)
+	case 5:
+		x, _ := asMemoryArray(a)
+		y, _ := asMemoryArray(b)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if result := compareMemoryValues(x[i], y[i]); result != 0 {
+				return result
+			}
+		}
+		return compareMemoryInts(int64(len(x)), int64(len(y)))
+	case 6:
+		return bytes.Compare(a.(primitive.Binary).Data, b.(primitive.Binary).Data)
+	case 7:
+		x, y := a.(primitive.ObjectID), b.(primitive.ObjectID)
+		return bytes.Compare(x[:], y[:])
+	case 8:
+		x, y := a.(bool), b.(bool)
+		if x == y {
+			return 0
+		}
+		if !x {
+			return -1
+		}
+		return 1
+	case 9:
+		return compareMemoryInts(int64(a.(primitive.DateTime)), int64(b.(primitive.DateTime)))
+	case 10:
+		x, y := a.(primitive.Timestamp), b.(primitive.Timestamp)
+		if x.T != y.T {
+			return compareMemoryInts(int64(x.T), int64(y.T))
+		}
+		return compareMemoryInts(int64(x.I), int64(y.I))
+	case 11:
+		return strings.Compare(a.(primitive.Regex).String(), b.(primitive.Regex).String())
+	default:
+		if reflect.DeepEqual(a, b) {
+			return 0
+		}
+		return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+	}
+}
+
+func memoryValuesEqual(a, b interface{}) bool {
+	if memoryTypeOrder(a) != memoryTypeOrder(b) {
+		return false
+	}
+
+	x, isDocument := asMemoryDocument(a)
+	if isDocument {
+		y, _ := asMemoryDocument(b)
+		if len(x) != len(y) {
+			return false
+		}
+		for key, value := range x {
+			other, ok := y[key]
+			if !ok || !memoryValuesEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return compareMemoryValues(a, b) == 0
+}
+
+func lookupMemoryPath(document bson.M, path string) (interface{}, bool) {
+	return lookupMemoryParts(document, strings.Split(path, "."))
+}
+
+func lookupMemoryParts(value interface{}, parts []string) (interface{}, bool) {
+	if len(parts) == 0 {
+		return value, true
+	}
+
+	if document, ok := asMemoryDocument(value); ok {
+		next, found := document[parts[0]]
+		if !found {
+			return nil, false
+		}
+		return lookupMemoryParts(next, parts[1:])
+	}
+
+	array, ok := asMemoryArray(value)
+	if !ok {
+		return nil, false
+	}
+
+	if index, err := strconv.Atoi(parts[0]); err == nil {
+		if index < 0 || index >= len(array) {
+			return nil, false
+		}
+		return lookupMemoryParts(array[index], parts[1:])
+	}
+
+	values := bson.A{}
+	for _, item := range array {
+		if _, isDocument := asMemoryDocument(item); !isDocument {
+			continue
+		}
+		if result, found := lookupMemoryParts(item, parts); found {
+			values = append(values, result)
+		}
+	}
+
+	if len(values) == 0 {
+		return nil, false
+	}
+
+	return values, true
+}
+
+func setMemoryPath(document bson.M, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	current := document
+
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := asMemoryDocument(current[part])
+		if !ok {
+			next = bson.M{}
+		}
+		current[part] = next
+		current = next
+	}
+
+	current[parts[len(parts)-1]] = value
+}
+
+func memoryOperators(condition interface{}) (bson.M, bool) {
+	document, ok := asMemoryDocument(condition)
+	if !ok || len(document) == 0 {
+		return nil, false
+	}
+
+	for key := range document {
+		if !strings.HasPrefix(key, "$") {
+			return nil, false
+		}
+	}
+
+	return document, true
+}
+
+func matchMemoryDocument(document bson.M, filter bson.M) (bool, error) {
+	for key, condition := range filter {
+		switch key {
+		case "$and", "$or", "$nor":
+			clauses, ok := asMemoryArray(condition)
+			if !ok {
+				return false, errors.New("memory matcher: " + key + " must be an array")
+			}
+
+			matches := 0
+			for _, clause := range clauses {
+				subFilter, ok := asMemoryDocument(clause)
+				if !ok {
+					return false, errors.New("memory matcher: " + key + " entries must be documents")
+				}
+				matched, err := matchMemoryDocument(document, subFilter)
+				if err != nil {
+					return false, err
+				}
+				if matched {
+					matches++
+				}
+			}
+
+			if key == "$and" && matches != len(clauses) {
+				return false, nil
+			}
+			if key == "$or" && matches == 0 {
+				return false, nil
+			}
+			if key == "$nor" && matches > 0 {
+				return false, nil
+			}
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, errors.New("memory matcher: unsupported top level operator: " + key)
+			}
+			matched, err := matchMemoryCondition(document, key, condition)
+			if err != nil || !matched {
+				return false, err
+			}
+		}
+	}
+
+	return true, nil
+}
+
+func matchMemoryCondition(document bson.M, key string, condition interface{}) (bool, error) {
+	value, found := lookupMemoryPath(document, key)
+
+	if operators, ok := memoryOperators(condition); ok {
+		return matchMemoryOperators(value, found, operators)
+	}
+
+	if regex, ok := condition.(primitive.Regex); ok {
+		return matchMemoryRegex(value, regex.Pattern, regex.Options)
+	}
+
+	return matchMemoryEquals(value, found, condition), nil
+}
+
+func matchMemoryOperators(value interface{}, found bool, operators bson.M) (bool, error) {
+	if pattern, ok := operators["$regex"]; ok {
+		options, _ := operators["$options"].(string)
+		if regex, isRegex := pattern.(primitive.Regex); isRegex {
+			pattern, options = regex.Pattern, regex.Options+options
+		}
+		matched, err := matchMemoryRegex(value, fmt.Sprint(pattern), options)
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+
+	for operator, argument := range operators {
+		var matched bool
+		var err error
+
+		switch operator {
+		case "$regex", "$options":
+			continue
+		case "$eq":
+			matched = matchMemoryEquals(value, found, argument)
+		case "$ne":
+			matched = !matchMemoryEquals(value, found, argument)
+		case "$in":
+			matched, err = matchMemoryIn(value, found, argument)
+		case "$nin":
+			matched, err = matchMemoryIn(value, found, argument)
+			matched = !matched
+		case "$gt", "$gte", "$lt", "$lte":
+			matched = matchMemoryComparison(value, found, operator, argument)
+		case "$exists":
+			matched = found == asMemoryBool(argument)
+		case "$size":
+			array, isArray := asMemoryArray(value)
+			size, isNumber := asMemoryNumber(argument)
+			matched = isArray && isNumber && float64(len(array)) == size
+		case "$all":
+			matched, err = matchMemoryAll(value, found, argument)
+		case "$elemMatch":
+			matched, err = matchMemoryElemMatch(value, argument)
+		case "$not":
+			if regex, ok := argument.(primitive.Regex); ok {
+				matched, err = matchMemoryRegex(value, regex.Pattern, regex.Options)
+			} else if subOperators, ok := memoryOperators(argument); ok {
+				matched, err = matchMemoryOperators(value, found, subOperators)
+			} else {
+				err = errors.New("memory matcher: $not needs a regex or a document")
+			}
+			matched = !matched
+		case "$geoWithin", "$geoIntersects", "$near":
+			matched, err = matchMemoryGeo(value, found, operator, argument)
+		default:
+			err = errors.New("memory matcher: unsupported operator: " + operator)
+		}
+
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// matchMemoryGeo matches the geo operators on the plane of the coordinates,
+// $near by the distance to the nearest position
+func matchMemoryGeo(value interface{}, found bool, operator string, argument interface{}) (bool, error) {
+	if !found || value == nil {
+		return false, nil
+	}
+	stored, err := toGeometry(value)
+	if err != nil {
+		return false, nil
+	}
+	shape, err := stored.shape()
+	if err != nil {
+		return false, nil
+	}
+
+	condition, ok := asMemoryDocument(argument)
+	if !ok {
+		return false, errors.New("memory matcher: " + operator + " must be a document")
+	}
+	if sphere, ok := asMemoryArray(condition["$centerSphere"]); ok && operator == "$geoWithin" {
+		return matchMemoryCenterSphere(shape, sphere)
+	}
+	geometry, err := toGeometry(condition["$geometry"])
+	if err != nil {
+		return false, errors.New("memory matcher: " + operator + ": " + err.Error())
+	}
+	target, err := geometry.shape()
+	if err != nil {
+		return false, errors.New("memory matcher: " + operator + ": " + err.Error())
+	}
+
+	switch operator {
+	case "$geoWithin":
+		return shape.within(target), nil
+	case "$geoIntersects":
+		return shape.intersects(target), nil
+	}
+
+	if len(target.points) != 1 {
+		return false, errors.New("memory matcher: $near needs a Point")
+	}
+	distance := shape.distance(target.points[0])
+	if maxDistance, ok := asMemoryNumber(condition["$maxDistance"]); ok && distance > maxDistance {
+		return false, nil
+	}
+	if minDistance, ok := asMemoryNumber(condition["$minDistance"]); ok && distance < minDistance {
+		return false, nil
+	}
+	return true, nil
+}
+
+// matchMemoryCenterSphere tells whether all the positions of the shape are in
+// the circle [[longitude, latitude], radius in radians]
+func matchMemoryCenterSphere(shape geoShape, sphere bson.A) (bool, error) {
+	if len(sphere) != 2 {
+		return false, errors.New("memory matcher: $centerSphere needs a center and a radius")
+	}
+	center, err := parseGeoPosition(sphere[0])
+	if err != nil {
+		return false, errors.New("memory matcher: $centerSphere: " + err.Error())
+	}
+	radius, ok := asMemoryNumber(sphere[1])
+	if !ok {
+		return false, errors.New("memory matcher: $centerSphere radius is not a number")
+	}
+
+	positions := shape.positions()
+	for _, position := range positions {
+		if position.distance(center) > radius*earthRadius {
+			return false, nil
+		}
+	}
+	return len(positions) > 0, nil
+}
+
+func matchMemoryEquals(value interface{}, found bool, target interface{}) bool {
+	if target == nil {
+		if !found || value == nil {
+			return true
+		}
+	} else if !found {
+		return false
+	}
+
+	if memoryValuesEqual(value, target) {
+		return true
+	}
+
+	array, ok := asMemoryArray(value)
+	if !ok {
+		return false
+	}
+
+	for _, item := range array {
+		if memoryValuesEqual(item, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchMemoryIn(value interface{}, found bool, argument interface{}) (bool, error) {
+	targets, ok := asMemoryArray(argument)
+	if !ok {
+		return false, errors.New("memory matcher: $in needs an array")
+	}
+
+	for _, target := range targets {
+		if regex, ok := target.(primitive.Regex); ok {
+			matched, err := matchMemoryRegex(value, regex.Pattern, regex.Options)
+			if err != nil {
+				return false, err
+			}
+			if matched {
+				return true, nil
+			}
+			continue
+		}
+		if matchMemoryEquals(value, found, target) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func matchMemoryAll(value interface{}, found bool, argument interface{}) (bool, error) {
+	targets, ok := asMemoryArray(argument)
+	if !ok {
+		return false, errors.New("memory matcher: $all needs an array")
+	}
+
+	if len(targets) == 0 {
+		return false, nil
+	}
+
+	for _, target := range targets {
+		if !matchMemoryEquals(value, found, target) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func matchMemoryElemMatch(value interface{}, argument interface{}) (bool, error) {
+	array, ok := asMemoryArray(value)
+	if !ok {
+		return false, nil
+	}
+
+	operators, isOperators := memoryOperators(argument)
+	query, isQuery := asMemoryDocument(argument)
+	if !isOperators && !isQuery {
+		return false, errors.New("memory matcher: $elemMatch needs a document")
+	}
+
+	for _, item := range array {
+		if isOperators {
+			matched, err := matchMemoryOperators(item, true, operators)
+			if err != nil {
+				return false, err
+			}
+			if matched {
+				return true, nil
+			}
+			continue
+		}
+
+		document, ok := asMemoryDocument(item)
+		if !ok {
+			continue
+		}
+		matched, err := matchMemoryDocument(document, query)
+		if err != nil {
+			return false, err
+		}
+		if matched {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func matchMemoryComparison(value interface{}, found bool, operator string, argument interface{}) bool {
+	if !found {
+		return false
+	}
+
+	candidates := bson.A{value}
+	if array, ok := asMemoryArray(value); ok {
+		candidates = append(candidates, array...)
+	}
+
+	for _, candidate := range candidates {
+		if memoryTypeOrder(candidate) != memoryTypeOrder(argument) {
+			continue
+		}
+
+		result := compareMemoryValues(candidate, argument)
+		switch operator {
+		case "$gt":
+			if result > 0 {
+				return true
+			}
+		case "$gte":
+			if result >= 0 {
+				return true
+			}
+		case "$lt":
+			if result < 0 {
+				return true
+			}
+		case "$lte":
+			if result <= 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func compileMemoryRegex(pattern string, options string) (*regexp.Regexp, error) {
+	flags := ""
+	for _, option := range options {
+		if strings.ContainsRune("ims", option) && !strings.ContainsRune(flags, option) {
+			flags += string(option)
+		}
+	}
+
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+
+	return regexp.Compile(pattern)
+}
+
+func matchMemoryRegex(value interface{}, pattern string, options string) (bool, error) {
+	regex, err := compileMemoryRegex(pattern, options)
+	if err != nil {
+		return false, err
+	}
+
+	if text, ok := value.(string); ok {
+		return regex.MatchString(text), nil
+	}
+
+	array, ok := asMemoryArray(value)
+	if !ok {
+		return false, nil
+	}
+
+	for _, item := range array {
+		if text, ok := item.(string); ok && regex.MatchString(text) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// memorySortKey picks the element MongoDB uses when sorting by an array
+// field: the smallest one ascending and the largest one descending.
+func memorySortKey(value interface{}, direction int) interface{} {
+	array, ok := asMemoryArray(value)
+	if !ok || len(array) == 0 {
+		return value
+	}
+
+	key := array[0]
+	for _, item := range array[1:] {
+		result := compareMemoryValues(item, key)
+		if (direction >= 0 && result < 0) || (direction < 0 && result > 0) {
+			key = item
+		}
+	}
+
+	return key
+}
+
+// sortMemoryNear sorts the documents by their distance to the point of the
+// $near of the filter, if it has one
+func sortMemoryNear(documents []bson.M, filter bson.M) {
+	key, condition, ok := memoryNearCondition(filter)
+	if !ok {
+		return
+	}
+	geometry, err := toGeometry(condition["$geometry"])
+	if err != nil {
+		return
+	}
+	target, err := geometry.shape()
+	if err != nil || len(target.points) != 1 {
+		return
+	}
+
+	distances := make([]float64, len(documents))
+	for i, document := range documents {
+		distances[i] = math.Inf(1)
+		value, _ := lookupMemoryPath(document, key)
+		if stored, err := toGeometry(value); err == nil {
+			if shape, err := stored.shape(); err == nil {
+				distances[i] = shape.distance(target.points[0])
+			}
+		}
+	}
+
+	indexes := make([]int, len(documents))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return distances[indexes[i]] < distances[indexes[j]]
+	})
+	sorted := make([]bson.M, len(documents))
+	for i, index := range indexes {
+		sorted[i] = documents[index]
+	}
+	copy(documents, sorted)
+}
+
+// memoryNearCondition finds the $near of a filter, at its top level or in an
+// $and
+func memoryNearCondition(filter bson.M) (string, bson.M, bool) {
+	for key, value := range filter {
+		if key == "$and" {
+			clauses, _ := asMemoryArray(value)
+			for _, clause := range clauses {
+				if subFilter, ok := asMemoryDocument(clause); ok {
+					if key, condition, ok := memoryNearCondition(subFilter); ok {
+						return key, condition, true
+					}
+				}
+			}
+			continue
+		}
+		if operators, ok := memoryOperators(value); ok {
+			if condition, ok := asMemoryDocument(operators["$near"]); ok {
+				return key, condition, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+func sortMemoryDocuments(documents []bson.M, orders []Order) {
+	if len(orders) == 0 {
+		return
+	}
+
+	sort.SliceStable(documents, func(i, j int) bool {
+		for _, order := range orders {
+			field := order.Field
+			if field == "id" {
+				field = "_id"
+			}
+
+			a, _ := lookupMemoryPath(documents[i], field)
+			b, _ := lookupMemoryPath(documents[j], field)
+
+			result := compareMemoryValues(memorySortKey(a, order.Direction), memorySortKey(b, order.Direction))
+			if result == 0 {
+				continue
+			}
+			if order.Direction < 0 {
+				return result > 0
+			}
+			return result < 0
+		}
+		return false
+	})
+}
@@ -0,0 +1,252 @@
+package foundation
+
+import (
+	"errors"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// memoryExpression evaluates the "$field" references of an aggregation
+// expression; other values are constants
+func memoryExpression(document bson.M, expression interface{}) interface{} {
+	if path, ok := expression.(string); ok && strings.HasPrefix(path, "$") {
+		value, _ := lookupMemoryPath(document, path[1:])
+		return value
+	}
+
+	if fields, ok := asMemoryDocument(expression); ok {
+		result := bson.M{}
+		for key, value := range fields {
+			result[key] = memoryExpression(document, value)
+		}
+		return result
+	}
+
+	return expression
+}
+
+type memoryGroup struct {
+	id        interface{}
+	documents []bson.M
+}
+
+func groupMemoryDocuments(documents []bson.M, group bson.M) ([]bson.M, error) {
+	idExpression, ok := group["_id"]
+	if !ok {
+		return nil, errors.New("MemoryRepository.Aggregate: $group needs an _id")
+	}
+
+	groups := []*memoryGroup{}
+	for _, document := range documents {
+		id := memoryExpression(document, idExpression)
+
+		var found *memoryGroup
+		for _, current := range groups {
+			if memoryValuesEqual(current.id, id) {
+				found = current
+				break
+			}
+		}
+		if found == nil {
+			found = &memoryGroup{id: id}
+			groups = append(groups, found)
+		}
+		found.documents = append(found.documents, document)
+	}
+
+	result := []bson.M{}
+	for _, current := range groups {
+		grouped := bson.M{"_id": current.id}
+		for field, expression := range group {
+			if field == "_id" {
+				continue
+			}
+			value, err := accumulateMemoryDocuments(current.documents, expression)
+			if err != nil {
+				return nil, err
+			}
+			grouped[field] = value
+		}
+		result = append(result, grouped)
+	}
+
+	return result, nil
+}
+
+func accumulateMemoryDocuments(documents []bson.M, expression interface{}) (interface{}, error) {
+	accumulator, ok := asMemoryDocument(expression)
+	if !ok || len(accumulator) != 1 {
+		return nil, errors.New("MemoryRepository.Aggregate: a $group field needs one accumulator")
+	}
+
+	for operator, argument := range accumulator {
+		values := bson.A{}
+		for _, document := range documents {
+			value := memoryExpression(document, argument)
+			if value != nil {
+				values = append(values, value)
+			}
+		}
+
+		switch operator {
+		case "$sum", "$avg":
+			sum, integer, count := 0.0, true, 0
+			for _, value := range values {
+				number, ok := asMemoryNumber(value)
+				if !ok {
+					continue
+				}
+				if _, isFloat := value.(float64); isFloat {
+					integer = false
+				}
+				sum += number
+				count++
+			}
+			if operator == "$avg" {
+				if count == 0 {
+					return nil, nil
+				}
+				return sum / float64(count), nil
+			}
+			if integer {
+				return int64(sum), nil
+			}
+			return sum, nil
+		case "$min", "$max":
+			var result interface{}
+			for _, value := range values {
+				comparison := compareMemoryValues(value, result)
+				if result == nil || operator == "$min" && comparison < 0 || operator == "$max" && comparison > 0 {
+					result = value
+				}
+			}
+			return result, nil
+		default:
+			return nil, errors.New("MemoryRepository.Aggregate: accumulator is not supported: " + operator)
+		}
+	}
+
+	return nil, nil
+}
+
+func unwindMemoryDocuments(documents []bson.M, argument interface{}) ([]bson.M, error) {
+	path, preserveEmpty := "", false
+	switch unwind := argument.(type) {
+	case string:
+		path = unwind
+	default:
+		options, err := toMemoryDocument(argument)
+		if err != nil {
+			return nil, err
+		}
+		path, _ = options["path"].(string)
+		preserveEmpty = asMemoryBool(options["preserveNullAndEmptyArrays"])
+	}
+
+	if !strings.HasPrefix(path, "$") {
+		return nil, errors.New("MemoryRepository.Aggregate: $unwind needs a \"$field\" path")
+	}
+	field := path[1:]
+
+	result := []bson.M{}
+	for _, document := range documents {
+		value, found := lookupMemoryPath(document, field)
+		array, isArray := asMemoryArray(value)
+
+		switch {
+		case !found || value == nil || isArray && len(array) == 0:
+			if preserveEmpty {
+				result = append(result, document)
+			}
+		case !isArray:
+			result = append(result, document)
+		default:
+			for _, item := range array {
+				unwound, err := toMemoryDocument(document)
+				if err != nil {
+					return nil, err
+				}
+				setMemoryPath(unwound, field, item)
+				result = append(result, unwound)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// lookup joins the documents of another collection of the same database
+func (m *MemoryRepository) lookup(documents []bson.M, lookup bson.M) ([]bson.M, error) {
+	from, _ := lookup["from"].(string)
+	localField, _ := lookup["localField"].(string)
+	foreignField, _ := lookup["foreignField"].(string)
+	as, _ := lookup["as"].(string)
+	if from == "" || localField == "" || foreignField == "" || as == "" {
+		return nil, errors.New("MemoryRepository.Aggregate: $lookup needs from, localField, foreignField and as")
+	}
+
+	foreign := &MemoryRepository{DataBase: m.DataBase, Collection: from}
+	foreignDocuments, err := foreign.documents()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, document := range documents {
+		local, _ := lookupMemoryPath(document, localField)
+
+		filter := bson.M{foreignField: local}
+		if array, ok := asMemoryArray(local); ok {
+			filter = bson.M{foreignField: bson.M{"$in": array}}
+		}
+
+		joined, err := filterMemoryDocuments(foreignDocuments, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		values := bson.A{}
+		for _, item := range joined {
+			values = append(values, item)
+		}
+		setMemoryPath(document, as, values)
+	}
+
+	return documents, nil
+}
+
+// facet runs each sub-pipeline over a copy of the documents
+func (m *MemoryRepository) facet(documents []bson.M, argument interface{}) ([]bson.M, error) {
+	facets := map[string]interface{}{}
+	switch facet := argument.(type) {
+	case bson.M:
+		facets = facet
+	case bson.D:
+		for _, element := range facet {
+			facets[element.Key] = element.Value
+		}
+	default:
+		return nil, errors.New("MemoryRepository.Aggregate: $facet needs a document")
+	}
+
+	result := bson.M{}
+	for name, value := range facets {
+		pipeline, err := getPipelineStages(value)
+		if err != nil {
+			return nil, errors.New("MemoryRepository.Aggregate: $facet " + name + ": " + err.Error())
+		}
+
+		faceted, err := m.runPipeline(cloneMemoryDocuments(documents), pipeline)
+		if err != nil {
+			return nil, err
+		}
+
+		values := bson.A{}
+		for _, item := range faceted {
+			values = append(values, item)
+		}
+		result[name] = values
+	}
+
+	return []bson.M{result}, nil
+}
@@ -0,0 +1,2120 @@
+package foundation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weitecit/pkg/log"
+	"github.com/weitecit/pkg/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryStore keeps the documents of every MemoryRepository in process.
+// Collections are indexed by "database.collection" so repositories cloned
+// for the same collection share their data, as they would on a server.
+type memoryStore struct {
+	mu          sync.RWMutex
+	collections map[string][]bson.M
+	// Indexes declared by EnsureIndexes, only unique ones are enforced
+	indexes map[string]map[string]Index
+	// Serializes transactions so a unit of work never sees another one half done
+	transactions sync.Mutex
+	// Changes of the watched collections, see Watch
+	watched  map[string]bool
+	changes  map[string][]memoryChange
+	sequence int64
+	// Closed and replaced on every change to wake up the watchers
+	changed chan struct{}
+}
+
+// memoryTransactionKey marks the context of an ongoing MemoryRepository transaction
+type memoryTransactionKey struct{}
+
+var memoryDataBases = &memoryStore{
+	collections: map[string][]bson.M{},
+	indexes:     map[string]map[string]Index{},
+	watched:     map[string]bool{},
+	changes:     map[string][]memoryChange{},
+	changed:     make(chan struct{}),
+}
+
+func cloneMemoryDocuments(documents []bson.M) []bson.M {
+	result := make([]bson.M, 0, len(documents))
+	for _, document := range documents {
+		clone, err := toMemoryDocument(document)
+		if err != nil {
+			log.Err(err)
+			continue
+		}
+		result = append(result, clone)
+	}
+	return result
+}
+
+// MemoryRepository is an in-process Repository that stores documents as BSON
+// and evaluates the same query MongoRepository.GetFilter sends to MongoDB.
+// It is meant for hermetic tests of model code.
+type MemoryRepository struct {
+	Error            error
+	ConnectionString string
+	RepoID           string
+	DataBase         string
+	Collection       string
+	// Kept for Repository.GetTimeout but not applied: the operations do not
+	// wait on anything, only the cancellation of the request context is
+	// checked
+	Timeout time.Duration
+}
+
+func (m *MemoryRepository) ToJSON() string {
+	o, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		log.Err(err)
+		return "Error in conversion"
+	}
+	return string(o)
+}
+
+func NewMemoryRepository(connection string, repoID string, collection string, isGlobal bool) MemoryRepository {
+	m := MemoryRepository{}
+	m.ConnectionString = connection
+	m.RepoID = repoID
+	m.DataBase = repoID
+	m.Collection = collection
+
+	if isGlobal {
+		m.DataBase = utils.GetEnv("DEFAULT_DATABASE")
+	}
+
+	if m.DataBase == "" {
+		m.Error = errors.New("MemoryRepository.NewMemoryRepository: Database can not be empty")
+	}
+
+	return m
+}
+
+// checkContext fails the operation when the request context is already
+// cancelled or past its deadline, as the driver would
+func (m *MemoryRepository) checkContext(request RepoRequest) error {
+	if request.Context == nil {
+		return nil
+	}
+	return request.Context.Err()
+}
+
+func (m *MemoryRepository) SetTimeout(timeout time.Duration) {
+	m.Timeout = timeout
+}
+
+func (m *MemoryRepository) GetTimeout() time.Duration {
+	return m.Timeout
+}
+
+func (m *MemoryRepository) collectionKey(collection string) (string, error) {
+	if m.DataBase == "" {
+		return "", errors.New("MemoryRepository.collectionKey: not database name")
+	}
+	if collection == "" {
+		return "", errors.New("MemoryRepository.collectionKey: not collection assigned")
+	}
+	return m.DataBase + "." + collection, nil
+}
+
+// documents returns a private copy of the collection documents
+func (m *MemoryRepository) documents() ([]bson.M, error) {
+	key, err := m.collectionKey(m.Collection)
+	if err != nil {
+		return nil, err
+	}
+
+	memoryDataBases.mu.RLock()
+	defer memoryDataBases.mu.RUnlock()
+
+	return cloneMemoryDocuments(memoryDataBases.collections[key]), nil
+}
+
+// write runs fn over the collection documents under the store lock and saves
+// the returned documents when fn succeeds
+func (m *MemoryRepository) write(fn func(documents []bson.M) ([]bson.M, error)) error {
+	key, err := m.collectionKey(m.Collection)
+	if err != nil {
+		return err
+	}
+
+	memoryDataBases.mu.Lock()
+	defer memoryDataBases.mu.Unlock()
+
+	documents, err := fn(cloneMemoryDocuments(memoryDataBases.collections[key]))
+	if err != nil {
+		return err
+	}
+
+	err = m.checkUniqueIndexes(key, documents)
+	if err != nil {
+		return err
+	}
+
+	recordMemoryChanges(key, memoryDataBases.collections[key], documents)
+	memoryDataBases.collections[key] = documents
+	return nil
+}
+
+func (m *MemoryRepository) normalizeFilter(filter map[string]interface{}) (bson.M, error) {
+	return toMemoryDocument(filter)
+}
+
+func filterMemoryDocuments(documents []bson.M, filter bson.M) ([]bson.M, error) {
+	result := []bson.M{}
+	for _, document := range documents {
+		matched, err := matchMemoryDocument(document, filter)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			result = append(result, document)
+		}
+	}
+	return result, nil
+}
+
+// findByFilter returns the documents a read of request finds
+func (m *MemoryRepository) findByFilter(request RepoRequest) ([]bson.M, error) {
+	filter, err := m.GetFilter(request.FindOptions)
+	if err != nil {
+		return nil, err
+	}
+	filter = notDeletedFilter(filter, request)
+
+	// there is no text index, any word in the search fields matches
+	textSearch := isTextSearch(request)
+	words := searchWords(request.SearchTerms)
+	if textSearch {
+		if len(request.SearchFields) == 0 {
+			return nil, errors.New("MemoryRepository.Find: text search needs a SearchableModel")
+		}
+		filter = bson.M{"$and": bson.A{filter, searchRegexFilter(request.SearchFields, words, false)}}
+	} else {
+		filter = searchFilter(filter, request)
+	}
+
+	normalized, err := m.normalizeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	documents, err := m.documents()
+	if err != nil {
+		return nil, err
+	}
+
+	documents, err = filterMemoryDocuments(documents, normalized)
+	if err != nil {
+		return nil, err
+	}
+	// like $near, before the orders of the query, which are stable
+	sortMemoryNear(documents, normalized)
+	if !textSearch {
+		return documents, nil
+	}
+
+	for _, document := range documents {
+		document[SearchScoreField], err = searchScore(document, request.SearchFields, words)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return documents, nil
+}
+
+// project applies the projection of a read, see readProjection
+func (m *MemoryRepository) project(documents []bson.M, request RepoRequest) ([]bson.M, error) {
+	projection, err := readProjection(request)
+	if err != nil {
+		return nil, err
+	}
+	return projectMemoryDocuments(documents, projection), nil
+}
+
+func (m *MemoryRepository) idFilter(id interface{}) (bson.M, error) {
+	return m.normalizeFilter(bson.M{"_id": id})
+}
+
+// decodeMemoryList decodes documents into a new slice of the same type as
+// *list, the way cursor.All fills RepoResponse.List
+func decodeMemoryList(documents []bson.M, list *interface{}) error {
+	target := reflect.ValueOf(*list)
+	if !target.IsValid() || target.Kind() != reflect.Slice {
+		return errors.New("MemoryRepository.decodeMemoryList: list must be a slice")
+	}
+
+	elemType := target.Type().Elem()
+	result := reflect.MakeSlice(target.Type(), 0, len(documents))
+
+	for _, document := range documents {
+		raw, err := bson.Marshal(document)
+		if err != nil {
+			return err
+		}
+
+		if elemType.Kind() == reflect.Ptr {
+			item := reflect.New(elemType.Elem())
+			err = bson.Unmarshal(raw, item.Interface())
+			if err != nil {
+				return err
+			}
+			result = reflect.Append(result, item)
+			continue
+		}
+
+		item := reflect.New(elemType)
+		err = bson.Unmarshal(raw, item.Interface())
+		if err != nil {
+			return err
+		}
+		result = reflect.Append(result, item.Elem())
+	}
+
+	*list = result.Interface()
+	return nil
+}
+
+func (m *MemoryRepository) Update(request RepoRequest) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	response := &RepoResponse{}
+
+	if request.Model == nil {
+		response.Error = errors.New("MemoryRepository.Update: model can not be empty")
+		return *response
+	}
+
+	if err := beforeSave(request); err != nil {
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	version, versionable := increaseVersion(request.Model)
+	request.Model.SetUpdated(request.User)
+	if request.Model.IsNew() {
+		return m.create(request)
+	}
+
+	id, err := request.Model.GetID()
+	if err != nil {
+		restoreVersion(request.Model, version)
+		err = errors.New("MemoryRepository.Update: " + err.Error())
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	values, err := updateDocument(request.Model)
+	if err != nil {
+		restoreVersion(request.Model, version)
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	idFilter, err := m.idFilter(id)
+	if err != nil {
+		restoreVersion(request.Model, version)
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	before, err := m.readHistory(request, idFilter)
+	if err != nil {
+		restoreVersion(request.Model, version)
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	// the document is not written while another user holds its lock
+	now := time.Now()
+	rawFilter := bson.M{"_id": id, "$or": unlockedFilter(request.User.GetIDStr(), now)}
+	checkVersion := versionable && request.CheckVersion
+	if checkVersion {
+		rawFilter["version"] = versionFilter(version)
+	}
+	filter, err := m.normalizeFilter(rawFilter)
+	if err != nil {
+		restoreVersion(request.Model, version)
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	modified, err := m.setMatching(filter, values, 1)
+	if err != nil {
+		restoreVersion(request.Model, version)
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	// Nothing modified may be unchanged values, or a lock or version that did
+	// not match. The version always changes.
+	if modified == 0 {
+		stored, err := m.findByID(id)
+		if err != nil {
+			restoreVersion(request.Model, version)
+			log.Err(err)
+			return RepoResponse{Error: err}
+		}
+		if stored != nil {
+			if lock := documentLock(stored); lockedFor(lock, request.User.GetIDStr(), now) {
+				restoreVersion(request.Model, version)
+				err := NewRecordLockedError(m.Collection, id, lock)
+				log.Trace(err)
+				return RepoResponse{Error: err}
+			}
+			if checkVersion {
+				restoreVersion(request.Model, version)
+				err := NewConflictError(m.Collection, id, version)
+				log.Trace(err)
+				return RepoResponse{Error: err}
+			}
+		}
+	}
+
+	response.TotalRows = modified
+	response.List = []interface{}{request.Model}
+
+	err = m.writeHistory(request, HistoryOperationUpdate, before, historyIDs(before))
+	if err != nil {
+		response.Errors = []error{err}
+	}
+
+	return *response
+}
+
+// findByID returns the stored document with the ID, nil if there is none
+func (m *MemoryRepository) findByID(id interface{}) (bson.M, error) {
+	filter, err := m.idFilter(id)
+	if err != nil {
+		return nil, err
+	}
+
+	documents, err := m.documents()
+	if err != nil {
+		return nil, err
+	}
+
+	found, err := filterMemoryDocuments(documents, filter)
+	if err != nil || len(found) == 0 {
+		return nil, err
+	}
+
+	return found[0], nil
+}
+
+func (m *MemoryRepository) setMatching(filter bson.M, values bson.M, limit int) (int64, error) {
+	modified := int64(0)
+
+	err := m.write(func(documents []bson.M) ([]bson.M, error) {
+		matches := 0
+		for _, document := range documents {
+			matched, err := matchMemoryDocument(document, filter)
+			if err != nil {
+				return nil, err
+			}
+			if !matched {
+				continue
+			}
+
+			before, err := toMemoryDocument(document)
+			if err != nil {
+				return nil, err
+			}
+			for field, value := range values {
+				setMemoryPath(document, field, value)
+			}
+			if !memoryValuesEqual(before, document) {
+				modified++
+			}
+
+			matches++
+			if limit > 0 && matches >= limit {
+				break
+			}
+		}
+		return documents, nil
+	})
+
+	return modified, err
+}
+
+func (m *MemoryRepository) UpdateMany(request RepoRequest, values map[string]interface{}) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	findOptions := request.FindOptions
+
+	isEmpty := findOptions.filterIsEmpty()
+	if isEmpty {
+		err := errors.New("MemoryRepository.UpdateMany: " + m.Collection + " model can not be empty. Filter is empty")
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	if err := beforeUpdateMany(request, values); err != nil {
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	values["updated_by"] = request.User.GetUserLog()
+
+	return m.updateByFilter(request, HistoryOperationUpdateMany, values)
+}
+
+func (m *MemoryRepository) updateByFilter(request RepoRequest, operation HistoryOperation, values map[string]interface{}) RepoResponse {
+	getFilter, err := m.GetFilter(request.FindOptions)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	filter, err := m.normalizeFilter(getFilter)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	normalizedValues, err := toMemoryDocument(values)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	before, err := m.readHistory(request, filter)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	modified, err := m.setMatching(filter, normalizedValues, 0)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{TotalRows: modified, Error: err}
+	}
+
+	err = m.writeHistory(request, operation, before, historyIDs(before))
+	if err != nil {
+		return RepoResponse{TotalRows: modified, Errors: []error{err}}
+	}
+
+	return RepoResponse{TotalRows: modified}
+}
+
+// updateArray replaces the array field of the document with the given id by
+// the result of fn and returns the new array length
+func (m *MemoryRepository) updateArray(request RepoRequest, field string, fn func(current interface{}) bson.A) (int, error) {
+	id, err := utils.GetObjectIdFromString(request.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	filter, err := m.idFilter(id)
+	if err != nil {
+		return 0, err
+	}
+
+	size := 0
+	err = m.write(func(documents []bson.M) ([]bson.M, error) {
+		for _, document := range documents {
+			matched, err := matchMemoryDocument(document, filter)
+			if err != nil {
+				return nil, err
+			}
+			if !matched {
+				continue
+			}
+			current, _ := lookupMemoryPath(document, field)
+			items := fn(current)
+			setMemoryPath(document, field, items)
+			size = len(items)
+			break
+		}
+		return documents, nil
+	})
+
+	return size, err
+}
+
+func memoryArrayContains(items bson.A, value interface{}) bool {
+	for _, item := range items {
+		if memoryValuesEqual(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// memorySetDifference mirrors $setDifference: distinct items not in value
+func memorySetDifference(items bson.A, value interface{}) bson.A {
+	result := bson.A{}
+	for _, item := range items {
+		if memoryValuesEqual(item, value) || memoryArrayContains(result, item) {
+			continue
+		}
+		result = append(result, item)
+	}
+	return result
+}
+
+func (m *MemoryRepository) AddItemInArray(request RepoRequest, field string, value string) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	_, err := m.updateArray(request, field, func(current interface{}) bson.A {
+		items, isArray := asMemoryArray(current)
+		if !isArray {
+			return bson.A{value}
+		}
+		if memoryArrayContains(items, value) {
+			return items
+		}
+		return append(items, value)
+	})
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	return RepoResponse{TotalRows: 1}
+}
+
+func (m *MemoryRepository) RemoveItemInArray(request RepoRequest, field string, value string) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	_, err := m.updateArray(request, field, func(current interface{}) bson.A {
+		items, isArray := asMemoryArray(current)
+		if !isArray {
+			return bson.A{}
+		}
+		return memorySetDifference(items, value)
+	})
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	return RepoResponse{TotalRows: 1}
+}
+
+func (m *MemoryRepository) SwitchItemInArray(request RepoRequest, field string, value string) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	size, err := m.updateArray(request, field, func(current interface{}) bson.A {
+		items, isArray := asMemoryArray(current)
+		if !isArray {
+			return bson.A{value}
+		}
+		if memoryArrayContains(items, value) {
+			return memorySetDifference(items, value)
+		}
+		return append(items, value)
+	})
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	return RepoResponse{TotalRows: int64(size)}
+}
+
+func (m *MemoryRepository) UpdateField(request RepoRequest, field string, value interface{}) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	findOptions := request.FindOptions
+
+	isEmpty := findOptions.filterIsEmpty()
+	if isEmpty {
+		err := errors.New("MemoryRepository.UpdateField: " + m.Collection + " model can not be empty. Filter is empty")
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	values := map[string]interface{}{
+		field: value,
+	}
+
+	if err := beforeUpdateMany(request, values); err != nil {
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	return m.updateByFilter(request, HistoryOperationUpdateField, values)
+}
+
+func (m *MemoryRepository) Move(request RepoRequest) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	if request.TargetCollection == "" {
+		err := errors.New("MemoryRepository.Move: move collection can not be empty")
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	findOptions := request.FindOptions
+
+	isEmpty := findOptions.filterIsEmpty()
+	if isEmpty {
+		err := errors.New("MemoryRepository.Move: " + m.Collection + " model can not be empty. Filter is empty")
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	getFilter, err := m.GetFilter(findOptions)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	filter, err := m.normalizeFilter(getFilter)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	sourceKey, err := m.collectionKey(m.Collection)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	targetKey, err := m.collectionKey(request.TargetCollection)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	memoryDataBases.mu.Lock()
+	defer memoryDataBases.mu.Unlock()
+
+	source := cloneMemoryDocuments(memoryDataBases.collections[sourceKey])
+	target := cloneMemoryDocuments(memoryDataBases.collections[targetKey])
+	kept := []bson.M{}
+	moved := int64(0)
+
+	for _, document := range source {
+		matched, err := matchMemoryDocument(document, filter)
+		if err != nil {
+			log.Err(err)
+			return RepoResponse{TotalRows: -1, Error: err}
+		}
+		if !matched {
+			kept = append(kept, document)
+			continue
+		}
+
+		// $merge defaults: merge on _id when matched, insert otherwise
+		merged := false
+		for _, existing := range target {
+			if memoryValuesEqual(existing["_id"], document["_id"]) {
+				for field, value := range document {
+					existing[field] = value
+				}
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			target = append(target, document)
+		}
+		moved++
+	}
+
+	recordMemoryChanges(targetKey, memoryDataBases.collections[targetKey], target)
+	recordMemoryChanges(sourceKey, memoryDataBases.collections[sourceKey], kept)
+	memoryDataBases.collections[targetKey] = target
+	memoryDataBases.collections[sourceKey] = kept
+
+	return RepoResponse{TotalRows: moved}
+}
+
+func (m *MemoryRepository) DeleteSoft(request RepoRequest) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	// Soft delete can avoid filterIsEmpty check
+	userLog := request.User.GetUserLog()
+
+	values := map[string]interface{}{
+		"deleted_by": userLog,
+	}
+
+	if err := beforeDelete(request); err != nil {
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	return m.updateByFilter(request, HistoryOperationDeleteSoft, values)
+}
+
+func (m *MemoryRepository) Restore(request RepoRequest) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	if request.FindOptions.filterIsEmpty() {
+		err := errors.New("MemoryRepository.Restore: " + m.Collection + " filter can not be empty")
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	getFilter, err := m.GetFilter(request.FindOptions)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	filter, err := m.normalizeFilter(bson.M{"$and": bson.A{getFilter, bson.M{"deleted_by": bson.M{"$ne": nil}}}})
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	userLog, err := normalizeMemoryValue(request.User.GetUserLog())
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	restored := int64(0)
+	err = m.write(func(documents []bson.M) ([]bson.M, error) {
+		for _, document := range documents {
+			matched, err := matchMemoryDocument(document, filter)
+			if err != nil {
+				return nil, err
+			}
+			if !matched {
+				continue
+			}
+			delete(document, "deleted_by")
+			document["updated_by"] = userLog
+			restored++
+		}
+		return documents, nil
+	})
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	return RepoResponse{TotalRows: restored}
+}
+
+func (m *MemoryRepository) RemoveField(request RepoRequest, field string) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	userLog := request.User.GetUserLog()
+
+	values := map[string]interface{}{
+		"updated_by": userLog,
+		field:        nil,
+	}
+
+	if err := beforeUpdateMany(request, values); err != nil {
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	return m.updateByFilter(request, HistoryOperationUpdateField, values)
+}
+
+func (m *MemoryRepository) create(request RepoRequest) RepoResponse {
+
+	model := request.Model
+	model.SetCreated(request.User)
+
+	document, err := toMemoryDocument(model)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	err = m.insert(document)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	response := RepoResponse{
+		TotalRows: 1,
+		List:      []interface{}{model},
+	}
+
+	err = m.writeHistory(request, HistoryOperationCreate, nil, bson.A{document["_id"]})
+	if err != nil {
+		response.Errors = []error{err}
+	}
+
+	return response
+}
+
+// readHistory returns the documents matching filter before a write, when the
+// model of the request keeps its History
+func (m *MemoryRepository) readHistory(request RepoRequest, filter bson.M) ([]bson.M, error) {
+	if !keepsHistory(request.Model) {
+		return nil, nil
+	}
+
+	documents, err := m.documents()
+	if err != nil {
+		return nil, err
+	}
+
+	return filterMemoryDocuments(documents, filter)
+}
+
+// writeHistory saves the History of a write, see MongoRepository.writeHistory
+func (m *MemoryRepository) writeHistory(request RepoRequest, operation HistoryOperation, before []bson.M, ids bson.A) error {
+	if !keepsHistory(request.Model) || len(ids) == 0 {
+		return nil
+	}
+
+	filter, err := m.normalizeFilter(bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+
+	after, err := m.readHistory(request, filter)
+	if err != nil {
+		log.Err(err)
+		return err
+	}
+
+	documents := []bson.M{}
+	for _, record := range newHistories(operation, request.User, before, after) {
+		document, err := toMemoryDocument(record)
+		if err != nil {
+			return err
+		}
+		documents = append(documents, document)
+	}
+	if len(documents) == 0 {
+		return nil
+	}
+
+	history := &MemoryRepository{DataBase: m.DataBase, Collection: historyCollection(m.Collection)}
+	err = history.insert(documents...)
+	if err != nil {
+		err = errors.New("MemoryRepository.writeHistory: " + err.Error())
+		log.Err(err)
+	}
+	return err
+}
+
+func (m *MemoryRepository) insert(newDocuments ...bson.M) error {
+	return m.write(func(documents []bson.M) ([]bson.M, error) {
+		for _, document := range newDocuments {
+			if _, ok := document["_id"]; !ok {
+				document["_id"] = primitive.NewObjectID()
+			}
+			for _, existing := range documents {
+				if memoryValuesEqual(existing["_id"], document["_id"]) {
+					return nil, fmt.Errorf("MemoryRepository.insert: E11000 duplicate key error collection: %s.%s index: _id_ dup key: %v", m.DataBase, m.Collection, document["_id"])
+				}
+			}
+			documents = append(documents, document)
+		}
+		return documents, nil
+	})
+}
+
+// CreateMany inserts list as it is, without hooks. The models never stored
+// get an ID and a CreatedBy, their UpdatedBy and Version are kept.
+func (m *MemoryRepository) CreateMany(dbModel RepositoryModel, list []interface{}) error {
+
+	if len(list) == 0 {
+		return nil
+	}
+
+	response := m.BulkWrite(RepoRequest{}, BulkList{NewList: list, Ordered: true, keepModels: true})
+	if response.Error != nil {
+		return response.Error
+	}
+	if len(response.Errors) > 0 {
+		return response.Errors[0]
+	}
+	return nil
+}
+
+func (m *MemoryRepository) BulkWrite(request RepoRequest, list BulkList) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	key, err := m.collectionKey(m.Collection)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	items := prepareBulkItems(request, list)
+
+	written := 0
+	err = m.write(func(documents []bson.M) ([]bson.M, error) {
+		for written < len(items) {
+			item := &items[written]
+			written++
+			if item.err == nil {
+				// every item is checked against the unique indexes on its own
+				next, err := m.bulkWriteItem(cloneMemoryDocuments(documents), item)
+				if err == nil {
+					err = m.checkUniqueIndexes(key, next)
+				}
+				if err == nil {
+					documents = next
+				}
+				item.err = err
+			}
+			if item.err != nil && list.Ordered {
+				break
+			}
+		}
+		return documents, nil
+	})
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	return bulkResponse(items, written)
+}
+
+func (m *MemoryRepository) bulkWriteItem(documents []bson.M, item *bulkItem) ([]bson.M, error) {
+
+	if item.operation == BulkOperationInsert {
+		for _, existing := range documents {
+			if memoryValuesEqual(existing["_id"], item.document["_id"]) {
+				return documents, fmt.Errorf("E11000 duplicate key error collection: %s.%s index: _id_ dup key: %v", m.DataBase, m.Collection, item.document["_id"])
+			}
+		}
+		return append(documents, item.document), nil
+	}
+
+	filter, err := m.normalizeFilter(item.filter)
+	if err != nil {
+		return documents, err
+	}
+
+	for i, document := range documents {
+		matched, err := matchMemoryDocument(document, filter)
+		if err != nil {
+			return documents, err
+		}
+		if !matched {
+			continue
+		}
+
+		if item.operation == BulkOperationDelete {
+			return append(documents[:i], documents[i+1:]...), nil
+		}
+
+		for field, value := range item.document {
+			setMemoryPath(document, field, value)
+		}
+		version, _ := asMemoryNumber(document["version"])
+		document["version"] = int32(version) + 1
+		return documents, nil
+	}
+
+	if item.operation == BulkOperationDelete {
+		return documents, nil
+	}
+
+	onInsert, err := toMemoryDocument(item.onInsert)
+	if err != nil {
+		return documents, err
+	}
+
+	document := bson.M{"version": int32(1)}
+	for field, value := range filter {
+		document[field] = value
+	}
+	for field, value := range item.document {
+		document[field] = value
+	}
+	for field, value := range onInsert {
+		document[field] = value
+	}
+
+	item.setUpserted()
+	return append(documents, document), nil
+}
+
+func (m *MemoryRepository) FindOne(request RepoRequest) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	response := &RepoResponse{}
+
+	if request.Model == nil {
+		response.Error = errors.New("MemoryRepository.FindOne: model can not be empty")
+		return *response
+	}
+
+	id, err := request.Model.GetID()
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	filter, err := m.normalizeFilter(notDeletedFilter(bson.M{"_id": id}, request))
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	documents, err := m.documents()
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	found, err := filterMemoryDocuments(documents, filter)
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	if len(found) == 0 {
+		err = fmt.Errorf("MemoryRepository.GetDetail.%s: no document found, ID: %s", m.Collection, id)
+		log.Trace(err)
+		response.Error = err
+		return *response
+	}
+
+	found, err = m.project(found[:1], request)
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	raw, err := bson.Marshal(found[0])
+	if err != nil {
+		response.Error = err
+		return *response
+	}
+
+	response.TotalRows = 1
+	response.Error = bson.Unmarshal(raw, request.Model)
+	if response.Error == nil {
+		response.Error = afterFind(request, request.Model)
+	}
+
+	return *response
+}
+
+func (m *MemoryRepository) Find(request RepoRequest) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	if request.Model != nil {
+		_, err := request.Model.GetID()
+		if err == nil {
+			result := m.FindOne(request)
+			response := &RepoResponse{}
+			response.CurrentPage = result.CurrentPage
+			response.Error = result.Error
+			if response.Error != nil && strings.Contains(response.Error.Error(), "no document found") {
+				response.Error = nil
+			}
+			response.List = []interface{}{request.Model}
+			response.PageSize = result.PageSize
+			response.TotalPages = result.TotalPages
+			response.TotalRows = result.TotalRows
+			return *response
+		}
+	}
+
+	response := &RepoResponse{
+		List: request.List,
+	}
+
+	documents, err := m.findByFilter(request)
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	if request.CursorPaging {
+		return m.findByCursor(request, documents)
+	}
+
+	sortMemoryDocuments(documents, searchOrders(request))
+
+	count := int64(len(documents))
+	if count > 1000001 {
+		count = 1000001
+	}
+	response.TotalRows = count
+
+	documents, err = m.project(pageMemoryDocuments(documents, request), request)
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	err = decodeMemoryList(documents, &response.List)
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	err = afterFindList(request, response.List)
+	if err != nil {
+		log.Trace(err)
+		response.Error = err
+		return *response
+	}
+
+	response.CurrentPage = request.CurrentPage
+	response.PageSize = request.PageSize
+
+	if count > 0 && request.PageSize > 0 {
+		response.TotalPages = count / request.PageSize
+		if count/request.PageSize > 0 {
+			response.TotalPages++
+		}
+	}
+
+	return *response
+}
+
+// pageMemoryDocuments returns the page of request.CurrentPage the way the
+// Skip and Limit of MongoRepository.Find do
+func pageMemoryDocuments(documents []bson.M, request RepoRequest) []bson.M {
+	skippedRows := request.PageSize * (request.CurrentPage - 1)
+	if skippedRows < 0 || request.PageSize <= 0 {
+		skippedRows = 0
+	}
+	if skippedRows > int64(len(documents)) {
+		skippedRows = int64(len(documents))
+	}
+	documents = documents[skippedRows:]
+
+	if request.CurrentPage > 0 && request.PageSize > 0 && int64(len(documents)) > request.PageSize {
+		documents = documents[:request.PageSize]
+	}
+
+	return documents
+}
+
+func (m *MemoryRepository) FindStream(request RepoRequest, fn StreamFunc) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	if fn == nil {
+		err := errors.New("MemoryRepository.FindStream: fn can not be nil")
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	documents, err := m.findByFilter(request)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	sortMemoryDocuments(documents, searchOrders(request))
+
+	documents, err = m.project(pageMemoryDocuments(documents, request), request)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	return m.stream(documents, request, afterFindStream(request, fn))
+}
+
+func (m *MemoryRepository) stream(documents []bson.M, request RepoRequest, fn StreamFunc) RepoResponse {
+	next := func() ([]byte, bool, error) {
+		if err := m.checkContext(request); err != nil {
+			return nil, false, err
+		}
+		if len(documents) == 0 {
+			return nil, false, nil
+		}
+		document := documents[0]
+		documents = documents[1:]
+
+		raw, err := bson.Marshal(document)
+		return raw, err == nil, err
+	}
+
+	total, err := streamRows(newStreamDecoder(request.List), next, fn)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{TotalRows: total, Error: err}
+	}
+
+	return RepoResponse{TotalRows: total}
+}
+
+// findByCursor pages documents, already filtered by the query, by keyset
+func (m *MemoryRepository) findByCursor(request RepoRequest, documents []bson.M) RepoResponse {
+
+	response := &RepoResponse{
+		List: request.List,
+	}
+
+	orders := cursorOrders(request.FindOptions)
+
+	count := int64(len(documents))
+	if count > 1000001 {
+		count = 1000001
+	}
+
+	afterCursor, err := cursorFilter(orders, request.Cursor)
+	if err != nil {
+		log.Trace(err)
+		response.Error = err
+		return *response
+	}
+
+	if afterCursor != nil {
+		filter, err := m.normalizeFilter(afterCursor)
+		if err != nil {
+			log.Err(err)
+			response.Error = err
+			return *response
+		}
+
+		documents, err = filterMemoryDocuments(documents, filter)
+		if err != nil {
+			log.Err(err)
+			response.Error = err
+			return *response
+		}
+	}
+
+	sortMemoryDocuments(documents, orders)
+
+	// one more row tells whether there is a next page
+	if request.PageSize > 0 && int64(len(documents)) > request.PageSize+1 {
+		documents = documents[:request.PageSize+1]
+	}
+
+	documents, err = m.project(documents, request)
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	err = decodeMemoryList(documents, &response.List)
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	response.List, response.NextCursor, err = nextCursor(orders, documents, response.List, request.PageSize)
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	err = afterFindList(request, response.List)
+	if err != nil {
+		log.Trace(err)
+		response.Error = err
+		return *response
+	}
+
+	response.PageSize = request.PageSize
+
+	if request.SkipCount {
+		return *response
+	}
+
+	response.TotalRows = count
+
+	if count > 0 && request.PageSize > 0 {
+		response.TotalPages = count / request.PageSize
+		if count/request.PageSize > 0 {
+			response.TotalPages++
+		}
+	}
+
+	return *response
+}
+
+func (m *MemoryRepository) Count(request RepoRequest) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	findResponse := &RepoResponse{}
+
+	documents, err := m.findByFilter(request)
+	if err != nil {
+		log.Err(err)
+		findResponse.Error = err
+		return *findResponse
+	}
+
+	count := int64(len(documents))
+	if request.PageSize > 0 && count > request.PageSize {
+		count = request.PageSize
+	}
+	findResponse.TotalRows = count
+
+	return *findResponse
+}
+
+func (m *MemoryRepository) Distinct(request RepoRequest, field string) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	if field == "" {
+		err := errors.New("MemoryRepository.Distinct: field can not be empty")
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	documents, err := m.findByFilter(request)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	values := []interface{}{}
+	for _, document := range documents {
+		values = append(values, fieldValues(document, field)...)
+	}
+	values = distinctValues(values)
+
+	return RepoResponse{TotalRows: int64(len(values)), List: values}
+}
+
+func (m *MemoryRepository) CountFacets(request RepoRequest, facets FacetOptions) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	err := facets.Validate()
+	if err != nil {
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	documents, err := m.findByFilter(request)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	counts := facets.countFacets(documents)
+	return RepoResponse{TotalRows: counts.Total, List: counts}
+}
+
+func (m *MemoryRepository) Delete(request RepoRequest) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	if err := beforeDelete(request); err != nil {
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	var id interface{}
+	if request.Model != nil {
+		var err error
+		id, err = request.Model.GetID()
+		if err != nil {
+			if err.Error() != "BaseModel.GetID: ID is nil" {
+				log.Trace(err)
+				return RepoResponse{Error: err}
+			}
+		}
+	}
+
+	if id != nil {
+		filter, err := m.idFilter(id)
+		if err != nil {
+			log.Trace(err)
+			return RepoResponse{Error: err}
+		}
+		before, err := m.readHistory(request, filter)
+		if err != nil {
+			log.Err(err)
+			return RepoResponse{Error: err}
+		}
+		_, err = m.deleteMatching(filter, 1)
+		if err != nil {
+			log.Trace(err)
+			return RepoResponse{Error: err}
+		}
+		err = m.writeHistory(request, HistoryOperationDelete, before, historyIDs(before))
+		if err != nil {
+			return RepoResponse{TotalRows: 1, Errors: []error{err}}
+		}
+		return RepoResponse{TotalRows: 1}
+	}
+
+	isEmpty := request.FindOptions.filterIsEmpty()
+	if isEmpty {
+		err := errors.New("MemoryRepository.Delete: " + m.Collection + " model can not be empty")
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	getFilter, err := m.GetFilter(request.FindOptions)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	filter, err := m.normalizeFilter(getFilter)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	before, err := m.readHistory(request, filter)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	deleted, err := m.deleteMatching(filter, 0)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	err = m.writeHistory(request, HistoryOperationDelete, before, historyIDs(before))
+	if err != nil {
+		return RepoResponse{TotalRows: deleted, Errors: []error{err}}
+	}
+
+	return RepoResponse{TotalRows: deleted}
+}
+
+// deleteMatching removes the documents matching filter. limit <= 0 removes
+// every match.
+func (m *MemoryRepository) deleteMatching(filter bson.M, limit int) (int64, error) {
+	deleted := int64(0)
+
+	err := m.write(func(documents []bson.M) ([]bson.M, error) {
+		kept := []bson.M{}
+		for _, document := range documents {
+			if limit > 0 && deleted >= int64(limit) {
+				kept = append(kept, document)
+				continue
+			}
+			matched, err := matchMemoryDocument(document, filter)
+			if err != nil {
+				return nil, err
+			}
+			if matched {
+				deleted++
+				continue
+			}
+			kept = append(kept, document)
+		}
+		return kept, nil
+	})
+
+	return deleted, err
+}
+
+// Aggregate supports the $match, $sort, $skip, $limit and $count stages,
+// enough for the pipelines built from FindOptions.
+func (m *MemoryRepository) Aggregate(request RepoRequest) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	response := &RepoResponse{
+		List: request.List,
+	}
+
+	pipeline, err := getPipelineStages(request.Pipeline)
+	if err != nil {
+		err = errors.New("MemoryRepository.Aggregate: " + err.Error())
+		log.Trace(err)
+		response.Error = err
+		return *response
+	}
+
+	documents, err := m.documents()
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	documents, err = m.runPipeline(documents, pipeline)
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	err = request.FindOptions.Projection.Validate()
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+	documents = projectMemoryDocuments(documents, request.FindOptions.Projection)
+
+	err = decodeMemoryList(documents, &response.List)
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	response.TotalRows = int64(len(documents))
+
+	return *response
+}
+
+func (m *MemoryRepository) runPipeline(documents []bson.M, pipeline bson.A) ([]bson.M, error) {
+	for _, rawStage := range pipeline {
+		var name string
+		var argument interface{}
+
+		switch stage := rawStage.(type) {
+		case bson.D:
+			if len(stage) != 1 {
+				return nil, errors.New("MemoryRepository.Aggregate: a stage must have exactly one field")
+			}
+			name, argument = stage[0].Key, stage[0].Value
+		case bson.M:
+			if len(stage) != 1 {
+				return nil, errors.New("MemoryRepository.Aggregate: a stage must have exactly one field")
+			}
+			for key, value := range stage {
+				name, argument = key, value
+			}
+		default:
+			return nil, errors.New("MemoryRepository.Aggregate: invalid stage")
+		}
+
+		switch name {
+		case "$match":
+			filter, err := toMemoryDocument(argument)
+			if err != nil {
+				return nil, err
+			}
+			documents, err = filterMemoryDocuments(documents, filter)
+			if err != nil {
+				return nil, err
+			}
+		case "$sort":
+			orders := Orders{}
+			switch sort := argument.(type) {
+			case bson.D:
+				for _, element := range sort {
+					direction, _ := asMemoryNumber(element.Value)
+					orders = append(orders, Order{Field: element.Key, Direction: int(direction)})
+				}
+			case bson.M:
+				for field, value := range sort {
+					direction, _ := asMemoryNumber(value)
+					orders = append(orders, Order{Field: field, Direction: int(direction)})
+				}
+			default:
+				return nil, errors.New("MemoryRepository.Aggregate: $sort needs a document")
+			}
+			sortMemoryDocuments(documents, orders)
+		case "$skip", "$limit":
+			value, err := normalizeMemoryValue(argument)
+			if err != nil {
+				return nil, err
+			}
+			number, ok := asMemoryNumber(value)
+			if !ok || number < 0 {
+				return nil, errors.New("MemoryRepository.Aggregate: " + name + " needs a positive number")
+			}
+			n := int(number)
+			if n > len(documents) {
+				n = len(documents)
+			}
+			if name == "$skip" {
+				documents = documents[n:]
+			} else {
+				documents = documents[:n]
+			}
+		case "$count":
+			field, ok := argument.(string)
+			if !ok || field == "" {
+				return nil, errors.New("MemoryRepository.Aggregate: $count needs a field name")
+			}
+			if len(documents) == 0 {
+				documents = []bson.M{}
+				continue
+			}
+			documents = []bson.M{{field: int32(len(documents))}}
+		case "$group":
+			group, err := toMemoryDocument(argument)
+			if err != nil {
+				return nil, err
+			}
+			documents, err = groupMemoryDocuments(documents, group)
+			if err != nil {
+				return nil, err
+			}
+		case "$unwind":
+			unwound, err := unwindMemoryDocuments(documents, argument)
+			if err != nil {
+				return nil, err
+			}
+			documents = unwound
+		case "$lookup":
+			lookup, err := toMemoryDocument(argument)
+			if err != nil {
+				return nil, err
+			}
+			documents, err = m.lookup(documents, lookup)
+			if err != nil {
+				return nil, err
+			}
+		case "$facet":
+			facets, err := m.facet(documents, argument)
+			if err != nil {
+				return nil, err
+			}
+			documents = facets
+		default:
+			return nil, errors.New("MemoryRepository.Aggregate: stage is not supported: " + name)
+		}
+	}
+
+	return documents, nil
+}
+
+// AggregateStream runs request.Pipeline and passes the rows to fn one at a
+// time, see FindStream
+func (m *MemoryRepository) AggregateStream(request RepoRequest, fn StreamFunc) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	if fn == nil {
+		err := errors.New("MemoryRepository.AggregateStream: fn can not be nil")
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	pipeline, err := getPipelineStages(request.Pipeline)
+	if err != nil {
+		err = errors.New("MemoryRepository.AggregateStream: " + err.Error())
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	documents, err := m.documents()
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	documents, err = m.runPipeline(documents, pipeline)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	return m.stream(documents, request, fn)
+}
+
+// GetFilter renders FindOptions with the MongoDB translation so both
+// backends interpret a query exactly the same way
+func (m *MemoryRepository) GetFilter(filterOptions FindOptions) (map[string]interface{}, error) {
+	translator := &MongoRepository{}
+	return translator.GetFilter(filterOptions)
+}
+
+func (m *MemoryRepository) GetOrder(filterOptions FindOptions) map[string]interface{} {
+	translator := &MongoRepository{}
+	return translator.GetOrder(filterOptions)
+}
+
+func (m *MemoryRepository) GetType() RepoType {
+	return RepoTypeMemory
+}
+
+func (m *MemoryRepository) GetRepoID() string {
+	return m.RepoID
+}
+
+func (m *MemoryRepository) GetDataBase() string {
+	return m.DataBase
+}
+
+func (m *MemoryRepository) GetConnection() string {
+	return m.ConnectionString
+}
+
+func (m *MemoryRepository) SetRepoID(repoID string) error {
+
+	if utils.IsEmptyStr(repoID) {
+		return errors.New("MemoryRepository.SetRepoID: repoID can not be empty")
+	}
+	m.RepoID = repoID
+	return nil
+}
+
+// RepoBackup writes the archive of the database, see MongoRepository.RepoBackup
+func (m *MemoryRepository) RepoBackup(request RepoRequest, backup BackupOptions) RepoResponse {
+	if m.DataBase == "" {
+		return RepoResponse{Error: errors.New("MemoryRepository.RepoBackup: not database name")}
+	}
+
+	prefix := m.DataBase + "."
+	memoryDataBases.mu.RLock()
+	snapshot := m.snapshotDataBase(m.DataBase)
+	indexes := map[string][]Index{}
+	for key, declared := range memoryDataBases.indexes {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		names := []string{}
+		for name := range declared {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			indexes[key] = append(indexes[key], declared[name])
+		}
+	}
+	memoryDataBases.mu.RUnlock()
+
+	keys := []string{}
+	for key := range snapshot {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return saveBackup(request, backup, m.DataBase, func(archive *backupWriter) error {
+		for _, key := range keys {
+			err := archive.collection(strings.TrimPrefix(key, prefix), indexes[key])
+			if err != nil {
+				return err
+			}
+			for _, document := range snapshot[key] {
+				raw, err := bson.Marshal(document)
+				if err != nil {
+					return err
+				}
+				err = archive.document(raw)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// RepoRestore replaces the database by the contents of the archive, see
+// MongoRepository.RepoRestore
+func (m *MemoryRepository) RepoRestore(request RepoRequest, backup BackupOptions) RepoResponse {
+	if m.DataBase == "" {
+		return RepoResponse{Error: errors.New("MemoryRepository.RepoRestore: not database name")}
+	}
+
+	return restoreBackup(request, backup, m.DataBase, func() (backupTarget, error) {
+		err := m.DeleteDatabase("", m.DataBase)
+		if err != nil {
+			return nil, err
+		}
+		return &memoryBackupTarget{database: m.DataBase}, nil
+	})
+}
+
+type memoryBackupTarget struct {
+	database  string
+	documents []bson.M
+}
+
+func (m *memoryBackupTarget) collection(name string, indexes []Index) error {
+	m.documents = []bson.M{}
+	return nil
+}
+
+func (m *memoryBackupTarget) document(collection string, document bson.Raw) error {
+	normalized := bson.M{}
+	err := bson.Unmarshal(document, &normalized)
+	if err != nil {
+		return err
+	}
+	normalized, err = toMemoryDocument(normalized)
+	if err != nil {
+		return err
+	}
+	m.documents = append(m.documents, normalized)
+	return nil
+}
+
+func (m *memoryBackupTarget) end(collection BackupCollection) error {
+	key := m.database + "." + collection.Name
+
+	memoryDataBases.mu.Lock()
+	recordMemoryChanges(key, memoryDataBases.collections[key], m.documents)
+	memoryDataBases.collections[key] = m.documents
+	memoryDataBases.mu.Unlock()
+
+	repo := &MemoryRepository{DataBase: m.database, Collection: collection.Name}
+	response := repo.EnsureIndexes(RepoRequest{}, collection.Indexes)
+	if response.Error != nil {
+		return response.Error
+	}
+	if len(response.Errors) > 0 {
+		return response.Errors[0]
+	}
+	return nil
+}
+
+// Transaction runs fn and, if it fails, restores the database to the state it
+// had before. Transactions are serialized between them but operations run
+// outside of a transaction can still see their partial writes.
+func (m *MemoryRepository) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if ctx.Value(memoryTransactionKey{}) != nil {
+		return fn(ctx)
+	}
+
+	if m.DataBase == "" {
+		return errors.New("MemoryRepository.Transaction: not database name")
+	}
+
+	memoryDataBases.transactions.Lock()
+	defer memoryDataBases.transactions.Unlock()
+
+	memoryDataBases.mu.Lock()
+	snapshot := m.snapshotDataBase(m.DataBase)
+	memoryDataBases.mu.Unlock()
+
+	err := fn(context.WithValue(ctx, memoryTransactionKey{}, m.DataBase))
+	if err != nil {
+		memoryDataBases.mu.Lock()
+		m.restoreDataBase(m.DataBase, snapshot)
+		memoryDataBases.mu.Unlock()
+	}
+
+	return err
+}
+
+// snapshotDataBase expects the store lock to be held
+func (m *MemoryRepository) snapshotDataBase(database string) map[string][]bson.M {
+	prefix := database + "."
+	snapshot := map[string][]bson.M{}
+	for key, documents := range memoryDataBases.collections {
+		if strings.HasPrefix(key, prefix) {
+			snapshot[key] = cloneMemoryDocuments(documents)
+		}
+	}
+	return snapshot
+}
+
+// restoreDataBase expects the store lock to be held
+func (m *MemoryRepository) restoreDataBase(database string, snapshot map[string][]bson.M) {
+	m.dropDataBase(database)
+	for key, documents := range snapshot {
+		memoryDataBases.collections[key] = cloneMemoryDocuments(documents)
+	}
+}
+
+// dropDataBase expects the store lock to be held
+func (m *MemoryRepository) dropDataBase(database string) {
+	prefix := database + "."
+	for key := range memoryDataBases.collections {
+		if strings.HasPrefix(key, prefix) {
+			delete(memoryDataBases.collections, key)
+		}
+	}
+}
+
+func (m *MemoryRepository) DeleteDatabase(connection string, database string) error {
+
+	if m.ConnectionString == "" || connection != "" {
+		m.ConnectionString = connection
+	}
+	if m.DataBase == "" || database != "" {
+		m.DataBase = database
+	}
+
+	if m.DataBase == "" {
+		err := errors.New("MemoryRepository.DeleteDatabase: DataBase can not be empty")
+		log.Err(err)
+		return err
+	}
+
+	memoryDataBases.mu.Lock()
+	defer memoryDataBases.mu.Unlock()
+
+	m.dropDataBase(m.DataBase)
+	for key := range memoryDataBases.indexes {
+		if strings.HasPrefix(key, m.DataBase+".") {
+			delete(memoryDataBases.indexes, key)
+		}
+	}
+	for key := range memoryDataBases.changes {
+		if strings.HasPrefix(key, m.DataBase+".") {
+			delete(memoryDataBases.changes, key)
+		}
+	}
+
+	return nil
+}
+
+// EnsureIndexes keeps the definitions of the indexes. Unique indexes are
+// enforced on every write, the rest only document the collection.
+func (m *MemoryRepository) EnsureIndexes(request RepoRequest, indexes []Index) RepoResponse {
+	if err := m.checkContext(request); err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	key, err := m.collectionKey(m.Collection)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	memoryDataBases.mu.Lock()
+	defer memoryDataBases.mu.Unlock()
+
+	declared := memoryDataBases.indexes[key]
+	if declared == nil {
+		declared = map[string]Index{}
+	}
+
+	response := RepoResponse{}
+	for _, index := range indexes {
+		err := index.Validate()
+		if err != nil {
+			response.Errors = append(response.Errors, err)
+			continue
+		}
+
+		name := index.GetName()
+		if current, ok := declared[name]; ok {
+			if !reflect.DeepEqual(current, index) {
+				response.Errors = append(response.Errors, indexChangedError("MemoryRepository.EnsureIndexes", m.Collection, name))
+			}
+			continue
+		}
+
+		if index.Unique {
+			err = checkMemoryUniqueIndex(key, index, memoryDataBases.collections[key])
+			if err != nil {
+				response.Errors = append(response.Errors, errors.New("MemoryRepository.EnsureIndexes: "+err.Error()))
+				continue
+			}
+		}
+		declared[name] = index
+		response.TotalRows++
+	}
+	memoryDataBases.indexes[key] = declared
+
+	return response
+}
+
+// checkUniqueIndexes expects the store lock to be held
+func (m *MemoryRepository) checkUniqueIndexes(key string, documents []bson.M) error {
+	for _, index := range memoryDataBases.indexes[key] {
+		if !index.Unique {
+			continue
+		}
+		err := checkMemoryUniqueIndex(key, index, documents)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkMemoryUniqueIndex(key string, index Index, documents []bson.M) error {
+	var partialFilter bson.M
+	if len(index.PartialFilter) > 0 {
+		filter, err := toMemoryDocument(index.PartialFilter)
+		if err != nil {
+			return err
+		}
+		partialFilter = filter
+	}
+
+	seen := map[string]bool{}
+	for _, document := range documents {
+		if partialFilter != nil {
+			matched, err := matchMemoryDocument(document, partialFilter)
+			if err != nil {
+				return err
+			}
+			if !matched {
+				continue
+			}
+		}
+
+		values := bson.A{}
+		found := false
+		for _, indexKey := range index.Keys {
+			value, ok := lookupMemoryPath(document, indexKey.Field)
+			found = found || ok
+			values = append(values, value)
+		}
+		if index.Sparse && !found {
+			continue
+		}
+
+		raw, err := bson.Marshal(bson.M{"v": values})
+		if err != nil {
+			return err
+		}
+		if seen[string(raw)] {
+			return fmt.Errorf("E11000 duplicate key error collection: %s index: %s dup key: %v", key, index.GetName(), values)
+		}
+		seen[string(raw)] = true
+	}
+
+	return nil
+}
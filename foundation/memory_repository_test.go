@@ -0,0 +1,1167 @@
+package foundation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/weitecit/pkg/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type memoryTestModel struct {
+	BaseModel `bson:",inline"`
+	Name      string     `json:"name" bson:"name"`
+	Amount    int        `json:"amount" bson:"amount"`
+	Items     []string   `json:"items" bson:"items"`
+	Groups    [][]string `json:"groups" bson:"groups"`
+}
+
+func (m *memoryTestModel) GetCollection() (name string, isGlobal bool) {
+	return "memory_test", false
+}
+
+func (m *memoryTestModel) GetRepoType() RepoType {
+	return RepoTypeMemory
+}
+
+func (m *memoryTestModel) GetSearchFields() []string {
+	return []string{"name", "items"}
+}
+
+func newMemoryTestUser() User {
+	user := User{}
+	user.ID = utils.NewID()
+	return user
+}
+
+func newMemoryTestRepo(t *testing.T, database string, collection string, isGlobal bool) Repository {
+	t.Helper()
+	repo, err := NewRepository("", RepoTypeMemory, database, collection, isGlobal)
+	if err != nil {
+		t.Fatalf("NewRepository(): %v", err)
+	}
+	t.Cleanup(func() {
+		repo.DeleteDatabase("", repo.GetDataBase())
+	})
+	return repo
+}
+
+func seedMemoryTestModels(t *testing.T, repo Repository, user User) []*memoryTestModel {
+	t.Helper()
+	models := []*memoryTestModel{
+		{Name: "Almendro", Amount: 10, Items: []string{"a", "b"}, Groups: [][]string{{"x", "y"}}},
+		{Name: "Olivo", Amount: 20, Items: []string{"b", "c"}, Groups: [][]string{{"x", "z"}}},
+		{Name: "Viña", Amount: 30, Items: []string{}},
+	}
+	models[0].Label(LabelDraft)
+	models[1].Label(LabelCompleted)
+	models[2].ExternalID = "ext-3"
+
+	for _, model := range models {
+		response := repo.Update(RepoRequest{Model: model, User: user})
+		if response.Error != nil {
+			t.Fatalf("Update(): %v", response.Error)
+		}
+	}
+	return models
+}
+
+func TestMemoryRepositoryFindEvaluatesFilterOperators(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_filters", "memory_test", false)
+	models := seedMemoryTestModels(t, repo, user)
+
+	tests := []struct {
+		name  string
+		build func(findOptions *FindOptions)
+		want  int64
+	}{
+		{"equals", func(f *FindOptions) { f.AddEquals("name", "Olivo") }, 1},
+		{"equals in array", func(f *FindOptions) { f.AddEquals("items", "b") }, 2},
+		{"equals ci", func(f *FindOptions) { f.AddEqualsCI("name", "olivo") }, 1},
+		{"not equals", func(f *FindOptions) { f.AddNotEquals("name", "Olivo") }, 2},
+		{"in", func(f *FindOptions) { f.AddIn("_id", []interface{}{models[0].ID, models[2].ID}) }, 2},
+		{"not in", func(f *FindOptions) { f.AddComplex("items", FilterOperatorNotIn, []string{"a"}) }, 2},
+		{"size", func(f *FindOptions) { f.AddComplex("items", FilterOperatorSize, 0) }, 1},
+		{"greater", func(f *FindOptions) { f.AddGreat("amount", 10) }, 2},
+		{"less", func(f *FindOptions) { f.AddLess("amount", 30) }, 2},
+		{"range", func(f *FindOptions) { f.AddRange("amount", 15, "amount", 30) }, 2},
+		{"all", func(f *FindOptions) { f.AddAll("items", []string{"b", "c"}) }, 1},
+		{"contains", func(f *FindOptions) { f.AddComplex("name", FilterOperatorContains, "IV") }, 1},
+		{"groups of arrays", func(f *FindOptions) { f.AddComplex("groups", FilterOperatorGroupsOfArrays, []string{"x", "y", "w"}) }, 1},
+		{"not nil", func(f *FindOptions) { f.AddNotNil("external_id") }, 1},
+		{"nil", func(f *FindOptions) { f.AddNil("external_id") }, 2},
+		{"labels", func(f *FindOptions) { f.AddIn("labels", []Label{LabelDraft, LabelCompleted}) }, 2},
+		{"filters or", func(f *FindOptions) {
+			f.AddMultiple(FilterOr{{Key: "name", Operator: FilterOperatorEquals, Value: "Viña"}, {Key: "amount", Operator: FilterOperatorEquals, Value: 10}})
+		}, 2},
+		{"search terms per field", func(f *FindOptions) {
+			f.AddSearchTerms([]string{"name", "items"}, []string{"li", "a"}, FilterOperatorContains)
+		}, 1},
+		{"filter tree", func(f *FindOptions) {
+			f.AddTree(NewOrFilter(
+				NewAndFilter(NewFilterNode("amount", FilterOperatorGreatOrEqual, 20), NewNotFilter(NewFilterNode("name", FilterOperatorEquals, "Viña"))),
+				NewFilterNode("name", FilterOperatorEquals, "Almendro"),
+			))
+		}, 2},
+		{"filter tree from json", func(f *FindOptions) {
+			raw := `{"group":"not","nodes":[{"group":"or","nodes":[{"filter":{"key":"amount","operator":"less","value":15}},{"filter":{"key":"items","operator":"size","value":0}}]}]}`
+			if err := json.Unmarshal([]byte(raw), &f.Tree); err != nil {
+				t.Fatalf("json.Unmarshal(): %v", err)
+			}
+		}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			findOptions := NewFindOptions()
+			tt.build(findOptions)
+
+			response := repo.Find(RepoRequest{Model: &memoryTestModel{}, FindOptions: *findOptions, List: []*memoryTestModel{}})
+			if response.Error != nil {
+				t.Fatalf("Find(): %v", response.Error)
+			}
+			if response.TotalRows != tt.want {
+				t.Fatalf("TotalRows = %d, want %d", response.TotalRows, tt.want)
+			}
+			if got := len(response.List.([]*memoryTestModel)); int64(got) != tt.want {
+				t.Fatalf("len(List) = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryRepositoryUpdateFieldByFilterTree(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_tree_writes", "memory_test", false)
+	seedMemoryTestModels(t, repo, user)
+
+	findOptions := NewFindOptions()
+	findOptions.AddTree(NewOrFilter(NewFilterNode("name", FilterOperatorEquals, "Olivo"), NewFilterNode("amount", FilterOperatorLess, 15)))
+	response := repo.UpdateField(RepoRequest{FindOptions: *findOptions, User: user}, "amount", 50)
+	if response.Error != nil || response.TotalRows != 2 {
+		t.Fatalf("UpdateField() = %+v, want 2 rows", response)
+	}
+
+	// a tree without filters is still no filter
+	response = repo.UpdateField(RepoRequest{FindOptions: FindOptions{Tree: &FilterNode{}}, User: user}, "amount", 0)
+	if response.Error == nil {
+		t.Fatalf("UpdateField() with an empty tree should fail")
+	}
+
+	findOptions = NewFindOptions()
+	findOptions.AddEquals("amount", 50)
+	if total := repo.Count(RepoRequest{Model: &memoryTestModel{}, FindOptions: *findOptions}).TotalRows; total != 2 {
+		t.Fatalf("Count() = %d, want 2", total)
+	}
+}
+
+func TestMemoryRepositoryFindOrdersAndPages(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_pages", "memory_test", false)
+	seedMemoryTestModels(t, repo, user)
+
+	findOptions := NewFindOptions()
+	findOptions.AddOrderDesc("amount")
+
+	response := repo.Find(RepoRequest{Model: &memoryTestModel{}, FindOptions: *findOptions, List: []*memoryTestModel{}, PageSize: 2, CurrentPage: 2})
+	if response.Error != nil {
+		t.Fatalf("Find(): %v", response.Error)
+	}
+	if response.TotalRows != 3 {
+		t.Fatalf("TotalRows = %d, want 3", response.TotalRows)
+	}
+
+	list := response.List.([]*memoryTestModel)
+	if len(list) != 1 || list[0].Name != "Almendro" {
+		t.Fatalf("page 2 = %+v, want only Almendro", list)
+	}
+}
+
+func TestMemoryRepositoryArrayHelpers(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_arrays", "memory_test", false)
+	models := seedMemoryTestModels(t, repo, user)
+
+	request := RepoRequest{ID: models[0].GetIDStr(), User: user}
+
+	repo.AddItemInArray(request, "items", "a")
+	repo.AddItemInArray(request, "items", "d")
+	if response := repo.SwitchItemInArray(request, "items", "b"); response.TotalRows != 2 {
+		t.Fatalf("SwitchItemInArray() TotalRows = %d, want 2", response.TotalRows)
+	}
+	repo.RemoveItemInArray(request, "items", "a")
+
+	model := &memoryTestModel{}
+	model.ID = models[0].ID
+	response := repo.FindOne(RepoRequest{Model: model})
+	if response.Error != nil {
+		t.Fatalf("FindOne(): %v", response.Error)
+	}
+	if !utils.SameArray(model.Items, []string{"d"}) {
+		t.Fatalf("items = %v, want [d]", model.Items)
+	}
+}
+
+func TestMemoryRepositoryUserUpdateRejectsDuplicatedUsername(t *testing.T) {
+	t.Setenv("DEFAULT_DATABASE", "memory_test_global")
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "", "users", true)
+
+	first := NewUser("agronomist")
+	first.Password = "secret"
+	request, err := NewBaseRequest(first, repo, user)
+	if err != nil {
+		t.Fatalf("NewBaseRequest(): %v", err)
+	}
+	if response := first.Update(request); response.Error != nil {
+		t.Fatalf("Update(): %v", response.Error)
+	}
+
+	second := NewUser("agronomist")
+	second.Password = "secret"
+	request, err = NewBaseRequest(second, repo, user)
+	if err != nil {
+		t.Fatalf("NewBaseRequest(): %v", err)
+	}
+	response := second.Update(request)
+	if response.Error == nil || response.Error.Error() != "User.Update: user already exists" {
+		t.Fatalf("Update() error = %v, want user already exists", response.Error)
+	}
+}
+
+func TestMemoryRepositoryDictionaryFindOrCreate(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_domain", "config", false)
+
+	created := &DictionaryRepo{DictionaryType: DictionaryTypeImpact}
+	request, err := NewBaseRequest(created, repo, user)
+	if err != nil {
+		t.Fatalf("NewBaseRequest(): %v", err)
+	}
+	if response := created.FindOrCreate(request); response.Error != nil {
+		t.Fatalf("FindOrCreate(): %v", response.Error)
+	}
+
+	found := &DictionaryRepo{DictionaryType: DictionaryTypeImpact}
+	request, err = NewBaseRequest(found, repo, user)
+	if err != nil {
+		t.Fatalf("NewBaseRequest(): %v", err)
+	}
+	if response := found.FindOrCreate(request); response.Error != nil {
+		t.Fatalf("FindOrCreate(): %v", response.Error)
+	}
+
+	if !utils.HaveSameIDs(created.ID, found.ID) {
+		t.Fatalf("found ID = %v, want %v", found.ID, created.ID)
+	}
+}
+
+func TestMemoryRepositoryFindHonorsCancelledContext(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_context", "memory_test", false)
+	seedMemoryTestModels(t, repo, user)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	response := repo.Find(RepoRequest{Model: &memoryTestModel{}, List: []*memoryTestModel{}, Context: ctx})
+	if !errors.Is(response.Error, context.Canceled) {
+		t.Fatalf("Find() error = %v, want context.Canceled", response.Error)
+	}
+}
+
+func TestMemoryRepositoryUnitOfWorkRollsBack(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_uow", "memory_test", false)
+	models := seedMemoryTestModels(t, repo, user)
+
+	request, err := NewBaseRequest(&memoryTestModel{}, repo, user)
+	if err != nil {
+		t.Fatalf("NewBaseRequest(): %v", err)
+	}
+	unitOfWork, err := NewUnitOfWork(request)
+	if err != nil {
+		t.Fatalf("NewUnitOfWork(): %v", err)
+	}
+
+	failure := errors.New("rollback")
+	err = unitOfWork.Run(func(uow *UnitOfWork) error {
+		models[0].Amount = 99
+		modelRequest, err := uow.Request(models[0])
+		if err != nil {
+			return err
+		}
+		if response := models[0].BaseUpdate(*modelRequest); response.Error != nil {
+			return response.Error
+		}
+
+		dictionary := &DictionaryRepo{DictionaryType: DictionaryTypeImpact}
+		dictionaryRequest, err := uow.Request(dictionary)
+		if err != nil {
+			return err
+		}
+		if response := dictionary.FindOrCreate(dictionaryRequest); response.Error != nil {
+			return response.Error
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("Run() error = %v, want %v", err, failure)
+	}
+
+	model := &memoryTestModel{}
+	model.ID = models[0].ID
+	if response := repo.FindOne(RepoRequest{Model: model}); response.Error != nil || model.Amount != 10 {
+		t.Fatalf("FindOne() amount = %d, error = %v, want 10", model.Amount, response.Error)
+	}
+
+	configRepo := newMemoryTestRepo(t, "memory_test_uow", "config", false)
+	if response := configRepo.Count(RepoRequest{Model: &DictionaryRepo{}}); response.TotalRows != 0 {
+		t.Fatalf("config Count() = %d, want 0", response.TotalRows)
+	}
+}
+
+func TestMemoryRepositoryUpdateDetectsVersionConflict(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_version", "memory_test", false)
+	models := seedMemoryTestModels(t, repo, user)
+	if models[0].Version != 1 {
+		t.Fatalf("Version = %d, want 1", models[0].Version)
+	}
+
+	stale := &memoryTestModel{}
+	stale.ID = models[0].ID
+	if response := repo.FindOne(RepoRequest{Model: stale}); response.Error != nil {
+		t.Fatalf("FindOne(): %v", response.Error)
+	}
+
+	models[0].Amount = 11
+	if response := repo.Update(RepoRequest{Model: models[0], User: user, CheckVersion: true}); response.Error != nil {
+		t.Fatalf("Update(): %v", response.Error)
+	}
+
+	stale.Amount = 12
+	response := repo.Update(RepoRequest{Model: stale, User: user, CheckVersion: true})
+	if !IsConflictError(response.Error) {
+		t.Fatalf("Update() error = %v, want ConflictError", response.Error)
+	}
+	if stale.Version != 1 {
+		t.Fatalf("stale Version = %d, want 1", stale.Version)
+	}
+	if code := NewBaseResponseFromRepoResponse(response).Code; code != 409 {
+		t.Fatalf("Code = %d, want 409", code)
+	}
+}
+
+func TestMemoryRepositoryFindPagesByCursor(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_cursor", "memory_test", false)
+	seedMemoryTestModels(t, repo, user)
+	extra := &memoryTestModel{Name: "Olivo", Amount: 40}
+	if response := repo.Update(RepoRequest{Model: extra, User: user}); response.Error != nil {
+		t.Fatalf("Update(): %v", response.Error)
+	}
+
+	findOptions := NewFindOptions()
+	findOptions.AddOrderDesc("name")
+
+	names := []string{}
+	cursors := []string{}
+	cursor := ""
+	for page := 0; page < 3; page++ {
+		response := repo.Find(RepoRequest{Model: &memoryTestModel{}, FindOptions: *findOptions, List: []*memoryTestModel{}, PageSize: 3, CursorPaging: true, Cursor: cursor, SkipCount: page > 0})
+		if response.Error != nil {
+			t.Fatalf("Find(): %v", response.Error)
+		}
+		if page == 0 && response.TotalRows != 4 {
+			t.Fatalf("TotalRows = %d, want 4", response.TotalRows)
+		}
+		for _, model := range response.List.([]*memoryTestModel) {
+			names = append(names, model.Name)
+		}
+		cursor = response.NextCursor
+		if cursor == "" {
+			break
+		}
+		cursors = append(cursors, cursor)
+	}
+
+	if got := strings.Join(names, ","); got != "Viña,Olivo,Olivo,Almendro" || len(cursors) != 1 {
+		t.Fatalf("names = %s with %d cursors, want Viña,Olivo,Olivo,Almendro with 1", got, len(cursors))
+	}
+
+	findOptions.AddOrderAsc("amount")
+	response := repo.Find(RepoRequest{Model: &memoryTestModel{}, FindOptions: *findOptions, List: []*memoryTestModel{}, PageSize: 3, CursorPaging: true, Cursor: cursors[0]})
+	if response.Error == nil {
+		t.Fatalf("Find() with a cursor of another order should fail")
+	}
+}
+
+func TestMemoryRepositoryFindPagesByCursorOnStoredFields(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_cursor_stored", "memory_test", false)
+	models := seedMemoryTestModels(t, repo, user)
+
+	// rank is stored but is not a field of the model
+	for i, model := range models {
+		findOptions := NewFindOptions()
+		findOptions.AddEquals("_id", model.ID)
+		if response := repo.UpdateField(RepoRequest{FindOptions: *findOptions, User: user}, "rank", len(models)-i); response.Error != nil {
+			t.Fatalf("UpdateField(): %v", response.Error)
+		}
+	}
+
+	findOptions := NewFindOptions()
+	findOptions.AddOrderAsc("rank")
+
+	names := []string{}
+	cursor := ""
+	for page := 0; page < len(models)+1; page++ {
+		response := repo.Find(RepoRequest{Model: &memoryTestModel{}, FindOptions: *findOptions, List: []*memoryTestModel{}, PageSize: 1, CursorPaging: true, Cursor: cursor, SkipCount: true})
+		if response.Error != nil {
+			t.Fatalf("Find(): %v", response.Error)
+		}
+		for _, model := range response.List.([]*memoryTestModel) {
+			names = append(names, model.Name)
+		}
+		cursor = response.NextCursor
+		if cursor == "" {
+			break
+		}
+	}
+
+	if got := strings.Join(names, ","); got != "Viña,Olivo,Almendro" {
+		t.Fatalf("names = %s, want Viña,Olivo,Almendro", got)
+	}
+}
+
+func TestMemoryRepositoryFindStreamStopsEarly(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_stream", "memory_test", false)
+	seedMemoryTestModels(t, repo, user)
+
+	findOptions := NewFindOptions()
+	findOptions.AddOrderAsc("amount")
+
+	names := []string{}
+	response := repo.FindStream(RepoRequest{Model: &memoryTestModel{}, FindOptions: *findOptions, List: []*memoryTestModel{}}, func(item interface{}) error {
+		names = append(names, item.(*memoryTestModel).Name)
+		if len(names) == 2 {
+			return ErrStopStream
+		}
+		return nil
+	})
+	if response.Error != nil {
+		t.Fatalf("FindStream(): %v", response.Error)
+	}
+	if got := strings.Join(names, ","); got != "Almendro,Olivo" || response.TotalRows != 2 {
+		t.Fatalf("names = %s, TotalRows = %d, want Almendro,Olivo and 2", got, response.TotalRows)
+	}
+
+	failure := errors.New("failure")
+	response = repo.FindStream(RepoRequest{Model: &memoryTestModel{}, List: []*memoryTestModel{}}, func(item interface{}) error {
+		return failure
+	})
+	if !errors.Is(response.Error, failure) || response.TotalRows != 1 {
+		t.Fatalf("FindStream() error = %v, TotalRows = %d, want failure and 1", response.Error, response.TotalRows)
+	}
+}
+
+func TestMemoryRepositoryBulkWrite(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_bulk", "memory_test", false)
+	models := seedMemoryTestModels(t, repo, user)
+
+	synced := &memoryTestModel{Name: "Nogal"}
+	synced.ExternalID = "ext-nogal"
+	duplicated := &memoryTestModel{Name: "Duplicated"}
+	duplicated.ID = models[1].ID
+
+	list := NewBulkList()
+	list.NewList = append(list.NewList, &memoryTestModel{Name: "Pistacho"}, duplicated)
+	list.UpdateList = append(list.UpdateList, synced, &memoryTestModel{Name: "Orphan"})
+	list.DeleteList = append(list.DeleteList, models[0])
+
+	response := repo.BulkWrite(RepoRequest{User: user}, *list)
+	if response.Error != nil {
+		t.Fatalf("BulkWrite(): %v", response.Error)
+	}
+	if response.TotalRows != 3 || len(response.Errors) != 2 {
+		t.Fatalf("TotalRows = %d, Errors = %v, want 3 and 2 errors", response.TotalRows, response.Errors)
+	}
+	results := response.List.([]BulkResult)
+	if len(results) != 5 || !results[2].Upserted || results[2].ID == "" || synced.GetIDStr() != results[2].ID {
+		t.Fatalf("results = %+v, want the upsert of ext-nogal inserted with the ID of the model", results)
+	}
+
+	synced.ID = nil
+	synced.Amount = 5
+	response = repo.BulkWrite(RepoRequest{User: user}, BulkList{UpdateList: []interface{}{synced}})
+	if response.TotalRows != 1 || response.List.([]BulkResult)[0].Upserted {
+		t.Fatalf("second upsert = %+v, want an update", response)
+	}
+
+	stored := &memoryTestModel{}
+	findOptions := NewFindOptions()
+	findOptions.AddEquals("external_id", "ext-nogal")
+	if response := repo.Find(RepoRequest{Model: stored, FindOptions: *findOptions, List: []*memoryTestModel{}}); response.TotalRows != 1 {
+		t.Fatalf("Find() TotalRows = %d, want 1", response.TotalRows)
+	} else if found := response.List.([]*memoryTestModel)[0]; found.Amount != 5 || found.Version != 2 || found.CreatedBy == nil {
+		t.Fatalf("stored = %+v, want amount 5, version 2 and created_by", found)
+	}
+
+	if response := repo.Count(RepoRequest{Model: &memoryTestModel{}}); response.TotalRows != 4 {
+		t.Fatalf("Count() = %d, want 4", response.TotalRows)
+	}
+
+	ordered := BulkList{NewList: []interface{}{duplicated, &memoryTestModel{Name: "Never"}}, Ordered: true}
+	response = repo.BulkWrite(RepoRequest{User: user}, ordered)
+	if len(response.List.([]BulkResult)) != 1 || len(response.Errors) != 1 {
+		t.Fatalf("ordered BulkWrite() = %+v, want to stop at the first error", response)
+	}
+}
+
+func TestMemoryRepositoryCreateManyKeepsModels(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_create_many", "memory_test", false)
+
+	imported := &memoryTestModel{Name: "Olivo"}
+	imported.ID = utils.NewID()
+	imported.Version = 3
+	imported.CreatedBy = user.GetUserLog()
+	imported.UpdatedBy = user.GetUserLog()
+	hooked := &memoryHookModel{}
+
+	if err := repo.(*MemoryRepository).CreateMany(&memoryTestModel{}, []interface{}{imported, &memoryTestModel{Name: "Almendro"}, hooked}); err != nil {
+		t.Fatalf("CreateMany(): %v", err)
+	}
+	if hooked.Slug != "" || hooked.Version != 0 || hooked.CreatedBy == nil || hooked.ID == nil {
+		t.Fatalf("hooked = %+v, want no hooks, no version and an ID with created_by", hooked)
+	}
+
+	findOptions := NewFindOptions()
+	findOptions.AddOrderDesc("name")
+	response := repo.Find(RepoRequest{Model: &memoryTestModel{}, FindOptions: *findOptions, List: []*memoryTestModel{}})
+	if response.Error != nil || response.TotalRows != 3 {
+		t.Fatalf("Find() = %+v, want 3 rows", response)
+	}
+	stored := response.List.([]*memoryTestModel)[0]
+	if stored.Version != 3 || stored.CreatedBy == nil || stored.UpdatedBy == nil || stored.UpdatedBy.User != user.GetIDStr() || stored.CreatedBy.User != user.GetIDStr() {
+		t.Fatalf("stored = %+v, want the version and user logs it was imported with", stored)
+	}
+}
+
+func TestMemoryRepositoryEnsureIndexesEnforcesUnique(t *testing.T) {
+	t.Setenv("DEFAULT_DATABASE", "memory_test_indexes")
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_domain_indexes", "memory_test", false)
+
+	response := EnsureIndexes(repo, &User{}, &memoryTestModel{})
+	if response.Error != nil || len(response.Errors) > 0 || response.TotalRows != 1 {
+		t.Fatalf("EnsureIndexes() = %+v, want 1 index created", response)
+	}
+	if response := EnsureIndexes(repo, &User{}); response.TotalRows != 0 {
+		t.Fatalf("EnsureIndexes() again created %d indexes, want 0", response.TotalRows)
+	}
+
+	usersRepo, err := CloneRepository(repo, &User{})
+	if err != nil {
+		t.Fatalf("CloneRepository(): %v", err)
+	}
+	t.Cleanup(func() { usersRepo.DeleteDatabase("", usersRepo.GetDataBase()) })
+
+	first := NewUser("agronomist")
+	first.Password = "secret"
+	if response := usersRepo.Update(RepoRequest{Model: first, User: user}); response.Error != nil {
+		t.Fatalf("Update(): %v", response.Error)
+	}
+
+	// skips the check of User.Update, as a concurrent writer would
+	second := NewUser("agronomist")
+	second.Password = "secret"
+	response = usersRepo.Update(RepoRequest{Model: second, User: user})
+	if !IsDuplicateKeyError(response.Error) {
+		t.Fatalf("Update() error = %v, want a duplicate key error", response.Error)
+	}
+
+	// a changed definition is reported and the unique index is kept
+	changed := NewIndex(IndexKey{Field: "username", Type: IndexKeyAsc})
+	if response := usersRepo.EnsureIndexes(RepoRequest{}, []Index{changed}); len(response.Errors) != 1 || response.TotalRows != 0 {
+		t.Fatalf("EnsureIndexes() of a changed index = %+v, want 1 error", response)
+	}
+	third := NewUser("agronomist")
+	third.Password = "secret"
+	if response := usersRepo.Update(RepoRequest{Model: third, User: user}); !IsDuplicateKeyError(response.Error) {
+		t.Fatalf("Update() error = %v, want a duplicate key error", response.Error)
+	}
+}
+
+func TestMemoryRepositorySoftDeleteAndRestore(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_soft_delete", "memory_test", false)
+	models := seedMemoryTestModels(t, repo, user)
+
+	findOptions := NewFindOptions()
+	findOptions.AddEquals("_id", models[0].ID)
+	if response := repo.DeleteSoft(RepoRequest{FindOptions: *findOptions, User: user}); response.TotalRows != 1 {
+		t.Fatalf("DeleteSoft() = %d, want 1", response.TotalRows)
+	}
+
+	if response := repo.Count(RepoRequest{Model: &memoryTestModel{}}); response.TotalRows != 2 {
+		t.Fatalf("Count() = %d, want 2", response.TotalRows)
+	}
+	if response := repo.Count(RepoRequest{Model: &memoryTestModel{}, IncludeDeleted: true}); response.TotalRows != 3 {
+		t.Fatalf("Count() with deleted = %d, want 3", response.TotalRows)
+	}
+
+	deleted := &memoryTestModel{}
+	deleted.ID = models[0].ID
+	if response := repo.FindOne(RepoRequest{Model: deleted}); response.Error == nil {
+		t.Fatalf("FindOne() of a soft deleted model should fail")
+	}
+
+	trash := NewFindOptions()
+	trash.AddNotNil("deleted_by")
+	if response := repo.Count(RepoRequest{Model: &memoryTestModel{}, FindOptions: *trash}); response.TotalRows != 1 {
+		t.Fatalf("Count() of deleted = %d, want 1", response.TotalRows)
+	}
+
+	if response := repo.Restore(RepoRequest{FindOptions: *findOptions, User: user}); response.TotalRows != 1 {
+		t.Fatalf("Restore() = %d, want 1", response.TotalRows)
+	}
+	if response := repo.FindOne(RepoRequest{Model: deleted}); response.Error != nil || deleted.DeletedBy != nil {
+		t.Fatalf("FindOne() after Restore() = %v, deleted_by = %v", response.Error, deleted.DeletedBy)
+	}
+}
+
+func TestMemoryRepositorySearchTerms(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_search", "memory_test", false)
+	seedMemoryTestModels(t, repo, user)
+
+	search := func(mode SearchMode, terms ...string) []*memoryTestModel {
+		t.Helper()
+		request, err := NewBaseRequest(&memoryTestModel{}, repo, user)
+		if err != nil {
+			t.Fatalf("NewBaseRequest(): %v", err)
+		}
+		request.SearchTerms = terms
+		request.SearchMode = mode
+		repoRequest := request.GetRepoRequest()
+		repoRequest.List = []*memoryTestModel{}
+
+		response := repo.Find(repoRequest)
+		if response.Error != nil {
+			t.Fatalf("Find(%v): %v", terms, response.Error)
+		}
+		return response.List.([]*memoryTestModel)
+	}
+
+	if list := search(SearchModeRegex, "VINA"); len(list) != 1 || list[0].Name != "Viña" {
+		t.Fatalf("search of VINA = %v, want Viña", list)
+	}
+	if list := search(SearchModeRegex, "olivo b"); len(list) != 1 || list[0].Name != "Olivo" {
+		t.Fatalf("search of olivo b = %v, want Olivo", list)
+	}
+
+	list := search(SearchModeText, "olivo b")
+	if len(list) != 2 || list[0].Name != "Olivo" || list[1].Name != "Almendro" {
+		t.Fatalf("text search of olivo b = %v, want Olivo and Almendro", list)
+	}
+}
+
+func TestMemoryRepositoryFindAppliesProjection(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_projection", "memory_test", false)
+	models := seedMemoryTestModels(t, repo, user)
+
+	findOptions := NewFindOptions()
+	findOptions.AddOrderAsc("amount")
+	findOptions.IncludeFields("name")
+	response := repo.Find(RepoRequest{Model: &memoryTestModel{}, FindOptions: *findOptions, List: []*memoryTestModel{}})
+	if response.Error != nil {
+		t.Fatalf("Find(): %v", response.Error)
+	}
+	list := response.List.([]*memoryTestModel)
+	if len(list) != 3 || list[0].Name != "Almendro" || list[0].ID == nil || list[0].Amount != 0 || list[0].Items != nil {
+		t.Fatalf("Find() with included name = %+v", list[0])
+	}
+
+	excluded := &memoryTestModel{}
+	excluded.ID = models[1].ID
+	findOptions = NewFindOptions()
+	findOptions.ExcludeFields("items", "amount")
+	response = repo.FindOne(RepoRequest{Model: excluded, FindOptions: *findOptions})
+	if response.Error != nil || excluded.Name != "Olivo" || excluded.Amount != 0 || excluded.Items != nil {
+		t.Fatalf("FindOne() with excluded items = %v, %+v", response.Error, excluded)
+	}
+
+	findOptions.IncludeFields("name")
+	if response := repo.Find(RepoRequest{Model: &memoryTestModel{}, FindOptions: *findOptions, List: []*memoryTestModel{}}); response.Error == nil {
+		t.Fatalf("Find() including and excluding fields should fail")
+	}
+}
+
+func TestMemoryRepositoryFindOptionsRoundTripJSON(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_filter_values", "memory_test", false)
+	models := seedMemoryTestModels(t, repo, user)
+	models[2].Notes = "2024-01-01"
+	if response := repo.Update(RepoRequest{Model: models[2], User: user}); response.Error != nil {
+		t.Fatalf("Update(): %v", response.Error)
+	}
+
+	findOptions := NewFindOptions()
+	findOptions.AddIn("_id", []*primitive.ObjectID{models[1].ID, models[2].ID})
+	findOptions.AddEquals("notes", "2024-01-01")
+	findOptions.AddGreat("amount", 15)
+
+	raw, err := json.Marshal(findOptions)
+	if err != nil {
+		t.Fatalf("json.Marshal(): %v", err)
+	}
+	decoded := FindOptions{}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal(): %v", err)
+	}
+
+	response := repo.Find(RepoRequest{Model: &memoryTestModel{}, FindOptions: decoded, List: []*memoryTestModel{}})
+	if response.Error != nil {
+		t.Fatalf("Find(): %v", response.Error)
+	}
+	if list := response.List.([]*memoryTestModel); len(list) != 1 || list[0].Name != "Viña" {
+		t.Fatalf("Find() after JSON = %d rows, want Viña", len(list))
+	}
+
+	invalid := NewFindOptions()
+	invalid.Filters = append(invalid.Filters, Filter{Key: "_id", Operator: FilterOperatorEquals, Value: "not-an-id", Type: FilterValueObjectID})
+	if response := repo.Find(RepoRequest{Model: &memoryTestModel{}, FindOptions: *invalid, List: []*memoryTestModel{}}); response.Error == nil {
+		t.Fatalf("Find() with an invalid ObjectID should fail")
+	}
+}
+
+func TestMemoryRepositoryAggregatesPipeline(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_pipeline", "memory_test", false)
+	seedMemoryTestModels(t, repo, user)
+
+	aggregate := func(pipeline interface{}) []bson.M {
+		t.Helper()
+		response := repo.Aggregate(RepoRequest{Model: &memoryTestModel{}, Pipeline: pipeline, List: []bson.M{}})
+		if response.Error != nil {
+			t.Fatalf("Aggregate(): %v", response.Error)
+		}
+		return response.List.([]bson.M)
+	}
+
+	findOptions := NewFindOptions()
+	findOptions.AddGreatOrEqual("amount", 10)
+	totals := aggregate(NewPipeline().Match(*findOptions).Group(nil,
+		GroupCount("count"), GroupSum("sum", "amount"), GroupAvg("avg", "amount"), GroupMin("min", "amount"), GroupMax("max", "amount"),
+	))
+	if len(totals) != 1 {
+		t.Fatalf("Group() totals = %v", totals)
+	}
+	for field, want := range map[string]float64{"count": 3, "sum": 60, "avg": 20, "min": 10, "max": 30} {
+		if got, _ := asMemoryNumber(totals[0][field]); got != want {
+			t.Fatalf("Group() %s = %v, want %v", field, totals[0][field], want)
+		}
+	}
+
+	items := NewPipeline().Unwind("items", false).Group([]string{"items"}, GroupCount("count")).Sort(Order{Field: "_id.items", Direction: 1})
+	faceted := aggregate(NewPipeline().Facet(map[string]*Pipeline{
+		"items": items,
+		"total": NewPipeline().Group(nil, GroupCount("count")),
+	}))
+	if len(faceted) != 1 {
+		t.Fatalf("Facet() = %v", faceted)
+	}
+	facet := faceted[0]["items"].(bson.A)
+	if len(facet) != 3 {
+		t.Fatalf("Facet() items = %v", facet)
+	}
+	if count, _ := asMemoryNumber(facet[1].(bson.M)["count"]); count != 2 {
+		t.Fatalf("Facet() items b = %v, want 2", facet[1])
+	}
+
+	grouped := NewFindOptions()
+	grouped.AddGroupBy("labels")
+	if rows := aggregate(NewPipeline().Match(*grouped)); len(rows) != 3 {
+		t.Fatalf("Match() with group by = %v", rows)
+	}
+	// group_by selects nothing, so it is no filter for the writes
+	if response := repo.UpdateMany(RepoRequest{Model: &memoryTestModel{}, FindOptions: *grouped, User: user}, map[string]interface{}{"amount": 0}); response.Error == nil {
+		t.Fatalf("UpdateMany() with only group by should fail")
+	}
+	if total := repo.Count(RepoRequest{Model: &memoryTestModel{}, FindOptions: FindOptions{Filters: []Filter{NewFilter("amount", FilterOperatorEquals, 0)}}}).TotalRows; total != 0 {
+		t.Fatalf("Count() of amount 0 = %d, want 0", total)
+	}
+
+	joined := aggregate(NewPipeline().Lookup("memory_test", "name", "name", "same").Limit(1))
+	if len(joined) != 1 || len(joined[0]["same"].(bson.A)) != 1 {
+		t.Fatalf("Lookup() = %v", joined)
+	}
+
+	if response := repo.Aggregate(RepoRequest{Model: &memoryTestModel{}, Pipeline: "not a pipeline"}); response.Error == nil {
+		t.Fatalf("Aggregate() of an invalid pipeline should fail")
+	}
+}
+
+func TestMemoryRepositoryWatch(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_watch", "memory_test", false)
+
+	// the resume tokens are global, kept in the same database
+	t.Setenv("DEFAULT_DATABASE", "memory_test_watch")
+	store, err := NewRepoResumeTokenStore(repo, user)
+	if err != nil {
+		t.Fatalf("NewRepoResumeTokenStore(): %v", err)
+	}
+	watch := WatchOptions{Name: "watch-" + utils.NewID().Hex(), Store: store}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan ChangeEvent, 10)
+	done := make(chan RepoResponse, 1)
+	started := make(chan struct{})
+	go func() {
+		findOptions := NewFindOptions()
+		findOptions.AddGreatOrEqual("amount", 10)
+		close(started)
+		done <- repo.Watch(RepoRequest{Context: ctx, FindOptions: *findOptions, List: []*memoryTestModel{}}, watch, func(event ChangeEvent) error {
+			events <- event
+			if event.Operation == ChangeOperationDelete {
+				return ErrStopStream
+			}
+			return nil
+		})
+	}()
+	<-started
+
+	// the watch has to be listening before the writes
+	for !memoryWatching(t, repo) {
+		runtime.Gosched()
+	}
+
+	model := &memoryTestModel{Name: "Almendro", Amount: 10}
+	if response := repo.Update(RepoRequest{Model: model, User: user}); response.Error != nil {
+		t.Fatalf("Update(): %v", response.Error)
+	}
+	ignored := &memoryTestModel{Name: "Olivo", Amount: 1}
+	if response := repo.Update(RepoRequest{Model: ignored, User: user}); response.Error != nil {
+		t.Fatalf("Update(): %v", response.Error)
+	}
+	model.Amount = 15
+	if response := repo.Update(RepoRequest{Model: model, User: user}); response.Error != nil {
+		t.Fatalf("Update(): %v", response.Error)
+	}
+	if response := repo.Delete(RepoRequest{Model: model, User: user}); response.Error != nil {
+		t.Fatalf("Delete(): %v", response.Error)
+	}
+
+	response := <-done
+	if response.Error != nil || response.TotalRows != 3 {
+		t.Fatalf("Watch() = %+v", response)
+	}
+
+	inserted, updated := <-events, <-events
+	if inserted.Operation != ChangeOperationInsert || inserted.ID != model.ID.Hex() || inserted.Document.(*memoryTestModel).Name != "Almendro" {
+		t.Fatalf("insert event = %+v", inserted)
+	}
+	if updated.Operation != ChangeOperationUpdate || updated.UpdatedFields["amount"] == nil || updated.Document.(*memoryTestModel).Amount != 15 {
+		t.Fatalf("update event = %+v", updated)
+	}
+	deleted := <-events
+	if deleted.Operation != ChangeOperationDelete || deleted.Document != nil {
+		t.Fatalf("delete event = %+v", deleted)
+	}
+
+	token, err := store.GetResumeToken(watch.Name)
+	if err != nil || token != deleted.ResumeToken {
+		t.Fatalf("GetResumeToken() = %q, %v, want %q", token, err, deleted.ResumeToken)
+	}
+
+	// resumes after the stored token
+	if response := repo.Update(RepoRequest{Model: &memoryTestModel{Name: "Viña", Amount: 30}, User: user}); response.Error != nil {
+		t.Fatalf("Update(): %v", response.Error)
+	}
+	response = repo.Watch(RepoRequest{Context: ctx, List: []*memoryTestModel{}}, watch, func(event ChangeEvent) error {
+		if event.Operation != ChangeOperationInsert || event.Document.(*memoryTestModel).Name != "Viña" {
+			t.Fatalf("resumed event = %+v", event)
+		}
+		return ErrStopStream
+	})
+	if response.Error != nil || response.TotalRows != 1 {
+		t.Fatalf("resumed Watch() = %+v", response)
+	}
+}
+
+func memoryWatching(t *testing.T, repo Repository) bool {
+	t.Helper()
+	key, err := repo.(*MemoryRepository).collectionKey("memory_test")
+	if err != nil {
+		t.Fatalf("collectionKey(): %v", err)
+	}
+	memoryDataBases.mu.RLock()
+	defer memoryDataBases.mu.RUnlock()
+	return memoryDataBases.watched[key]
+}
+
+func TestMemoryRepositoryUpdateWithoutIDFails(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_update_without_id", "memory_test", false)
+
+	// not new, so it is not inserted again
+	model := &memoryTestModel{Name: "Almendro"}
+	model.CreatedBy = user.GetUserLog()
+	if response := repo.Update(RepoRequest{Model: model, User: user}); response.Error == nil {
+		t.Fatalf("Update() of a model without ID should fail")
+	}
+	if total := repo.Count(RepoRequest{Model: &memoryTestModel{}}).TotalRows; total != 0 {
+		t.Fatalf("Count() = %d, want 0", total)
+	}
+}
+
+func TestMemoryRepositoryRecordLocks(t *testing.T) {
+	alice := newMemoryTestUser()
+	bob := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_record_locks", "memory_test", false)
+
+	model := &memoryTestModel{Name: "Parcela 7", Amount: 10}
+	if response := repo.Update(RepoRequest{Model: model, User: alice}); response.Error != nil {
+		t.Fatalf("Update() error = %v", response.Error)
+	}
+
+	response := Lock(repo, RepoRequest{Model: model, User: alice}, time.Minute)
+	if response.Error != nil {
+		t.Fatalf("Lock() error = %v", response.Error)
+	}
+	if lock, ok := response.List.(*UserLog); !ok || lock.User != alice.GetIDStr() {
+		t.Fatalf("Lock() List = %#v, want the lock of alice", response.List)
+	}
+
+	// a second editor can neither lock nor write it
+	if response := Lock(repo, RepoRequest{Model: model, User: bob}, time.Minute); !IsRecordLockedError(response.Error) {
+		t.Fatalf("Lock() by bob error = %v, want RecordLockedError", response.Error)
+	}
+	stale := &memoryTestModel{Name: "Parcela 7", Amount: 20}
+	stale.ID = model.ID
+	stale.CreatedBy = model.CreatedBy
+	response = repo.Update(RepoRequest{Model: stale, User: bob})
+	var locked *RecordLockedError
+	if !errors.As(response.Error, &locked) {
+		t.Fatalf("Update() by bob error = %v, want RecordLockedError", response.Error)
+	}
+	if locked.User != alice.GetIDStr() || !strings.Contains(locked.Error(), "locked by "+alice.GetIDStr()) {
+		t.Fatalf("RecordLockedError = %v, want locked by alice", locked)
+	}
+	if code := ErrorStatusCode(NewBaseResponseFromError(response.Error).Error); code != 423 {
+		t.Fatalf("ErrorStatusCode() = %d, want 423", code)
+	}
+
+	// the holder writes, and its Update keeps the lock
+	model.Amount = 15
+	if response := repo.Update(RepoRequest{Model: model, User: alice}); response.Error != nil {
+		t.Fatalf("Update() by alice error = %v", response.Error)
+	}
+	if response := RefreshLock(repo, RepoRequest{Model: model, User: alice}, time.Minute); response.Error != nil {
+		t.Fatalf("RefreshLock() error = %v", response.Error)
+	}
+	if response := RefreshLock(repo, RepoRequest{Model: model, User: bob}, time.Minute); !IsRecordLockedError(response.Error) {
+		t.Fatalf("RefreshLock() by bob error = %v, want RecordLockedError", response.Error)
+	}
+	if response := Unlock(repo, RepoRequest{Model: model, User: bob}); !IsRecordLockedError(response.Error) {
+		t.Fatalf("Unlock() by bob error = %v, want RecordLockedError", response.Error)
+	}
+
+	if response := Unlock(repo, RepoRequest{Model: model, User: alice}); response.Error != nil {
+		t.Fatalf("Unlock() error = %v", response.Error)
+	}
+	if response := repo.Update(RepoRequest{Model: stale, User: bob}); response.Error != nil {
+		t.Fatalf("Update() by bob after Unlock() error = %v", response.Error)
+	}
+
+	// an expired lock does not block
+	if response := Lock(repo, RepoRequest{Model: model, User: alice}, time.Millisecond); response.Error != nil {
+		t.Fatalf("Lock() error = %v", response.Error)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if response := RefreshLock(repo, RepoRequest{Model: model, User: alice}, time.Minute); response.Error == nil {
+		t.Fatalf("RefreshLock() of an expired lock should fail")
+	}
+	if response := Lock(repo, RepoRequest{Model: model, User: bob}, time.Minute); response.Error != nil {
+		t.Fatalf("Lock() over an expired lock error = %v", response.Error)
+	}
+
+	if response := ForceUnlock(repo, RepoRequest{Model: model, User: alice}); response.Error != nil {
+		t.Fatalf("ForceUnlock() error = %v", response.Error)
+	}
+	model.Amount = 40
+	if response := repo.Update(RepoRequest{Model: model, User: alice}); response.Error != nil {
+		t.Fatalf("Update() after ForceUnlock() error = %v", response.Error)
+	}
+
+	found := &memoryTestModel{}
+	found.ID = model.ID
+	if response := repo.FindOne(RepoRequest{Model: found}); response.Error != nil {
+		t.Fatalf("FindOne() error = %v", response.Error)
+	}
+	if found.Amount != 40 || found.LockedBy != nil {
+		t.Fatalf("FindOne() = amount %d, lock %#v, want 40 and no lock", found.Amount, found.LockedBy)
+	}
+}
+
+type memoryGeoModel struct {
+	BaseModel `bson:",inline"`
+	Name      string    `json:"name" bson:"name"`
+	Location  *Geometry `json:"location,omitempty" bson:"location,omitempty"`
+}
+
+func (m *memoryGeoModel) GetCollection() (name string, isGlobal bool) {
+	return "memory_geo", false
+}
+
+func (m *memoryGeoModel) GetRepoType() RepoType {
+	return RepoTypeMemory
+}
+
+func TestMemoryRepositoryGeoFilters(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_geo", "memory_geo", false)
+
+	plot := NewPolygon([][]float64{{-1.10, 37.90}, {-1.09, 37.90}, {-1.09, 37.91}, {-1.10, 37.91}})
+	stations := []*memoryGeoModel{}
+	for _, station := range []struct {
+		name      string
+		longitude float64
+		latitude  float64
+	}{
+		{"Lejana", -1.20, 38.00},
+		{"Dentro", -1.095, 37.905},
+		{"Cercana", -1.08, 37.90},
+	} {
+		location := NewPoint(station.longitude, station.latitude)
+		model := &memoryGeoModel{Name: station.name, Location: &location}
+		if response := repo.Update(RepoRequest{Model: model, User: user}); response.Error != nil {
+			t.Fatalf("Update() error = %v", response.Error)
+		}
+		stations = append(stations, model)
+	}
+
+	names := func(findOptions *FindOptions) []string {
+		t.Helper()
+		response := repo.Find(RepoRequest{Model: &memoryGeoModel{}, FindOptions: *findOptions, List: []*memoryGeoModel{}})
+		if response.Error != nil {
+			t.Fatalf("Find() error = %v", response.Error)
+		}
+		list := response.List.([]*memoryGeoModel)
+		result := []string{}
+		for _, model := range list {
+			result = append(result, model.Name)
+		}
+		return result
+	}
+
+	within := NewFindOptions()
+	within.AddComplex("location", FilterOperatorGeoWithin, plot)
+	if got := names(within); len(got) != 1 || got[0] != "Dentro" {
+		t.Fatalf("Find() within the plot = %v, want [Dentro]", got)
+	}
+
+	intersects := NewFindOptions()
+	intersects.AddComplex("location", FilterOperatorGeoIntersects, plot)
+	if got := names(intersects); len(got) != 1 || got[0] != "Dentro" {
+		t.Fatalf("Find() intersecting the plot = %v, want [Dentro]", got)
+	}
+
+	// nearest weather station to the plot
+	centroid, err := plot.Centroid()
+	if err != nil {
+		t.Fatalf("Centroid() error = %v", err)
+	}
+	near := NewFindOptions()
+	near.AddComplex("location", FilterOperatorNear, GeoNear{Point: centroid, MaxDistance: 2000})
+	if got := names(near); len(got) != 2 || got[0] != "Dentro" || got[1] != "Cercana" {
+		t.Fatalf("Find() near the plot = %v, want [Dentro Cercana]", got)
+	}
+
+	found := &memoryGeoModel{}
+	found.ID = stations[0].ID
+	if response := repo.FindOne(RepoRequest{Model: found}); response.Error != nil {
+		t.Fatalf("FindOne() error = %v", response.Error)
+	}
+	if found.Location == nil || found.Location.Type != GeometryPoint {
+		t.Fatalf("FindOne() location = %#v, want a Point", found.Location)
+	}
+	if err := found.Location.Validate(); err != nil {
+		t.Fatalf("Validate() of a read location error = %v", err)
+	}
+}
+
+func TestMemoryRepositoryDistinctAndFacets(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_facets", "memory_test", false)
+	models := seedMemoryTestModels(t, repo, user)
+
+	models[0].Tags = &Tags{*NewTag("crop", "almond"), *NewTag("irrigation", "drip")}
+	models[1].Tags = &Tags{*NewTag("crop", "olive"), *NewTag("irrigation", "drip")}
+	models[2].Label(LabelDraft)
+	for _, model := range models {
+		if response := repo.Update(RepoRequest{Model: model, User: user}); response.Error != nil {
+			t.Fatalf("Update() error = %v", response.Error)
+		}
+	}
+	deleted := &memoryTestModel{Name: "Borrado", Amount: 10}
+	repo.Update(RepoRequest{Model: deleted, User: user})
+	deletedOptions := NewFindOptions()
+	deletedOptions.AddEquals("_id", deleted.ID)
+	if response := repo.DeleteSoft(RepoRequest{FindOptions: *deletedOptions, User: user}); response.TotalRows != 1 {
+		t.Fatalf("DeleteSoft() = %d, want 1", response.TotalRows)
+	}
+
+	// the items of an array are values one by one
+	response := repo.Distinct(RepoRequest{Model: &memoryTestModel{}}, "items")
+	if response.Error != nil {
+		t.Fatalf("Distinct() error = %v", response.Error)
+	}
+	if values := response.List.([]interface{}); len(values) != 3 || values[0] != "a" || values[2] != "c" {
+		t.Fatalf("Distinct(items) = %v, want [a b c]", values)
+	}
+
+	findOptions := NewFindOptions()
+	findOptions.AddComplex("amount", FilterOperatorGreatOrEqual, 20)
+	response = repo.Distinct(RepoRequest{Model: &memoryTestModel{}, FindOptions: *findOptions}, "amount")
+	if values := response.List.([]interface{}); len(values) != 2 {
+		t.Fatalf("Distinct(amount) with a filter = %v, want [20 30]", values)
+	}
+
+	response = repo.CountFacets(RepoRequest{Model: &memoryTestModel{}}, FacetOptions{Labels: true, Tags: true, Fields: []string{"amount", "tags.key"}})
+	if response.Error != nil {
+		t.Fatalf("CountFacets() error = %v", response.Error)
+	}
+	facets := response.List.(Facets)
+	if facets.Total != 3 || response.TotalRows != 3 {
+		t.Fatalf("CountFacets() total = %d, want 3 without the deleted one", facets.Total)
+	}
+	if len(facets.Labels) != 2 || facets.Labels[0] != (FacetCount{Value: string(LabelDraft), Count: 2}) {
+		t.Fatalf("CountFacets() labels = %v, want draft (2) first", facets.Labels)
+	}
+	if len(facets.Tags) != 3 || facets.Tags[0] != (TagFacetCount{Key: "irrigation", Value: "drip", Count: 2}) {
+		t.Fatalf("CountFacets() tags = %v, want irrigation=drip (2) first", facets.Tags)
+	}
+	if amounts := facets.Fields["amount"]; len(amounts) != 3 || amounts[0].Count != 1 {
+		t.Fatalf("CountFacets() amount = %v, want 3 values once", amounts)
+	}
+	if keys := facets.Fields["tags.key"]; len(keys) != 2 || keys[0] != (FacetCount{Value: "crop", Count: 2}) {
+		t.Fatalf("CountFacets() tags.key = %v, want crop (2) first", keys)
+	}
+}
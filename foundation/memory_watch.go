@@ -0,0 +1,248 @@
+package foundation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/weitecit/pkg/log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Changes kept per watched collection to resume a Watch
+const memoryChangeLogSize = 1000
+
+// memoryChange is a change of a watched collection, its sequence is the
+// resume token
+type memoryChange struct {
+	sequence  int64
+	operation ChangeOperation
+	id        interface{}
+	document  bson.M
+	updated   bson.M
+	removed   []string
+	time      time.Time
+}
+
+func memoryIDKey(id interface{}) string {
+	if objectID, ok := id.(primitive.ObjectID); ok {
+		return objectID.Hex()
+	}
+	return fmt.Sprint(id)
+}
+
+// recordMemoryChanges logs the differences between the documents of a watched
+// collection before and after a write. It runs under the store lock.
+func recordMemoryChanges(key string, before []bson.M, after []bson.M) {
+	if !memoryDataBases.watched[key] {
+		return
+	}
+
+	previous := map[string]bson.M{}
+	for _, document := range before {
+		previous[memoryIDKey(document["_id"])] = document
+	}
+
+	changes := []memoryChange{}
+	for _, document := range after {
+		id := memoryIDKey(document["_id"])
+		old, found := previous[id]
+		delete(previous, id)
+
+		if !found {
+			changes = append(changes, memoryChange{operation: ChangeOperationInsert, id: document["_id"], document: document})
+			continue
+		}
+
+		change := memoryChange{operation: ChangeOperationUpdate, id: document["_id"], document: document, updated: bson.M{}}
+		for field, value := range document {
+			if current, ok := old[field]; !ok || !memoryValuesEqual(current, value) {
+				change.updated[field] = value
+			}
+		}
+		for field := range old {
+			if _, ok := document[field]; !ok {
+				change.removed = append(change.removed, field)
+			}
+		}
+		if len(change.updated) > 0 || len(change.removed) > 0 {
+			changes = append(changes, change)
+		}
+	}
+
+	for _, document := range before {
+		if _, deleted := previous[memoryIDKey(document["_id"])]; deleted {
+			changes = append(changes, memoryChange{operation: ChangeOperationDelete, id: document["_id"]})
+		}
+	}
+
+	if len(changes) == 0 {
+		return
+	}
+
+	now := time.Now()
+	changeLog := memoryDataBases.changes[key]
+	for _, change := range changes {
+		memoryDataBases.sequence++
+		change.sequence = memoryDataBases.sequence
+		change.time = now
+		changeLog = append(changeLog, change)
+	}
+	if len(changeLog) > memoryChangeLogSize {
+		changeLog = changeLog[len(changeLog)-memoryChangeLogSize:]
+	}
+	memoryDataBases.changes[key] = changeLog
+
+	// wakes up the watchers
+	close(memoryDataBases.changed)
+	memoryDataBases.changed = make(chan struct{})
+}
+
+// Watch delivers the changes of the collection written after it starts, or
+// after the resume token, see MongoRepository.Watch
+func (m *MemoryRepository) Watch(request RepoRequest, watch WatchOptions, fn WatchFunc) RepoResponse {
+	if fn == nil {
+		err := errors.New("MemoryRepository.Watch: fn can not be nil")
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	ctx := request.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	key, err := m.collectionKey(m.Collection)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	filter, err := m.GetFilter(request.FindOptions)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	match, err := watchFilter(filter, "fullDocument", watch.getOperations())
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+	match, err = m.normalizeFilter(match)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	token, err := watch.getResumeToken()
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	memoryDataBases.mu.Lock()
+	memoryDataBases.watched[key] = true
+	last := memoryDataBases.sequence
+	if token != "" {
+		last, err = strconv.ParseInt(token, 10, 64)
+		changes := memoryDataBases.changes[key]
+		if err == nil && len(changes) > 0 && changes[0].sequence > last+1 {
+			err = errors.New("resume token is too old")
+		}
+	}
+	memoryDataBases.mu.Unlock()
+	if err != nil {
+		err = errors.New("MemoryRepository.Watch: invalid resume token: " + err.Error())
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	decoder := newStreamDecoder(request.List)
+	total := int64(0)
+
+	for {
+		memoryDataBases.mu.RLock()
+		pending := []memoryChange{}
+		for _, change := range memoryDataBases.changes[key] {
+			if change.sequence > last {
+				pending = append(pending, change)
+			}
+		}
+		changed := memoryDataBases.changed
+		memoryDataBases.mu.RUnlock()
+
+		for _, change := range pending {
+			last = change.sequence
+
+			event, ok, err := m.changeEvent(change, match, decoder)
+			if err != nil {
+				log.Err(err)
+				return RepoResponse{TotalRows: total, Error: err}
+			}
+			if !ok {
+				continue
+			}
+
+			total++
+			stop, err := watch.deliver(event, fn)
+			if err != nil {
+				log.Err(err)
+				return RepoResponse{TotalRows: total, Error: err}
+			}
+			if stop {
+				return RepoResponse{TotalRows: total}
+			}
+		}
+
+		if len(pending) > 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return RepoResponse{TotalRows: total}
+		case <-changed:
+		}
+	}
+}
+
+// changeEvent returns the event of a change, and whether it matches the
+// filter of the Watch
+func (m *MemoryRepository) changeEvent(change memoryChange, match bson.M, decoder streamDecoder) (ChangeEvent, bool, error) {
+	event := ChangeEvent{
+		Operation:     change.operation,
+		Collection:    m.Collection,
+		ID:            memoryIDKey(change.id),
+		UpdatedFields: change.updated,
+		RemovedFields: change.removed,
+		ResumeToken:   strconv.FormatInt(change.sequence, 10),
+		Time:          change.time,
+	}
+
+	changeDocument := bson.M{"operationType": string(change.operation)}
+	if change.document != nil {
+		changeDocument["fullDocument"] = change.document
+	}
+	matched, err := matchMemoryDocument(changeDocument, match)
+	if err != nil || !matched {
+		return event, false, err
+	}
+
+	if change.document != nil {
+		raw, err := bson.Marshal(change.document)
+		if err != nil {
+			return event, false, err
+		}
+		event.Document, err = decoder.decode(raw)
+		if err != nil {
+			return event, false, err
+		}
+	}
+
+	return event, true, nil
+}
@@ -0,0 +1,355 @@
+package foundation
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MigrationFunc reshapes the data of the database of repo. Models are reached
+// with CloneRepository(repo, model).
+type MigrationFunc func(repo Repository, request RepoRequest) error
+
+// Migration is a change of the data of the repo databases. Migrations run in
+// the order of their ID, so IDs should sort, e.g. "2024_05_01_drop_origin_repo_id".
+type Migration struct {
+	ID          string
+	Description string
+	Up          MigrationFunc
+}
+
+var (
+	migrationsMu sync.Mutex
+	migrations   = map[string]Migration{}
+)
+
+// RegisterMigration adds a migration to the ones RunMigrations applies
+func RegisterMigration(migration Migration) error {
+	if migration.ID == "" {
+		return errors.New("RegisterMigration: ID can not be empty")
+	}
+	if migration.Up == nil {
+		return errors.New("RegisterMigration: " + migration.ID + " has no Up")
+	}
+
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+
+	if _, ok := migrations[migration.ID]; ok {
+		return errors.New("RegisterMigration: " + migration.ID + " is already registered")
+	}
+	migrations[migration.ID] = migration
+	return nil
+}
+
+// getMigrations returns the registered migrations sorted by ID
+func getMigrations() []Migration {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+
+	list := []Migration{}
+	for _, migration := range migrations {
+		list = append(list, migration)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// MigrationRecord is an applied migration, kept in the migrations collection
+// of each repo database
+type MigrationRecord struct {
+	BaseModel   `bson:",inline"`
+	MigrationID string        `json:"migration_id" bson:"migration_id"`
+	Description string        `json:"description,omitempty" bson:"description,omitempty"`
+	AppliedAt   time.Time     `json:"applied_at" bson:"applied_at"`
+	Duration    time.Duration `json:"duration" bson:"duration"`
+}
+
+func (m *MigrationRecord) GetCollection() (name string, isGlobal bool) {
+	return "migrations", false
+}
+
+func (m *MigrationRecord) GetRepoType() RepoType {
+	return RepoTypeMongoDB
+}
+
+func (m *MigrationRecord) GetIndexes() []Index {
+	return []Index{
+		{Keys: []IndexKey{{Field: "migration_id", Type: IndexKeyAsc}}, Unique: true},
+	}
+}
+
+// Name of the lock of the migrations
+const migrationLockName = "migrations"
+
+// MigrationLock keeps two instances from migrating the same database at once.
+// The unique name makes only one of them insert it.
+type MigrationLock struct {
+	BaseModel `bson:",inline"`
+	Name      string    `json:"name" bson:"name"`
+	Owner     string    `json:"owner" bson:"owner"`
+	ExpiresAt time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+func (m *MigrationLock) GetCollection() (name string, isGlobal bool) {
+	return "migration_locks", false
+}
+
+func (m *MigrationLock) GetRepoType() RepoType {
+	return RepoTypeMongoDB
+}
+
+func (m *MigrationLock) GetIndexes() []Index {
+	return []Index{
+		{Keys: []IndexKey{{Field: "name", Type: IndexKeyAsc}}, Unique: true},
+	}
+}
+
+// MigrationLockedError is returned by RunMigrations when another instance is
+// migrating the database
+type MigrationLockedError struct {
+	DataBase  string
+	Owner     string
+	ExpiresAt time.Time
+}
+
+func (m *MigrationLockedError) Error() string {
+	return fmt.Sprintf("RunMigrations: %s is being migrated by %s until %s", m.DataBase, m.Owner, m.ExpiresAt.Format(time.RFC3339))
+}
+
+func IsMigrationLockedError(err error) bool {
+	var locked *MigrationLockedError
+	return errors.As(err, &locked)
+}
+
+type MigrationOptions struct {
+	// Identifies the instance in the lock, hostname and pid by default
+	Owner string
+	// The lock expires after it, so a crashed instance does not block the
+	// others. It is extended before each migration. 30 minutes by default.
+	LockTTL time.Duration
+}
+
+func (m MigrationOptions) getOwner() string {
+	if m.Owner != "" {
+		return m.Owner
+	}
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+func (m MigrationOptions) getLockTTL() time.Duration {
+	if m.LockTTL <= 0 {
+		return 30 * time.Minute
+	}
+	return m.LockTTL
+}
+
+// migrator applies the migrations to the database of repo
+type migrator struct {
+	repo    Repository
+	records Repository
+	locks   Repository
+	request RepoRequest
+	owner   string
+	ttl     time.Duration
+}
+
+func newMigrator(repo Repository, request RepoRequest, options MigrationOptions) (*migrator, error) {
+	records, err := CloneRepository(repo, &MigrationRecord{})
+	if err != nil {
+		return nil, err
+	}
+	locks, err := CloneRepository(repo, &MigrationLock{})
+	if err != nil {
+		return nil, err
+	}
+
+	response := EnsureIndexes(repo, &MigrationRecord{}, &MigrationLock{})
+	if response.Error != nil {
+		return nil, response.Error
+	}
+	if len(response.Errors) > 0 {
+		return nil, response.Errors[0]
+	}
+
+	return &migrator{
+		repo:    repo,
+		records: records,
+		locks:   locks,
+		request: request,
+		owner:   options.getOwner(),
+		ttl:     options.getLockTTL(),
+	}, nil
+}
+
+func (m *migrator) lockFilter() *FindOptions {
+	findOptions := NewFindOptions()
+	findOptions.AddEquals("name", migrationLockName)
+	findOptions.AddEquals("owner", m.owner)
+	return findOptions
+}
+
+// lock inserts the lock, removing it first if it expired
+func (m *migrator) lock() error {
+	expired := NewFindOptions()
+	expired.AddEquals("name", migrationLockName)
+	expired.AddLess("expires_at", time.Now())
+	response := m.locks.Delete(RepoRequest{Model: &MigrationLock{}, FindOptions: *expired, User: m.request.User, Context: m.request.Context})
+	if response.Error != nil {
+		return response.Error
+	}
+
+	lock := &MigrationLock{Name: migrationLockName, Owner: m.owner, ExpiresAt: time.Now().Add(m.ttl)}
+	response = m.locks.Update(RepoRequest{Model: lock, User: m.request.User, Context: m.request.Context})
+	if response.Error == nil {
+		return nil
+	}
+	if !IsDuplicateKeyError(response.Error) {
+		return response.Error
+	}
+
+	findOptions := NewFindOptions()
+	findOptions.AddEquals("name", migrationLockName)
+	found := m.locks.Find(RepoRequest{Model: &MigrationLock{}, FindOptions: *findOptions, List: []*MigrationLock{}, Context: m.request.Context})
+	locked := &MigrationLockedError{DataBase: m.repo.GetDataBase()}
+	if list, ok := found.List.([]*MigrationLock); ok && len(list) > 0 {
+		locked.Owner = list[0].Owner
+		locked.ExpiresAt = list[0].ExpiresAt
+	}
+	return locked
+}
+
+// extend renews the lock, failing if it is no longer ours
+func (m *migrator) extend() error {
+	values := map[string]interface{}{"expires_at": time.Now().Add(m.ttl)}
+	response := m.locks.UpdateMany(RepoRequest{Model: &MigrationLock{}, FindOptions: *m.lockFilter(), User: m.request.User, Context: m.request.Context}, values)
+	if response.Error != nil {
+		return response.Error
+	}
+
+	// an unchanged expires_at is not counted as modified, so it is read back
+	response = m.locks.Count(RepoRequest{Model: &MigrationLock{}, FindOptions: *m.lockFilter(), Context: m.request.Context})
+	if response.Error != nil {
+		return response.Error
+	}
+	if response.TotalRows == 0 {
+		return errors.New("RunMigrations: " + m.repo.GetDataBase() + " lock was lost")
+	}
+	return nil
+}
+
+func (m *migrator) unlock() error {
+	response := m.locks.Delete(RepoRequest{Model: &MigrationLock{}, FindOptions: *m.lockFilter(), User: m.request.User, Context: m.request.Context})
+	return response.Error
+}
+
+func (m *migrator) applied() (map[string]bool, error) {
+	response := m.records.Find(RepoRequest{Model: &MigrationRecord{}, List: []*MigrationRecord{}, Context: m.request.Context})
+	if response.Error != nil {
+		return nil, response.Error
+	}
+
+	applied := map[string]bool{}
+	list, _ := response.List.([]*MigrationRecord)
+	for _, record := range list {
+		applied[record.MigrationID] = true
+	}
+	return applied, nil
+}
+
+func (m *migrator) run(migration Migration) error {
+	err := m.extend()
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err = migration.Up(m.repo, m.request)
+	if err != nil {
+		return errors.New("RunMigrations: " + m.repo.GetDataBase() + ": " + migration.ID + ": " + err.Error())
+	}
+
+	record := &MigrationRecord{
+		MigrationID: migration.ID,
+		Description: migration.Description,
+		AppliedAt:   start,
+		Duration:    time.Since(start),
+	}
+	return m.records.Update(RepoRequest{Model: record, User: m.request.User, Context: m.request.Context}).Error
+}
+
+// RunMigrations applies to the database of repo the registered migrations it
+// has not applied yet, in the order of their ID, and stops at the first one
+// that fails. RepoResponse.List has the IDs of the applied ones. Only one
+// instance migrates a database at a time, the others get a
+// MigrationLockedError.
+func RunMigrations(repo Repository, request RepoRequest, options MigrationOptions) RepoResponse {
+	if repo == nil {
+		return RepoResponse{Error: errors.New("RunMigrations: repository is nil")}
+	}
+
+	migrator, err := newMigrator(repo, request, options)
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	err = migrator.lock()
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
+	defer migrator.unlock()
+
+	applied, err := migrator.applied()
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	done := []string{}
+	for _, migration := range getMigrations() {
+		if applied[migration.ID] {
+			continue
+		}
+		err = migrator.run(migration)
+		if err != nil {
+			return RepoResponse{TotalRows: int64(len(done)), List: done, Error: err}
+		}
+		done = append(done, migration.ID)
+	}
+
+	return RepoResponse{TotalRows: int64(len(done)), List: done}
+}
+
+// RunMigrationsForRepos runs the migrations in the database of each repoID,
+// with the connection and type of repo. Errors of a database do not stop the
+// others and are returned in RepoResponse.Errors.
+func RunMigrationsForRepos(repo Repository, request RepoRequest, options MigrationOptions, repoIDs ...string) RepoResponse {
+	response := RepoResponse{}
+
+	if repo == nil {
+		response.Error = errors.New("RunMigrationsForRepos: repository is nil")
+		return response
+	}
+
+	for _, repoID := range repoIDs {
+		repoIDRepo, err := NewRepository(repo.GetConnection(), repo.GetType(), repoID, "migrations", false)
+		if err != nil {
+			response.Errors = append(response.Errors, err)
+			continue
+		}
+		repoIDRepo.SetTimeout(repo.GetTimeout())
+
+		result := RunMigrations(repoIDRepo, request, options)
+		if result.Error != nil {
+			response.Errors = append(response.Errors, result.Error)
+		}
+		response.TotalRows += result.TotalRows
+	}
+
+	return response
+}
@@ -0,0 +1,87 @@
+package foundation
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryRepositoryMigrations(t *testing.T) {
+	user := newMemoryTestUser()
+	repo := newMemoryTestRepo(t, "memory_test_migrations", "memory_test", false)
+	seedMemoryTestModels(t, repo, user)
+
+	calls := 0
+	double := Migration{
+		ID:          "memory_test_001_double_amount",
+		Description: "Doubles the amounts",
+		Up: func(repo Repository, request RepoRequest) error {
+			calls++
+			models, err := CloneRepository(repo, &memoryTestModel{})
+			if err != nil {
+				return err
+			}
+			findOptions := NewFindOptions()
+			findOptions.AddEquals("name", "Almendro")
+			return models.UpdateMany(RepoRequest{Model: &memoryTestModel{}, FindOptions: *findOptions, User: request.User}, map[string]interface{}{"amount": 20}).Error
+		},
+	}
+	if err := RegisterMigration(double); err != nil {
+		t.Fatalf("RegisterMigration(): %v", err)
+	}
+	if err := RegisterMigration(double); err == nil {
+		t.Fatalf("RegisterMigration() of a duplicate ID should fail")
+	}
+
+	options := MigrationOptions{Owner: "test"}
+	response := RunMigrations(repo, RepoRequest{User: user}, options)
+	if response.Error != nil || response.TotalRows != 1 {
+		t.Fatalf("RunMigrations() = %+v", response)
+	}
+
+	findOptions := NewFindOptions()
+	findOptions.AddEquals("amount", 20)
+	if total := repo.Count(RepoRequest{Model: &memoryTestModel{}, FindOptions: *findOptions}).TotalRows; total != 2 {
+		t.Fatalf("documents with amount 20 = %d, want 2", total)
+	}
+
+	response = RunMigrations(repo, RepoRequest{User: user}, options)
+	if response.Error != nil || response.TotalRows != 0 || calls != 1 {
+		t.Fatalf("RunMigrations() again = %+v, calls = %d", response, calls)
+	}
+
+	locks, err := CloneRepository(repo, &MigrationLock{})
+	if err != nil {
+		t.Fatalf("CloneRepository(): %v", err)
+	}
+	lock := &MigrationLock{Name: migrationLockName, Owner: "other", ExpiresAt: time.Now().Add(time.Hour)}
+	if response := locks.Update(RepoRequest{Model: lock, User: user}); response.Error != nil {
+		t.Fatalf("Update(): %v", response.Error)
+	}
+	response = RunMigrations(repo, RepoRequest{User: user}, options)
+	if !IsMigrationLockedError(response.Error) {
+		t.Fatalf("RunMigrations() while locked = %v, want a MigrationLockedError", response.Error)
+	}
+
+	lock.ExpiresAt = time.Now().Add(-time.Minute)
+	if response := locks.Update(RepoRequest{Model: lock, User: user}); response.Error != nil {
+		t.Fatalf("Update(): %v", response.Error)
+	}
+	failing := Migration{
+		ID: "memory_test_002_fail",
+		Up: func(repo Repository, request RepoRequest) error {
+			return errors.New("failed")
+		},
+	}
+	if err := RegisterMigration(failing); err != nil {
+		t.Fatalf("RegisterMigration(): %v", err)
+	}
+	response = RunMigrations(repo, RepoRequest{User: user}, options)
+	if response.Error == nil || !strings.Contains(response.Error.Error(), failing.ID) {
+		t.Fatalf("RunMigrations() with an expired lock and a failing migration = %v", response.Error)
+	}
+	if total := locks.Count(RepoRequest{Model: &MigrationLock{}}).TotalRows; total != 0 {
+		t.Fatalf("locks after RunMigrations() = %d, want 0", total)
+	}
+}
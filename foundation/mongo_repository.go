@@ -5,7 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os/exec"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -20,8 +20,6 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var backupHistory = []string{}
-
 type MongoRepository struct {
 	Error               error
 	ConnectionString    string
@@ -32,6 +30,14 @@ type MongoRepository struct {
 	clientInstanceError error
 	mongoOnce           sync.Once
 	ctx                 context.Context
+	// Timeout applied to every operation, zero means no timeout
+	Timeout time.Duration
+	// Operations longer than it are logged as a SlowQuery, zero disables it
+	SlowQueryThreshold time.Duration
+	// Slow queries are logged with their explain, run in the background
+	ExplainSlowQueries bool
+	// Retries of the operations that fail with a transient error
+	Retry RetryPolicy
 }
 
 func (m *MongoRepository) ToJSON() string {
@@ -50,6 +56,10 @@ func NewMongoRepository(connection string, repoID string, collection string, isG
 	m.DataBase = repoID
 	m.Collection = collection
 	m.ctx = context.Background()
+	m.Timeout = time.Duration(utils.GetEnvInt("MONGO_TIMEOUT", 0)) * time.Second
+	m.SlowQueryThreshold = time.Duration(utils.GetEnvInt("MONGO_SLOW_QUERY_MS", 0)) * time.Millisecond
+	m.ExplainSlowQueries = utils.GetEnv("MONGO_SLOW_QUERY_EXPLAIN") == "true"
+	m.Retry = NewRetryPolicy()
 
 	// Si el usuario no tienen una servidor de base de datos propio o es algo global
 	// Abre la conexión de ASD
@@ -96,6 +106,87 @@ func (m *MongoRepository) GetDB() (*mongo.Database, error) {
 	return m.clientInstance.Database(m.DataBase), nil
 }
 
+// getContext derives the context of an operation from the request context,
+// or the repository one when the request has none, and applies the timeout.
+func (m *MongoRepository) getContext(request RepoRequest) (context.Context, context.CancelFunc) {
+	ctx := m.getRequestContext(request)
+
+	if m.Timeout > 0 {
+		return context.WithTimeout(ctx, m.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// getRequestContext returns the context of request, without the repository
+// Timeout
+func (m *MongoRepository) getRequestContext(request RepoRequest) context.Context {
+	if request.Context != nil {
+		return request.Context
+	}
+	if m.ctx != nil {
+		return m.ctx
+	}
+	return context.Background()
+}
+
+// Transaction runs fn in a session transaction. The context passed to fn
+// carries the session, so every operation whose RepoRequest uses it joins
+// the transaction. If ctx already carries a session fn joins that one.
+func (m *MongoRepository) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+
+	if ctx == nil {
+		ctx = m.ctx
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if mongo.SessionFromContext(ctx) != nil {
+		return fn(ctx)
+	}
+
+	_, err := m.GetDB()
+	if err != nil {
+		return err
+	}
+
+	session, err := m.clientInstance.StartSession()
+	if err != nil {
+		err = errors.New("MongoRepository.Transaction: " + err.Error())
+		log.Err(err)
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessionContext mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessionContext)
+	})
+
+	return err
+}
+
+// IsTransactionNotSupportedError tells whether err comes from a transaction on
+// a standalone server, which does not support them
+func IsTransactionNotSupportedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var serverError mongo.ServerError
+	if errors.As(err, &serverError) && serverError.HasErrorCode(20) {
+		return true
+	}
+	// errors of the models may only keep the message
+	return strings.Contains(err.Error(), "Transaction numbers are only allowed on a replica set member or mongos")
+}
+
+func (m *MongoRepository) SetTimeout(timeout time.Duration) {
+	m.Timeout = timeout
+}
+
+func (m *MongoRepository) GetTimeout() time.Duration {
+	return m.Timeout
+}
+
 func (m *MongoRepository) GetMongoClient() {
 	//Perform connection creation operation only once.
 
@@ -141,6 +232,11 @@ func (m *MongoRepository) GetMongoClient() {
 }
 
 func (m *MongoRepository) Update(request RepoRequest) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+	profile := m.profile("Update")
+	defer profile.done()
+
 	response := &RepoResponse{}
 
 	if request.Model == nil {
@@ -148,38 +244,104 @@ func (m *MongoRepository) Update(request RepoRequest) RepoResponse {
 		return *response
 	}
 
+	if err := beforeSave(request); err != nil {
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	version, versionable := increaseVersion(request.Model)
 	request.Model.SetUpdated(request.User)
 	if request.Model.IsNew() {
 		return m.create(request)
 	}
 
+	// a failed update is not retried as an insert, it could duplicate the
+	// document
 	collection, err := m.GetCollection()
 	if err != nil {
+		restoreVersion(request.Model, version)
 		log.Err(err)
-		return m.create(request)
+		return RepoResponse{Error: err}
 	}
 
-	isNew := request.Model.IsNew()
-
 	id, err := request.Model.GetID()
-	if err != nil || isNew {
+	if err != nil {
+		restoreVersion(request.Model, version)
+		err = errors.New("MongoRepository.Update: " + err.Error())
 		log.Err(err)
-		return m.create(request)
+		return RepoResponse{Error: err}
 	}
 
-	result, err := collection.UpdateOne(m.ctx, bson.M{"_id": id}, bson.M{"$set": request.Model})
+	before, err := m.readHistory(ctx, collection, request, bson.M{"_id": id})
 	if err != nil {
+		restoreVersion(request.Model, version)
 		log.Err(err)
-		return m.create(request)
+		return RepoResponse{Error: err}
+	}
+
+	// the document is not written while another user holds its lock
+	now := time.Now()
+	filter := bson.M{"_id": id, "$or": unlockedFilter(request.User.GetIDStr(), now)}
+	checkVersion := versionable && request.CheckVersion
+	if checkVersion {
+		filter["version"] = versionFilter(version)
+	}
+
+	values, err := updateDocument(request.Model)
+	if err != nil {
+		restoreVersion(request.Model, version)
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	profile.find(collection, filter, nil)
+	result, err := m.retrying(collection, "Update", true).UpdateOne(ctx, filter, bson.M{"$set": values})
+	if err != nil {
+		restoreVersion(request.Model, version)
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	if result.MatchedCount == 0 {
+		stored := bson.M{}
+		err := m.retrying(collection, "Update", true).FindOne(ctx, bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"locked_by": 1})).Decode(&stored)
+		if err != nil && err != mongo.ErrNoDocuments {
+			restoreVersion(request.Model, version)
+			log.Err(err)
+			return RepoResponse{Error: err}
+		}
+		if err == nil {
+			if lock := documentLock(stored); lockedFor(lock, request.User.GetIDStr(), now) {
+				restoreVersion(request.Model, version)
+				err := NewRecordLockedError(collection.Name(), id, lock)
+				log.Trace(err)
+				return RepoResponse{Error: err}
+			}
+			if checkVersion {
+				restoreVersion(request.Model, version)
+				err := NewConflictError(collection.Name(), id, version)
+				log.Trace(err)
+				return RepoResponse{Error: err}
+			}
+		}
 	}
 
 	response.TotalRows = result.ModifiedCount
 	response.List = []interface{}{request.Model}
 
+	err = m.writeHistory(ctx, collection, request, HistoryOperationUpdate, before, bson.A{id})
+	if err != nil {
+		response.Errors = []error{err}
+	}
+
 	return *response
 }
 
 func (m *MongoRepository) UpdateMany(request RepoRequest, values map[string]interface{}) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+	profile := m.profile("UpdateMany")
+	defer profile.done()
 
 	collection, err := m.GetCollection()
 	if err != nil {
@@ -196,6 +358,11 @@ func (m *MongoRepository) UpdateMany(request RepoRequest, values map[string]inte
 		return RepoResponse{Error: err}
 	}
 
+	if err := beforeUpdateMany(request, values); err != nil {
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
 	values["updated_by"] = request.User.GetUserLog()
 
 	getFilter, err := m.GetFilter(findOptions)
@@ -204,17 +371,23 @@ func (m *MongoRepository) UpdateMany(request RepoRequest, values map[string]inte
 		return RepoResponse{Error: err}
 	}
 
-	response, err := collection.UpdateMany(m.ctx, getFilter, bson.M{"$set": values})
-	if err != nil {
-		log.Err(err)
-		return RepoResponse{TotalRows: response.ModifiedCount, Error: err}
-	}
-
-	return RepoResponse{TotalRows: response.ModifiedCount}
+	profile.find(collection, getFilter, nil)
+	return m.writeMany(ctx, collection, request, HistoryOperationUpdateMany, getFilter, func(filter interface{}) (int64, error) {
+		response, err := m.retrying(collection, "UpdateMany", true).UpdateMany(ctx, filter, bson.M{"$set": values})
+		if err != nil {
+			return 0, err
+		}
+		return response.ModifiedCount, nil
+	})
 
 }
 
 func (m *MongoRepository) AddItemInArray(request RepoRequest, field string, value string) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+	profile := m.profile("AddItemInArray")
+	defer profile.done()
+
 	id, err := utils.GetObjectIdFromString(request.ID)
 	if err != nil {
 		log.Err(err)
@@ -253,7 +426,8 @@ func (m *MongoRepository) AddItemInArray(request RepoRequest, field string, valu
 		}}},
 	}
 
-	if _, err := collection.Aggregate(context.TODO(), updatePipeline); err != nil {
+	profile.aggregate(collection, updatePipeline)
+	if _, err := m.retrying(collection, "AddItemInArray", true).Aggregate(ctx, updatePipeline); err != nil {
 		log.Err(err)
 		return RepoResponse{Error: err}
 	}
@@ -262,6 +436,11 @@ func (m *MongoRepository) AddItemInArray(request RepoRequest, field string, valu
 }
 
 func (m *MongoRepository) RemoveItemInArray(request RepoRequest, field string, value string) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+	profile := m.profile("RemoveItemInArray")
+	defer profile.done()
+
 	id, err := utils.GetObjectIdFromString(request.ID)
 	if err != nil {
 		log.Err(err)
@@ -296,7 +475,8 @@ func (m *MongoRepository) RemoveItemInArray(request RepoRequest, field string, v
 		}}},
 	}
 
-	if _, err := collection.Aggregate(context.TODO(), updatePipeline); err != nil {
+	profile.aggregate(collection, updatePipeline)
+	if _, err := m.retrying(collection, "RemoveItemInArray", true).Aggregate(ctx, updatePipeline); err != nil {
 		log.Err(err)
 		return RepoResponse{Error: err}
 	}
@@ -305,6 +485,10 @@ func (m *MongoRepository) RemoveItemInArray(request RepoRequest, field string, v
 }
 
 func (m *MongoRepository) SwitchItemInArray(request RepoRequest, field string, value string) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+	profile := m.profile("SwitchItemInArray")
+	defer profile.done()
 
 	id, err := utils.GetObjectIdFromString(request.ID)
 	if err != nil {
@@ -344,7 +528,8 @@ func (m *MongoRepository) SwitchItemInArray(request RepoRequest, field string, v
 		}}},
 	}
 
-	_, err = collection.Aggregate(context.TODO(), updatePipeline)
+	profile.aggregate(collection, updatePipeline)
+	_, err = m.retrying(collection, "SwitchItemInArray", false).Aggregate(ctx, updatePipeline)
 	if err != nil {
 		log.Err(err)
 		return RepoResponse{Error: err}
@@ -368,14 +553,14 @@ func (m *MongoRepository) SwitchItemInArray(request RepoRequest, field string, v
 		}}},
 	}
 
-	cursor, err := collection.Aggregate(context.TODO(), countPipeline)
+	cursor, err := m.retrying(collection, "SwitchItemInArray", true).Aggregate(ctx, countPipeline)
 	if err != nil {
 		log.Err(err)
 		return RepoResponse{Error: err}
 	}
-	defer cursor.Close(context.TODO())
+	defer cursor.Close(ctx)
 
-	if cursor.Next(context.TODO()) {
+	if cursor.Next(ctx) {
 		if err := cursor.Decode(&result); err != nil {
 			log.Err(err)
 			return RepoResponse{Error: err}
@@ -386,6 +571,10 @@ func (m *MongoRepository) SwitchItemInArray(request RepoRequest, field string, v
 }
 
 func (m *MongoRepository) UpdateField(request RepoRequest, field string, value interface{}) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+	profile := m.profile("UpdateField")
+	defer profile.done()
 
 	collection, err := m.GetCollection()
 	if err != nil {
@@ -406,23 +595,33 @@ func (m *MongoRepository) UpdateField(request RepoRequest, field string, value i
 		field: value,
 	}
 
-	getFilter, err := m.GetFilter(findOptions)
-	if err != nil {
-		log.Err(err)
+	if err := beforeUpdateMany(request, values); err != nil {
+		log.Trace(err)
 		return RepoResponse{Error: err}
 	}
 
-	response, err := collection.UpdateMany(m.ctx, getFilter, bson.M{"$set": values})
+	getFilter, err := m.GetFilter(findOptions)
 	if err != nil {
 		log.Err(err)
-		return RepoResponse{TotalRows: response.ModifiedCount, Error: err}
+		return RepoResponse{Error: err}
 	}
 
-	return RepoResponse{TotalRows: response.ModifiedCount}
+	profile.find(collection, getFilter, nil)
+	return m.writeMany(ctx, collection, request, HistoryOperationUpdateField, getFilter, func(filter interface{}) (int64, error) {
+		response, err := m.retrying(collection, "UpdateField", true).UpdateMany(ctx, filter, bson.M{"$set": values})
+		if err != nil {
+			return 0, err
+		}
+		return response.ModifiedCount, nil
+	})
 
 }
 
 func (m *MongoRepository) Move(request RepoRequest) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+	profile := m.profile("Move")
+	defer profile.done()
 
 	collection, err := m.GetCollection()
 	if err != nil {
@@ -451,8 +650,23 @@ func (m *MongoRepository) Move(request RepoRequest) RepoResponse {
 		return RepoResponse{Error: err}
 	}
 
+	profile.find(collection, getFilter, nil)
+	response := RepoResponse{}
+	err = m.Transaction(ctx, func(ctx context.Context) error {
+		response = m.moveDocuments(ctx, collection, getFilter, request.TargetCollection)
+		return response.Error
+	})
+	if err == nil {
+		return response
+	}
+
+	if !IsTransactionNotSupportedError(err) {
+		return RepoResponse{Error: err}
+	}
+	log.Trace(errors.New("MongoRepository.Move: transactions not supported, moving without them"))
+
 	// out aggregate
-	_, err = collection.Aggregate(context.TODO(), mongo.Pipeline{
+	_, err = m.retrying(collection, "Move", true).Aggregate(ctx, mongo.Pipeline{
 		{{Key: "$match", Value: getFilter}},
 		// {{Key: "$out", Value: request.TargetCollection}},
 		{{Key: "$merge", Value: request.TargetCollection}},
@@ -462,7 +676,7 @@ func (m *MongoRepository) Move(request RepoRequest) RepoResponse {
 		return RepoResponse{TotalRows: -1, Error: err}
 	}
 
-	result, err := collection.DeleteMany(m.ctx, getFilter)
+	result, err := m.retrying(collection, "Move", true).DeleteMany(ctx, getFilter)
 	if err != nil {
 
 		log.Err(err)
@@ -473,7 +687,56 @@ func (m *MongoRepository) Move(request RepoRequest) RepoResponse {
 
 }
 
+// moveDocuments merges the matching documents into target and deletes them
+// from collection. $merge is not allowed inside transactions, so documents
+// are upserted one by one with the same semantics.
+func (m *MongoRepository) moveDocuments(ctx context.Context, collection *mongo.Collection, filter map[string]interface{}, target string) RepoResponse {
+
+	targetCollection := collection.Database().Collection(target)
+
+	cursor, err := m.retrying(collection, "Move", true).Find(ctx, filter)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{TotalRows: -1, Error: err}
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		document := bson.M{}
+		err := cursor.Decode(&document)
+		if err != nil {
+			log.Err(err)
+			return RepoResponse{TotalRows: -1, Error: err}
+		}
+
+		id := document["_id"]
+		delete(document, "_id")
+
+		_, err = m.retrying(targetCollection, "Move", true).UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": document}, options.Update().SetUpsert(true))
+		if err != nil {
+			log.Err(err)
+			return RepoResponse{TotalRows: -1, Error: err}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		log.Err(err)
+		return RepoResponse{TotalRows: -1, Error: err}
+	}
+
+	result, err := m.retrying(collection, "Move", true).DeleteMany(ctx, filter)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	return RepoResponse{TotalRows: result.DeletedCount}
+}
+
 func (m *MongoRepository) DeleteSoft(request RepoRequest) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+	profile := m.profile("DeleteSoft")
+	defer profile.done()
 
 	collection, err := m.GetCollection()
 	if err != nil {
@@ -488,22 +751,73 @@ func (m *MongoRepository) DeleteSoft(request RepoRequest) RepoResponse {
 		"deleted_by": userLog,
 	}
 
+	if err := beforeDelete(request); err != nil {
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	getFilter, err := m.GetFilter(request.FindOptions)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	profile.find(collection, getFilter, nil)
+	return m.writeMany(ctx, collection, request, HistoryOperationDeleteSoft, getFilter, func(filter interface{}) (int64, error) {
+		response, err := m.retrying(collection, "DeleteSoft", true).UpdateMany(ctx, filter, bson.M{"$set": values})
+		if err != nil {
+			return 0, err
+		}
+		return response.ModifiedCount, nil
+	})
+}
+
+// Restore undoes DeleteSoft on the soft deleted documents matching the filter
+func (m *MongoRepository) Restore(request RepoRequest) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+	profile := m.profile("Restore")
+	defer profile.done()
+
+	collection, err := m.GetCollection()
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	if request.FindOptions.filterIsEmpty() {
+		err := errors.New("MongoRepository.Restore: " + collection.Name() + " filter can not be empty")
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
 	getFilter, err := m.GetFilter(request.FindOptions)
 	if err != nil {
 		log.Err(err)
 		return RepoResponse{Error: err}
 	}
 
-	response, err := collection.UpdateMany(m.ctx, getFilter, bson.M{"$set": values})
+	filter := bson.M{"$and": bson.A{getFilter, bson.M{"deleted_by": bson.M{"$ne": nil}}}}
+	update := bson.M{
+		"$unset": bson.M{"deleted_by": ""},
+		"$set":   bson.M{"updated_by": request.User.GetUserLog()},
+	}
+
+	profile.find(collection, filter, nil)
+	response, err := m.retrying(collection, "Restore", true).UpdateMany(ctx, filter, update)
 	if err != nil {
 		log.Err(err)
-		return RepoResponse{TotalRows: response.ModifiedCount, Error: err}
+		return RepoResponse{Error: err}
 	}
 
 	return RepoResponse{TotalRows: response.ModifiedCount}
 }
 
 func (m *MongoRepository) RemoveField(request RepoRequest, field string) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+	profile := m.profile("RemoveField")
+	defer profile.done()
 
 	collection, err := m.GetCollection()
 	if err != nil {
@@ -519,22 +833,30 @@ func (m *MongoRepository) RemoveField(request RepoRequest, field string) RepoRes
 		field:        nil,
 	}
 
-	getFilter, err := m.GetFilter(request.FindOptions)
-	if err != nil {
-		log.Err(err)
+	if err := beforeUpdateMany(request, values); err != nil {
+		log.Trace(err)
 		return RepoResponse{Error: err}
 	}
 
-	response, err := collection.UpdateMany(m.ctx, getFilter, bson.M{"$set": values})
+	getFilter, err := m.GetFilter(request.FindOptions)
 	if err != nil {
 		log.Err(err)
-		return RepoResponse{TotalRows: response.ModifiedCount, Error: err}
+		return RepoResponse{Error: err}
 	}
 
-	return RepoResponse{TotalRows: response.ModifiedCount}
+	profile.find(collection, getFilter, nil)
+	return m.writeMany(ctx, collection, request, HistoryOperationUpdateField, getFilter, func(filter interface{}) (int64, error) {
+		response, err := m.retrying(collection, "RemoveField", true).UpdateMany(ctx, filter, bson.M{"$set": values})
+		if err != nil {
+			return 0, err
+		}
+		return response.ModifiedCount, nil
+	})
 }
 
 func (m *MongoRepository) create(request RepoRequest) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
 
 	model := request.Model
 	model.SetCreated(request.User)
@@ -545,78 +867,337 @@ func (m *MongoRepository) create(request RepoRequest) RepoResponse {
 		return RepoResponse{Error: err}
 	}
 
-	_, err = collection.InsertOne(m.ctx, model)
+	_, err = m.retrying(collection, "Update", false).InsertOne(ctx, model)
 	if err != nil {
 		log.Err(err)
 		return RepoResponse{Error: err}
 	}
 
-	return RepoResponse{
+	response := RepoResponse{
 		TotalRows: 1,
 		List:      []interface{}{model},
 	}
+
+	id, err := model.GetID()
+	if err == nil {
+		err = m.writeHistory(ctx, collection, request, HistoryOperationCreate, nil, bson.A{id})
+	}
+	if err != nil {
+		response.Errors = []error{err}
+	}
+
+	return response
 }
 
-func (m *MongoRepository) CreateMany(dbModel RepositoryModel, list []interface{}) error {
-	if len(list) == 0 {
-		return nil
+// Documents of a write of many read and written at once when its model
+// keeps its History
+const historyBatchSize = 500
+
+// writeMany runs write, which returns the documents written, on the
+// documents matching filter. When the model keeps its History, they are read
+// with a cursor sorted by _id and written in batches, each one with its
+// History records, so they are never all in memory.
+func (m *MongoRepository) writeMany(ctx context.Context, collection *mongo.Collection, request RepoRequest, operation HistoryOperation, filter interface{}, write func(filter interface{}) (int64, error)) RepoResponse {
+	if !keepsHistory(request.Model) {
+		rows, err := write(filter)
+		if err != nil {
+			log.Err(err)
+			return RepoResponse{TotalRows: rows, Error: err}
+		}
+		return RepoResponse{TotalRows: rows}
 	}
 
-	collection, err := m.GetCollection()
+	findOptions := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetBatchSize(historyBatchSize)
+	cursor, err := m.retrying(collection, "History", true).Find(ctx, filter, findOptions)
 	if err != nil {
 		log.Err(err)
-		return err
+		return RepoResponse{Error: err}
+	}
+	defer cursor.Close(ctx)
+
+	response := RepoResponse{}
+	before := []bson.M{}
+	flush := func() error {
+		if len(before) == 0 {
+			return nil
+		}
+		ids := historyIDs(before)
+		// the documents changed since they were read and no longer matching
+		// are left out, as the write of all of them would do
+		rows, err := write(bson.M{"$and": bson.A{filter, bson.M{"_id": bson.M{"$in": ids}}}})
+		response.TotalRows += rows
+		if err != nil {
+			return err
+		}
+		err = m.writeHistory(ctx, collection, request, operation, before, ids)
+		if err != nil {
+			response.Errors = append(response.Errors, err)
+		}
+		before = []bson.M{}
+		return nil
 	}
 
-	_, err = collection.InsertMany(m.ctx, list)
+	for cursor.Next(ctx) {
+		document := bson.M{}
+		err = cursor.Decode(&document)
+		if err == nil {
+			before = append(before, document)
+			if len(before) == historyBatchSize {
+				err = flush()
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = cursor.Err()
+	}
+	if err == nil {
+		err = flush()
+	}
 	if err != nil {
 		log.Err(err)
-		return err
+		response.Error = err
 	}
-	return nil
+
+	return response
 }
 
-func (m *MongoRepository) FindOne(request RepoRequest) RepoResponse {
-	response := &RepoResponse{}
+// readHistory returns the documents matching filter before a write, when the
+// model of the request keeps its History
+func (m *MongoRepository) readHistory(ctx context.Context, collection *mongo.Collection, request RepoRequest, filter interface{}) ([]bson.M, error) {
+	if !keepsHistory(request.Model) {
+		return nil, nil
+	}
 
-	if request.Model == nil {
-		response.Error = errors.New("MongoRepository.FindOne: model can not be empty")
-		return *response
+	cursor, err := m.retrying(collection, "History", true).Find(ctx, filter)
+	if err != nil {
+		return nil, err
 	}
 
-	collection, err := m.GetCollection()
+	documents := []bson.M{}
+	err = cursor.All(ctx, &documents)
+	return documents, err
+}
+
+// writeHistory saves the History of a write, comparing the documents read
+// by readHistory with the documents ids after the write
+func (m *MongoRepository) writeHistory(ctx context.Context, collection *mongo.Collection, request RepoRequest, operation HistoryOperation, before []bson.M, ids bson.A) error {
+	if !keepsHistory(request.Model) || len(ids) == 0 {
+		return nil
+	}
+
+	cursor, err := m.retrying(collection, "History", true).Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
 	if err != nil {
 		log.Err(err)
-		response.Error = err
-		return *response
+		return err
 	}
 
-	id, err := request.Model.GetID()
+	after := []bson.M{}
+	err = cursor.All(ctx, &after)
 	if err != nil {
 		log.Err(err)
-		response.Error = err
-		return *response
+		return err
 	}
 
-	result := collection.FindOne(m.ctx, bson.M{"_id": id})
-	err = result.Err()
+	records := newHistories(operation, request.User, before, after)
+	if len(records) == 0 {
+		return nil
+	}
+
+	_, err = m.retrying(collection.Database().Collection(historyCollection(collection.Name())), "History", false).InsertMany(ctx, records)
 	if err != nil {
-		if err.Error() == "mongo: no documents in result" {
-			message := fmt.Sprintf("MongoRepository.GetDetail.%s: no document found, ID: %s", collection.Name(), id)
-			err = errors.New(message)
-		}
-		log.Trace(err)
-		response.Error = err
-		return *response
+		err = errors.New("MongoRepository.writeHistory: " + err.Error())
+		log.Err(err)
 	}
+	return err
+}
 
-	response.TotalRows = 1
+// CreateMany inserts list as it is, without hooks. The models never stored
+// get an ID and a CreatedBy, their UpdatedBy and Version are kept.
+func (m *MongoRepository) CreateMany(dbModel RepositoryModel, list []interface{}) error {
+
+	if len(list) == 0 {
+		return nil
+	}
+
+	response := m.BulkWrite(RepoRequest{}, BulkList{NewList: list, Ordered: true, keepModels: true})
+	if response.Error != nil {
+		return response.Error
+	}
+	if len(response.Errors) > 0 {
+		return response.Errors[0]
+	}
+	return nil
+}
+
+// BulkWrite inserts, upserts and deletes the items of list in batches and
+// stamps their UserLogs. RepoResponse.List has a BulkResult per item written
+// and the failed ones are also in RepoResponse.Errors as BulkItemError.
+func (m *MongoRepository) BulkWrite(request RepoRequest, list BulkList) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+	profile := m.profile("BulkWrite")
+	defer profile.done()
+
+	collection, err := m.GetCollection()
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	items := prepareBulkItems(request, list)
+
+	batchSize := list.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBulkBatchSize
+	}
+
+	written := 0
+	for written < len(items) {
+		// a batch ends at the size limit or at an item that could not be prepared
+		end := written
+		for end < len(items) && end-written < batchSize && items[end].err == nil {
+			end++
+		}
+
+		if end > written {
+			attempted, err := m.bulkWriteBatch(ctx, collection, items[written:end], list.Ordered)
+			stopped := attempted < end-written
+			written += attempted
+			if err != nil {
+				log.Err(err)
+				response := bulkResponse(items, written)
+				response.Error = err
+				return response
+			}
+			if stopped {
+				break
+			}
+		}
+
+		if written < len(items) && items[written].err != nil {
+			written++
+			if list.Ordered {
+				break
+			}
+		}
+	}
+
+	return bulkResponse(items, written)
+}
+
+// bulkWriteBatch returns how many items of the batch were tried, less than
+// all of them only when an ordered write stopped at a failed one
+func (m *MongoRepository) bulkWriteBatch(ctx context.Context, collection *mongo.Collection, items []bulkItem, ordered bool) (int, error) {
+
+	writeModels := []mongo.WriteModel{}
+	for _, item := range items {
+		switch item.operation {
+		case BulkOperationInsert:
+			writeModels = append(writeModels, mongo.NewInsertOneModel().SetDocument(item.document))
+		case BulkOperationUpsert:
+			update := bson.M{"$set": item.document, "$setOnInsert": item.onInsert, "$inc": bson.M{"version": 1}}
+			writeModels = append(writeModels, mongo.NewUpdateOneModel().SetFilter(item.filter).SetUpdate(update).SetUpsert(true))
+		case BulkOperationDelete:
+			writeModels = append(writeModels, mongo.NewDeleteOneModel().SetFilter(item.filter))
+		}
+	}
+
+	result, err := m.retrying(collection, "BulkWrite", false).BulkWrite(ctx, writeModels, options.BulkWrite().SetOrdered(ordered))
+
+	attempted := len(items)
+	var bulkError mongo.BulkWriteException
+	if errors.As(err, &bulkError) {
+		for _, writeError := range bulkError.WriteErrors {
+			items[writeError.Index].err = errors.New(writeError.Message)
+			if ordered {
+				attempted = writeError.Index + 1
+			}
+		}
+		if bulkError.WriteConcernError == nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if result != nil {
+		for index := range result.UpsertedIDs {
+			items[index].setUpserted()
+		}
+	}
+
+	return attempted, nil
+}
+
+func (m *MongoRepository) FindOne(request RepoRequest) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+	profile := m.profile("FindOne")
+	defer profile.done()
+
+	response := &RepoResponse{}
+
+	if request.Model == nil {
+		response.Error = errors.New("MongoRepository.FindOne: model can not be empty")
+		return *response
+	}
+
+	collection, err := m.GetCollection()
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	id, err := request.Model.GetID()
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	projection, err := m.GetProjection(request)
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	findOneOptions := options.FindOne()
+	if projection != nil {
+		findOneOptions.SetProjection(projection)
+	}
+
+	filter := notDeletedFilter(bson.M{"_id": id}, request)
+	profile.find(collection, filter, nil)
+	result := m.retrying(collection, "FindOne", true).FindOne(ctx, filter, findOneOptions)
+	err = result.Err()
+	if err != nil {
+		if err.Error() == "mongo: no documents in result" {
+			message := fmt.Sprintf("MongoRepository.GetDetail.%s: no document found, ID: %s", collection.Name(), id)
+			err = errors.New(message)
+		}
+		log.Trace(err)
+		response.Error = err
+		return *response
+	}
+
+	response.TotalRows = 1
 	response.Error = result.Decode(request.Model)
+	if response.Error == nil {
+		response.Error = afterFind(request, request.Model)
+	}
 
 	return *response
 }
 
 func (m *MongoRepository) Find(request RepoRequest) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
 
 	_, err := request.Model.GetID()
 	if err == nil {
@@ -634,6 +1215,9 @@ func (m *MongoRepository) Find(request RepoRequest) RepoResponse {
 		return *response
 	}
 
+	profile := m.profile("Find")
+	defer profile.done()
+
 	response := &RepoResponse{
 		List: request.List,
 	}
@@ -644,12 +1228,18 @@ func (m *MongoRepository) Find(request RepoRequest) RepoResponse {
 		return *response
 	}
 
+	if request.CursorPaging {
+		return m.findByCursor(ctx, request, collection, profile)
+	}
+
 	countOptions := options.Count()
 	countOptions.Limit = utils.Int64(1000001)
 
 	options := options.Find()
 
-	if request.FindOptions.GetTotalOrders() > 0 {
+	if isTextSearch(request) {
+		options.SetSort(textSearchSort(searchOrders(request)))
+	} else if request.FindOptions.GetTotalOrders() > 0 {
 		options.SetSort(m.GetOrder(request.FindOptions))
 	}
 
@@ -672,8 +1262,20 @@ func (m *MongoRepository) Find(request RepoRequest) RepoResponse {
 		response.Error = err
 		return *response
 	}
+	filter = searchFilter(notDeletedFilter(filter, request), request)
+
+	projection, err := m.GetProjection(request)
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+	if projection != nil {
+		options.SetProjection(projection)
+	}
 
-	cursor, err := collection.Find(m.ctx, filter, options)
+	profile.find(collection, filter, options.Sort)
+	cursor, err := m.retrying(collection, "Find", true).Find(ctx, filter, options)
 
 	if err != nil {
 		log.Trace(err)
@@ -681,20 +1283,28 @@ func (m *MongoRepository) Find(request RepoRequest) RepoResponse {
 		return *response
 	}
 
-	count, err := collection.CountDocuments(m.ctx, filter, countOptions)
+	count, err := m.retrying(collection, "Find", true).CountDocuments(ctx, countFilter(filter), countOptions)
 	if err != nil {
-		log.Trace(err)
+		log.Err(err)
+		response.Error = err
 		return *response
 	}
 	response.TotalRows = count
 
-	err = cursor.All(m.ctx, &response.List)
+	err = cursor.All(ctx, &response.List)
 	if err != nil {
 		log.Err(err)
 		response.Error = err
 		return *response
 	}
 
+	err = afterFindList(request, response.List)
+	if err != nil {
+		log.Trace(err)
+		response.Error = err
+		return *response
+	}
+
 	response.CurrentPage = request.CurrentPage
 	response.PageSize = request.PageSize
 
@@ -708,7 +1318,205 @@ func (m *MongoRepository) Find(request RepoRequest) RepoResponse {
 	return *response
 }
 
+// FindStream runs the query of Find but, instead of loading the result in
+// RepoResponse.List, passes the rows to fn one at a time as they are read.
+// RepoResponse.TotalRows is the number of rows passed to fn.
+func (m *MongoRepository) FindStream(request RepoRequest, fn StreamFunc) RepoResponse {
+	// the repository Timeout bounds opening the cursor, not the time fn takes
+	// with the rows
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+
+	if fn == nil {
+		err := errors.New("MongoRepository.FindStream: fn can not be nil")
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	collection, err := m.GetCollection()
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	filter, err := m.GetFilter(request.FindOptions)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+	filter = searchFilter(notDeletedFilter(filter, request), request)
+
+	findOptions := options.Find()
+
+	if isTextSearch(request) {
+		findOptions.SetSort(textSearchSort(searchOrders(request)))
+	} else if request.FindOptions.GetTotalOrders() > 0 {
+		findOptions.SetSort(m.GetOrder(request.FindOptions))
+	}
+
+	skippedRows := request.PageSize * (request.CurrentPage - 1)
+	if request.PageSize > 0 && skippedRows > 0 {
+		findOptions.SetSkip(skippedRows)
+	}
+
+	if request.CurrentPage > 0 && request.PageSize > 0 {
+		findOptions.SetLimit(request.PageSize)
+	}
+
+	projection, err := m.GetProjection(request)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+	if projection != nil {
+		findOptions.SetProjection(projection)
+	}
+
+	cursor, err := m.retrying(collection, "FindStream", true).Find(ctx, filter, findOptions)
+	if err != nil {
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	return m.stream(m.getRequestContext(request), cursor, request, afterFindStream(request, fn))
+}
+
+func (m *MongoRepository) stream(ctx context.Context, cursor *mongo.Cursor, request RepoRequest, fn StreamFunc) RepoResponse {
+	defer cursor.Close(ctx)
+
+	next := func() ([]byte, bool, error) {
+		if cursor.Next(ctx) {
+			return cursor.Current, true, nil
+		}
+		return nil, false, cursor.Err()
+	}
+
+	total, err := streamRows(newStreamDecoder(request.List), next, fn)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{TotalRows: total, Error: err}
+	}
+
+	return RepoResponse{TotalRows: total}
+}
+
+// findByCursor pages by keyset: the rows after request.Cursor in the order of
+// the query, without skipping rows on the server
+func (m *MongoRepository) findByCursor(ctx context.Context, request RepoRequest, collection *mongo.Collection, profile *queryProfile) RepoResponse {
+
+	response := &RepoResponse{
+		List: request.List,
+	}
+
+	filter, err := m.GetFilter(request.FindOptions)
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+	filter = searchFilter(notDeletedFilter(filter, request), request)
+
+	orders := cursorOrders(request.FindOptions)
+
+	afterCursor, err := cursorFilter(orders, request.Cursor)
+	if err != nil {
+		log.Trace(err)
+		response.Error = err
+		return *response
+	}
+
+	pageFilter := interface{}(filter)
+	if afterCursor != nil {
+		pageFilter = bson.M{"$and": bson.A{filter, afterCursor}}
+	}
+
+	findOptions := options.Find().SetSort(cursorSort(orders))
+	if request.PageSize > 0 {
+		// one more row tells whether there is a next page
+		findOptions.SetLimit(request.PageSize + 1)
+	}
+
+	projection, err := m.GetProjection(request)
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+	if projection != nil {
+		findOptions.SetProjection(projection)
+	}
+
+	profile.find(collection, pageFilter, findOptions.Sort)
+	cursor, err := m.retrying(collection, "Find", true).Find(ctx, pageFilter, findOptions)
+	if err != nil {
+		log.Trace(err)
+		response.Error = err
+		return *response
+	}
+
+	// the token is read from the rows as stored, see nextCursor
+	documents := []bson.M{}
+	err = cursor.All(ctx, &documents)
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	err = decodeMemoryList(documents, &response.List)
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	response.List, response.NextCursor, err = nextCursor(orders, documents, response.List, request.PageSize)
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+
+	err = afterFindList(request, response.List)
+	if err != nil {
+		log.Trace(err)
+		response.Error = err
+		return *response
+	}
+
+	response.PageSize = request.PageSize
+
+	if request.SkipCount {
+		return *response
+	}
+
+	countOptions := options.Count()
+	countOptions.Limit = utils.Int64(1000001)
+
+	count, err := m.retrying(collection, "Find", true).CountDocuments(ctx, countFilter(filter), countOptions)
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+	response.TotalRows = count
+
+	if count > 0 && request.PageSize > 0 {
+		response.TotalPages = count / request.PageSize
+		if count/request.PageSize > 0 {
+			response.TotalPages++
+		}
+	}
+
+	return *response
+}
+
 func (m *MongoRepository) Count(request RepoRequest) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+	profile := m.profile("Count")
+	defer profile.done()
+
 	findResponse := &RepoResponse{}
 	collection, err := m.GetCollection()
 	if err != nil {
@@ -728,10 +1536,14 @@ func (m *MongoRepository) Count(request RepoRequest) RepoResponse {
 		findResponse.Error = err
 		return *findResponse
 	}
+	getFilter = searchFilter(notDeletedFilter(getFilter, request), request)
 
-	count, err := collection.CountDocuments(m.ctx, getFilter, countOptions)
+	getFilter = countFilter(getFilter)
+	profile.find(collection, getFilter, nil)
+	count, err := m.retrying(collection, "Count", true).CountDocuments(ctx, getFilter, countOptions)
 	if err != nil {
 		log.Err(err)
+		findResponse.Error = err
 		return *findResponse
 	}
 	findResponse.TotalRows = count
@@ -739,7 +1551,108 @@ func (m *MongoRepository) Count(request RepoRequest) RepoResponse {
 	return *findResponse
 }
 
+// Distinct returns in RepoResponse.List the values of field in the documents
+// of request, sorted. The items of an array field are values one by one.
+func (m *MongoRepository) Distinct(request RepoRequest, field string) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+	profile := m.profile("Distinct")
+	defer profile.done()
+
+	if field == "" {
+		err := errors.New("MongoRepository.Distinct: field can not be empty")
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	collection, err := m.GetCollection()
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	getFilter, err := m.GetFilter(request.FindOptions)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+	getFilter = searchFilter(notDeletedFilter(getFilter, request), request)
+
+	profile.find(collection, getFilter, nil)
+	values, err := m.retrying(collection, "Distinct", true).Distinct(ctx, field, getFilter)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+	values = distinctValues(values)
+
+	return RepoResponse{TotalRows: int64(len(values)), List: values}
+}
+
+// CountFacets counts the documents of request per label, tag and field of
+// facets in one $facet aggregation. RepoResponse.List has the Facets and
+// TotalRows the documents.
+func (m *MongoRepository) CountFacets(request RepoRequest, facets FacetOptions) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+	profile := m.profile("CountFacets")
+	defer profile.done()
+
+	err := facets.Validate()
+	if err != nil {
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	collection, err := m.GetCollection()
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	getFilter, err := m.GetFilter(request.FindOptions)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+	getFilter = searchFilter(notDeletedFilter(getFilter, request), request)
+
+	pipeline := bson.A{bson.M{"$match": getFilter}, bson.M{"$facet": facets.stages()}}
+	profile.aggregate(collection, pipeline)
+	cursor, err := m.retrying(collection, "CountFacets", true).Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+	defer cursor.Close(ctx)
+
+	result := bson.M{}
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(&result); err != nil {
+			log.Err(err)
+			return RepoResponse{Error: err}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	counts := facets.facets(result)
+	return RepoResponse{TotalRows: counts.Total, List: counts}
+}
+
 func (m *MongoRepository) Delete(request RepoRequest) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+	profile := m.profile("Delete")
+	defer profile.done()
+
+	if err := beforeDelete(request); err != nil {
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
 	collection, err := m.GetCollection()
 	if err != nil {
 		log.Err(err)
@@ -755,11 +1668,23 @@ func (m *MongoRepository) Delete(request RepoRequest) RepoResponse {
 	}
 
 	if id != nil {
-		_, err := collection.DeleteOne(m.ctx, bson.M{"_id": id})
+		profile.find(collection, bson.M{"_id": id}, nil)
+		before, err := m.readHistory(ctx, collection, request, bson.M{"_id": id})
+		if err != nil {
+			log.Err(err)
+			return RepoResponse{Error: err}
+		}
+
+		_, err = m.retrying(collection, "Delete", true).DeleteOne(ctx, bson.M{"_id": id})
 		if err != nil {
 			log.Trace(err)
 			return RepoResponse{Error: err}
 		}
+
+		err = m.writeHistory(ctx, collection, request, HistoryOperationDelete, before, bson.A{id})
+		if err != nil {
+			return RepoResponse{TotalRows: 1, Errors: []error{err}}
+		}
 		return RepoResponse{TotalRows: 1}
 	}
 
@@ -776,23 +1701,27 @@ func (m *MongoRepository) Delete(request RepoRequest) RepoResponse {
 		return RepoResponse{Error: err}
 	}
 
-	result, err := collection.DeleteMany(m.ctx, getFilter)
-	if err != nil {
-		log.Err(err)
-		return RepoResponse{Error: err}
-	}
-
-	return RepoResponse{TotalRows: result.DeletedCount}
+	profile.find(collection, getFilter, nil)
+	return m.writeMany(ctx, collection, request, HistoryOperationDelete, getFilter, func(filter interface{}) (int64, error) {
+		result, err := m.retrying(collection, "Delete", true).DeleteMany(ctx, filter)
+		if err != nil {
+			return 0, err
+		}
+		return result.DeletedCount, nil
+	})
 }
 
 func (m *MongoRepository) DeleteAll(dbModel RepositoryModel) error {
+	ctx, cancel := m.getContext(RepoRequest{})
+	defer cancel()
+
 	collection, err := m.GetCollection()
 	if err != nil {
 		log.Err(err)
 		return err
 	}
 
-	_, err = collection.DeleteMany(m.ctx, dbModel)
+	_, err = m.retrying(collection, "DeleteAll", true).DeleteMany(ctx, dbModel)
 	if err != nil {
 		log.Err(err)
 	}
@@ -800,6 +1729,9 @@ func (m *MongoRepository) DeleteAll(dbModel RepositoryModel) error {
 	return err
 }
 func (m *MongoRepository) GetSize(dbModel RepositoryModel) error {
+	ctx, cancel := m.getContext(RepoRequest{})
+	defer cancel()
+
 	collection, err := m.GetCollection()
 	if err != nil {
 		log.Err(err)
@@ -812,7 +1744,7 @@ func (m *MongoRepository) GetSize(dbModel RepositoryModel) error {
 		return err
 	}
 
-	result := db.RunCommand(context.Background(), bson.M{"collStats": collection.Name()})
+	result := db.RunCommand(ctx, bson.M{"collStats": collection.Name()})
 
 	var document bson.M
 	err = result.Decode(&document)
@@ -830,19 +1762,22 @@ func (m *MongoRepository) GetSize(dbModel RepositoryModel) error {
 }
 
 func (m *MongoRepository) Aggregate(request RepoRequest) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+	profile := m.profile("Aggregate")
+	defer profile.done()
+
 	response := &RepoResponse{
 		List: request.List,
 	}
 
-	if request.Pipeline == nil {
-		err := errors.New("MongoRepository.Aggregate: Pipeline is nil")
+	pipeline, err := getPipelineStages(request.Pipeline)
+	if err != nil {
+		err = errors.New("MongoRepository.Aggregate: " + err.Error())
 		log.Trace(err)
 		response.Error = err
 		return *response
 	}
-	// pipeline := map[string]interface{}{}
-	// pipeline := bson.A{}
-	pipeline := request.Pipeline.(bson.A)
 
 	collection, err := m.GetCollection()
 	if err != nil {
@@ -851,19 +1786,30 @@ func (m *MongoRepository) Aggregate(request RepoRequest) RepoResponse {
 		return *response
 	}
 
+	err = request.FindOptions.Projection.Validate()
+	if err != nil {
+		log.Err(err)
+		response.Error = err
+		return *response
+	}
+	if projection := request.FindOptions.Projection.mongoProjection(); projection != nil {
+		pipeline = append(pipeline, bson.M{"$project": projection})
+	}
+
 	countOptions := options.Count()
 	countOptions.Limit = utils.Int64(1000001)
 
 	aggregateOptions := options.Aggregate()
 
-	cursor, err := collection.Aggregate(m.ctx, pipeline, aggregateOptions)
+	profile.aggregate(collection, pipeline)
+	cursor, err := m.retrying(collection, "Aggregate", true).Aggregate(ctx, pipeline, aggregateOptions)
 	if err != nil {
 		log.Err(err)
 		response.Error = err
 		return *response
 	}
 
-	err = cursor.All(m.ctx, &response.List)
+	err = cursor.All(ctx, &response.List)
 	if err != nil {
 		log.Err(err)
 		response.Error = err
@@ -872,7 +1818,7 @@ func (m *MongoRepository) Aggregate(request RepoRequest) RepoResponse {
 
 	pipeline = append(pipeline, bson.D{{Key: "$count", Value: "total"}})
 
-	cursor, err = collection.Aggregate(m.ctx, pipeline, aggregateOptions)
+	cursor, err = m.retrying(collection, "Aggregate", true).Aggregate(ctx, pipeline, aggregateOptions)
 	if err != nil {
 		response.Error = err
 
@@ -884,7 +1830,7 @@ func (m *MongoRepository) Aggregate(request RepoRequest) RepoResponse {
 	}
 
 	var counter []Counter
-	err = cursor.All(m.ctx, &counter)
+	err = cursor.All(ctx, &counter)
 	if err != nil {
 		response.Error = err
 		return *response
@@ -899,7 +1845,157 @@ func (m *MongoRepository) Aggregate(request RepoRequest) RepoResponse {
 	return *response
 }
 
+// mongoChange is a change stream event
+type mongoChange struct {
+	OperationType     string              `bson:"operationType"`
+	ClusterTime       primitive.Timestamp `bson:"clusterTime"`
+	FullDocument      bson.Raw            `bson:"fullDocument"`
+	DocumentKey       bson.M              `bson:"documentKey"`
+	UpdateDescription struct {
+		UpdatedFields bson.M   `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+	NS struct {
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+}
+
+// Watch subscribes to the changes of the collection matching
+// request.FindOptions and passes them to fn, see WatchFunc. It blocks until
+// fn stops it or request.Context is done. The repository Timeout does not
+// apply.
+func (m *MongoRepository) Watch(request RepoRequest, watch WatchOptions, fn WatchFunc) RepoResponse {
+	if fn == nil {
+		err := errors.New("MongoRepository.Watch: fn can not be nil")
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	ctx := m.getRequestContext(request)
+
+	collection, err := m.GetCollection()
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	filter, err := m.GetFilter(request.FindOptions)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	match, err := watchFilter(filter, "fullDocument", watch.getOperations())
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	streamOptions := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+
+	token, err := watch.getResumeToken()
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+	if token != "" {
+		streamOptions.SetResumeAfter(bson.M{"_data": token})
+	}
+
+	stream, err := collection.Watch(ctx, bson.A{bson.M{"$match": match}}, streamOptions)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+	defer stream.Close(context.Background())
+
+	decoder := newStreamDecoder(request.List)
+	total := int64(0)
+
+	for stream.Next(ctx) {
+		change := mongoChange{}
+		err = stream.Decode(&change)
+		if err != nil {
+			log.Err(err)
+			return RepoResponse{TotalRows: total, Error: err}
+		}
+
+		event := ChangeEvent{
+			Operation:     ChangeOperation(change.OperationType),
+			Collection:    change.NS.Coll,
+			UpdatedFields: change.UpdateDescription.UpdatedFields,
+			RemovedFields: change.UpdateDescription.RemovedFields,
+			Time:          time.Unix(int64(change.ClusterTime.T), 0),
+		}
+		event.ResumeToken, _ = stream.ResumeToken().Lookup("_data").StringValueOK()
+		if id, ok := change.DocumentKey["_id"].(primitive.ObjectID); ok {
+			event.ID = id.Hex()
+		}
+		if len(change.FullDocument) > 0 {
+			event.Document, err = decoder.decode(change.FullDocument)
+			if err != nil {
+				log.Err(err)
+				return RepoResponse{TotalRows: total, Error: err}
+			}
+		}
+
+		total++
+		stop, err := watch.deliver(event, fn)
+		if err != nil {
+			log.Err(err)
+			return RepoResponse{TotalRows: total, Error: err}
+		}
+		if stop {
+			return RepoResponse{TotalRows: total}
+		}
+	}
+
+	if err = stream.Err(); err != nil && ctx.Err() == nil {
+		log.Err(err)
+		return RepoResponse{TotalRows: total, Error: err}
+	}
+
+	return RepoResponse{TotalRows: total}
+}
+
+// AggregateStream runs request.Pipeline and passes the rows to fn one at a
+// time, see FindStream
+func (m *MongoRepository) AggregateStream(request RepoRequest, fn StreamFunc) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+
+	if fn == nil {
+		err := errors.New("MongoRepository.AggregateStream: fn can not be nil")
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	pipeline, err := getPipelineStages(request.Pipeline)
+	if err != nil {
+		err = errors.New("MongoRepository.AggregateStream: " + err.Error())
+		log.Trace(err)
+		return RepoResponse{Error: err}
+	}
+
+	collection, err := m.GetCollection()
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	cursor, err := m.retrying(collection, "AggregateStream", true).Aggregate(ctx, pipeline, options.Aggregate())
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	return m.stream(m.getRequestContext(request), cursor, request, fn)
+}
+
 func (m *MongoRepository) DeleteDataBasesByCollections(list []utils.Dictionary, exceptions []string) error {
+	ctx, cancel := m.getContext(RepoRequest{})
+	defer cancel()
+
 	for _, item := range list {
 		m.ConnectionString = item.Key
 		m.DataBase = item.Value
@@ -908,7 +2004,7 @@ func (m *MongoRepository) DeleteDataBasesByCollections(list []utils.Dictionary,
 			log.Err(err)
 			return err
 		}
-		collections, err := db.ListCollectionNames(m.ctx, bson.M{})
+		collections, err := db.ListCollectionNames(ctx, bson.M{})
 		if err != nil {
 			log.Err(err)
 			return err
@@ -928,13 +2024,15 @@ func (m *MongoRepository) DeleteDataBasesByCollections(list []utils.Dictionary,
 				log.Err(err)
 				return err
 			}
-			_, err = db.Collection(col).DeleteMany(m.ctx, bson.M{})
+			_, err = db.Collection(col).DeleteMany(ctx, bson.M{})
 		}
 	}
 	return nil
 }
 
 func (m *MongoRepository) DeleteDatabase(connection string, database string) error {
+	ctx, cancel := m.getContext(RepoRequest{})
+	defer cancel()
 
 	if m.ConnectionString == "" || connection != "" {
 		m.ConnectionString = connection
@@ -954,8 +2052,78 @@ func (m *MongoRepository) DeleteDatabase(connection string, database string) err
 		log.Err(err)
 		return err
 	}
-	return db.Drop(m.ctx)
+	return db.Drop(ctx)
+
+}
+
+// EnsureIndexes creates the indexes missing in the collection. An index whose
+// definition changed is reported and left as it is, see indexChangedError.
+// Indexes not declared are left as they are.
+func (m *MongoRepository) EnsureIndexes(request RepoRequest, indexes []Index) RepoResponse {
+	ctx, cancel := m.getContext(request)
+	defer cancel()
+
+	collection, err := m.GetCollection()
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	return ensureMongoIndexes(ctx, collection, indexes)
+}
+
+func listMongoIndexes(ctx context.Context, collection *mongo.Collection) ([]mongoIndexSpec, error) {
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	specs := []mongoIndexSpec{}
+	err = cursor.All(ctx, &specs)
+	return specs, err
+}
+
+func ensureMongoIndexes(ctx context.Context, collection *mongo.Collection, indexes []Index) RepoResponse {
+	specs, err := listMongoIndexes(ctx, collection)
+	if err != nil {
+		log.Err(err)
+		return RepoResponse{Error: err}
+	}
+
+	existing := map[string]mongoIndexSpec{}
+	for _, spec := range specs {
+		existing[spec.Name] = spec
+	}
+
+	response := RepoResponse{}
+	for _, index := range indexes {
+		err := index.Validate()
+		if err != nil {
+			response.Errors = append(response.Errors, err)
+			continue
+		}
+
+		name := index.GetName()
+		if spec, ok := existing[name]; ok {
+			if !spec.sameAs(index) {
+				err := indexChangedError("MongoRepository.EnsureIndexes", collection.Name(), name)
+				log.Err(err)
+				response.Errors = append(response.Errors, err)
+			}
+			continue
+		}
+
+		_, err = collection.Indexes().CreateOne(ctx, index.mongoModel())
+		if err != nil {
+			err = errors.New("MongoRepository.EnsureIndexes: " + collection.Name() + "." + name + ": " + err.Error())
+			log.Err(err)
+			response.Errors = append(response.Errors, err)
+			continue
+		}
+		response.TotalRows++
+	}
 
+	return response
 }
 
 func (m *MongoRepository) GetCollection() (*mongo.Collection, error) {
@@ -978,41 +2146,18 @@ func (m *MongoRepository) GetFilter(filterOptions FindOptions) (map[string]inter
 	andFilters := []bson.M{}
 
 	for _, filter := range filterOptions.Filters {
-		// Detect if the value is a date string and convert it
-		if strVal, ok := filter.Value.(string); ok {
-			// Try to parse common date formats
-			var parsedTime time.Time
-			var err error
-
-			// Try RFC3339 format first
-			parsedTime, err = time.Parse(time.RFC3339, strVal)
-			if err != nil {
-				// Try ISO format
-				parsedTime, err = time.Parse("2006-01-02", strVal)
-				if err != nil {
-					// Try ISO format with time
-					parsedTime, err = time.Parse("2006-01-02T15:04:05", strVal)
-					if err != nil {
-						// Try ISO format with timezone
-						parsedTime, err = time.Parse("2006-01-02T15:04:05-07:00", strVal)
-						if err != nil {
-							// If none of the formats work, keep it as string
-							goto skipDateConversion
-						}
-					}
-				}
-			}
-			filter.Value = parsedTime
+		// group_by groups an aggregation, see Pipeline.Match
+		if filter.Operator == FilterOperatorGroupBy {
+			continue
 		}
-	skipDateConversion:
 
-		filterItem, err := m.getFilterItem(filter)
+		filterItem, err := m.getFilterCondition(filter)
 		if err != nil {
 			return map[string]interface{}{}, err
 		}
 
 		// Store filter item
-		andFilters = append(andFilters, bson.M{filter.Key: filterItem})
+		andFilters = append(andFilters, filterItem)
 	}
 
 	// Process FiltersOr (OR conditions)
@@ -1024,33 +2169,11 @@ func (m *MongoRepository) GetFilter(filterOptions FindOptions) (map[string]inter
 		}
 
 		for _, filter := range filterOr {
-			// Detect if the value is a date string and convert it
-			if strVal, ok := filter.Value.(string); ok {
-				var parsedTime time.Time
-				var err error
-
-				parsedTime, err = time.Parse(time.RFC3339, strVal)
-				if err != nil {
-					parsedTime, err = time.Parse("2006-01-02", strVal)
-					if err != nil {
-						parsedTime, err = time.Parse("2006-01-02T15:04:05", strVal)
-						if err != nil {
-							parsedTime, err = time.Parse("2006-01-02T15:04:05-07:00", strVal)
-							if err != nil {
-								goto skipDateConversionOr
-							}
-						}
-					}
-				}
-				filter.Value = parsedTime
-			}
-		skipDateConversionOr:
-
-			filterItem, err := m.getFilterItem(filter)
+			filterItem, err := m.getFilterCondition(filter)
 			if err != nil {
 				return map[string]interface{}{}, err
 			}
-			allOrConditions = append(allOrConditions, bson.M{filter.Key: filterItem})
+			allOrConditions = append(allOrConditions, filterItem)
 		}
 	}
 
@@ -1059,6 +2182,20 @@ func (m *MongoRepository) GetFilter(filterOptions FindOptions) (map[string]inter
 		andFilters = append(andFilters, bson.M{"$or": allOrConditions})
 	}
 
+	// Nested groups keep their own AND/OR/NOT
+	if filterOptions.Tree != nil {
+		err := filterOptions.Tree.Validate()
+		if err != nil {
+			return map[string]interface{}{}, err
+		}
+
+		treeFilter, err := m.getFilterNode(*filterOptions.Tree)
+		if err != nil {
+			return map[string]interface{}{}, err
+		}
+		andFilters = append(andFilters, treeFilter)
+	}
+
 	// If we have any andFilters, combine them with the main result
 	if len(andFilters) > 0 {
 		result["$and"] = andFilters
@@ -1067,6 +2204,46 @@ func (m *MongoRepository) GetFilter(filterOptions FindOptions) (map[string]inter
 	return result, nil
 }
 
+func (m *MongoRepository) getFilterNode(node FilterNode) (bson.M, error) {
+	if !node.IsGroup() {
+		return m.getFilterCondition(*node.Filter)
+	}
+
+	conditions := []bson.M{}
+	for _, child := range node.Nodes {
+		condition, err := m.getFilterNode(child)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+
+	switch node.Group {
+	case FilterGroupOr:
+		return bson.M{"$or": conditions}, nil
+	case FilterGroupNot:
+		// $not only applies to a field, $nor negates a whole expression
+		return bson.M{"$nor": conditions}, nil
+	default:
+		return bson.M{"$and": conditions}, nil
+	}
+}
+
+func (m *MongoRepository) getFilterCondition(filter Filter) (bson.M, error) {
+	value, err := filter.GetValue()
+	if err != nil {
+		return nil, err
+	}
+	filter.Value = value
+
+	filterItem, err := m.getFilterItem(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return bson.M{filter.Key: filterItem}, nil
+}
+
 func (m *MongoRepository) getFilterItem(filter Filter) (interface{}, error) {
 	switch filter.Operator {
 	case FilterOperatorEquals:
@@ -1099,6 +2276,10 @@ func (m *MongoRepository) getFilterItem(filter Filter) (interface{}, error) {
 		return bson.M{"$exists": true}, nil
 	case FilterOperatorNil:
 		return bson.M{"$exists": false}, nil
+	case FilterOperatorGeoWithin, FilterOperatorGeoIntersects, FilterOperatorNear:
+		return geoFilterItem(filter)
+	case FilterOperatorGroupBy:
+		return bson.D{}, errors.New("MongoRepository.getFilterItem: group_by is not a condition, add it to FindOptions.Filters and use Pipeline.Match")
 	default:
 		return bson.D{}, errors.New("MongoRepository.getFilterItem: unknown filter operator: ")
 	}
@@ -1127,6 +2308,25 @@ func (m *MongoRepository) GetOrder(filterOptions FindOptions) map[string]interfa
 	return result
 }
 
+// GetProjection returns the projection of a read, nil when it returns all the
+// fields
+func (m *MongoRepository) GetProjection(request RepoRequest) (map[string]interface{}, error) {
+	projection, err := readProjection(request)
+	if err != nil {
+		return nil, err
+	}
+
+	result := projection.mongoProjection()
+	if isTextSearch(request) {
+		if result == nil {
+			result = bson.M{}
+		}
+		result[SearchScoreField] = bson.M{"$meta": "textScore"}
+	}
+
+	return result, nil
+}
+
 func (m *MongoRepository) GetType() RepoType {
 	return RepoTypeMongoDB
 }
@@ -1152,37 +2352,137 @@ func (m *MongoRepository) SetRepoID(repoID string) error {
 	return nil
 }
 
-func (m *MongoRepository) RepoBackup(request RepoRequest, backupID string) RepoResponse {
-	out := "backup/" + m.DataBase + "/" + backupID
-	db := m.DataBase
+// RepoBackup streams every collection of the database, with its documents
+// and indexes, into an archive saved in the file repository of backup
+func (m *MongoRepository) RepoBackup(request RepoRequest, backup BackupOptions) RepoResponse {
+	// a backup takes as long as it needs, the repository Timeout does not apply
+	ctx := request.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	db, err := m.GetDB()
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
 
-	cmd := exec.Command("mongodump", "--uri", m.ConnectionString, "--db", db, "--out", out)
-	err := cmd.Run()
+	// only the data: views have no documents of their own and the system.*
+	// collections belong to the server
+	names, err := db.ListCollectionNames(ctx, bson.M{
+		"type": "collection",
+		"name": bson.M{"$not": primitive.Regex{Pattern: `^system\.`}},
+	})
 	if err != nil {
+		log.Err(err)
 		return RepoResponse{Error: err}
 	}
+	sort.Strings(names)
+
+	return saveBackup(request, backup, m.DataBase, func(archive *backupWriter) error {
+		for _, name := range names {
+			collection := db.Collection(name)
+
+			specs, err := listMongoIndexes(ctx, collection)
+			if err != nil {
+				return err
+			}
+			indexes := []Index{}
+			for _, spec := range specs {
+				if spec.Name != "_id_" {
+					indexes = append(indexes, spec.index())
+				}
+			}
+
+			err = archive.collection(name, indexes)
+			if err != nil {
+				return err
+			}
+
+			cursor, err := m.retrying(collection, "RepoBackup", true).Find(ctx, bson.M{})
+			if err != nil {
+				return err
+			}
+			for cursor.Next(ctx) {
+				err = archive.document(cursor.Current)
+				if err != nil {
+					cursor.Close(ctx)
+					return err
+				}
+			}
+			err = cursor.Err()
+			cursor.Close(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RepoRestore replaces the database by the contents of the archive of
+// backup, see BackupOptions
+func (m *MongoRepository) RepoRestore(request RepoRequest, backup BackupOptions) RepoResponse {
+	ctx := request.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return restoreBackup(request, backup, m.DataBase, func() (backupTarget, error) {
+		db, err := m.GetDB()
+		if err != nil {
+			return nil, err
+		}
+		err = db.Drop(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &mongoBackupTarget{ctx: ctx, db: db, repo: m}, nil
+	})
+}
+
+// Documents inserted at once by RepoRestore
+const mongoRestoreBatchSize = 1000
 
-	return RepoResponse{Error: nil}
+type mongoBackupTarget struct {
+	ctx       context.Context
+	db        *mongo.Database
+	repo      *MongoRepository
+	documents []interface{}
 }
 
-func (m *MongoRepository) RepoRestore(request RepoRequest, backupID string) RepoResponse {
-	db := m.DataBase
+func (m *mongoBackupTarget) collection(name string, indexes []Index) error {
+	m.documents = []interface{}{}
+	return m.db.CreateCollection(m.ctx, name)
+}
 
-	if strings.Contains(strings.ToLower(m.ConnectionString), "pro") {
-		return RepoResponse{Error: errors.New("MongoRepository.RepoRestore: no se puede restaurar en entorno PRO")}
+func (m *mongoBackupTarget) document(collection string, document bson.Raw) error {
+	m.documents = append(m.documents, document)
+	if len(m.documents) < mongoRestoreBatchSize {
+		return nil
 	}
+	return m.flush(collection)
+}
 
-	err := m.DeleteDatabase(m.GetConnection(), m.DataBase)
-	if err != nil {
-		return RepoResponse{Error: err}
+func (m *mongoBackupTarget) flush(collection string) error {
+	if len(m.documents) == 0 {
+		return nil
 	}
-	out := "backup/" + db + "/" + backupID + "/" + db
+	_, err := m.repo.retrying(m.db.Collection(collection), "RepoRestore", false).InsertMany(m.ctx, m.documents)
+	m.documents = []interface{}{}
+	return err
+}
 
-	cmd := exec.Command("mongorestore", "--uri", m.ConnectionString, "--db", db, out)
-	err = cmd.Run()
+func (m *mongoBackupTarget) end(collection BackupCollection) error {
+	err := m.flush(collection.Name)
 	if err != nil {
-		return RepoResponse{Error: err}
+		return err
 	}
-
-	return RepoResponse{Error: nil}
+	response := ensureMongoIndexes(m.ctx, m.db.Collection(collection.Name), collection.Indexes)
+	if response.Error != nil {
+		return response.Error
+	}
+	if len(response.Errors) > 0 {
+		return response.Errors[0]
+	}
+	return nil
 }
@@ -0,0 +1,279 @@
+package foundation
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/weitecit/pkg/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type Accumulator utils.Enum
+
+const (
+	AccumulatorSum   Accumulator = "sum"
+	AccumulatorAvg   Accumulator = "avg"
+	AccumulatorMin   Accumulator = "min"
+	AccumulatorMax   Accumulator = "max"
+	AccumulatorCount Accumulator = "count"
+)
+
+// GroupField is a field computed by a $group stage: Name is the result of the
+// Accumulator over Field in the documents of each group
+type GroupField struct {
+	Name        string      `json:"name"`
+	Accumulator Accumulator `json:"accumulator"`
+	Field       string      `json:"field,omitempty"`
+}
+
+func GroupSum(name string, field string) GroupField {
+	return GroupField{Name: name, Accumulator: AccumulatorSum, Field: field}
+}
+
+func GroupAvg(name string, field string) GroupField {
+	return GroupField{Name: name, Accumulator: AccumulatorAvg, Field: field}
+}
+
+func GroupMin(name string, field string) GroupField {
+	return GroupField{Name: name, Accumulator: AccumulatorMin, Field: field}
+}
+
+func GroupMax(name string, field string) GroupField {
+	return GroupField{Name: name, Accumulator: AccumulatorMax, Field: field}
+}
+
+func GroupCount(name string) GroupField {
+	return GroupField{Name: name, Accumulator: AccumulatorCount}
+}
+
+func (m GroupField) expression() (bson.M, error) {
+	if m.Name == "" || m.Name == "_id" || strings.Contains(m.Name, ".") {
+		return nil, errors.New("Pipeline.Group: invalid field name: " + m.Name)
+	}
+
+	if m.Accumulator == AccumulatorCount {
+		return bson.M{"$sum": 1}, nil
+	}
+
+	if m.Field == "" {
+		return nil, errors.New("Pipeline.Group: " + m.Name + " needs a field")
+	}
+
+	switch m.Accumulator {
+	case AccumulatorSum, AccumulatorAvg, AccumulatorMin, AccumulatorMax:
+		return bson.M{"$" + string(m.Accumulator): "$" + m.Field}, nil
+	default:
+		return nil, errors.New("Pipeline.Group: unknown accumulator: " + string(m.Accumulator))
+	}
+}
+
+// Pipeline builds an aggregation pipeline that Aggregate and AggregateStream
+// accept in RepoRequest.Pipeline (or FindOptions.Pipeline), e.g.
+//
+//	NewPipeline().
+//		Match(*findOptions).
+//		Group([]string{"category"}, GroupCount("total"), GroupSum("amount", "amount")).
+//		Sort(Order{Field: "total", Direction: -1}).
+//		Limit(10)
+//
+// The first error of the builder is returned by Stages.
+type Pipeline struct {
+	stages bson.A
+	err    error
+}
+
+func NewPipeline() *Pipeline {
+	return &Pipeline{stages: bson.A{}}
+}
+
+func (m *Pipeline) add(stage string, value interface{}) *Pipeline {
+	m.stages = append(m.stages, bson.D{{Key: stage, Value: value}})
+	return m
+}
+
+func (m *Pipeline) fail(err error) *Pipeline {
+	if m.err == nil {
+		m.err = err
+	}
+	return m
+}
+
+// Match filters the documents with the filters of findOptions. When it has
+// FilterOperatorGroupBy filters, the documents are then grouped by those
+// fields and counted in "count".
+func (m *Pipeline) Match(findOptions FindOptions) *Pipeline {
+	filter, err := (&MongoRepository{}).GetFilter(findOptions)
+	if err != nil {
+		return m.fail(err)
+	}
+
+	if len(filter) > 0 {
+		m.add("$match", filter)
+	}
+
+	if groupBy := findOptions.GetGroupBy(); len(groupBy) > 0 {
+		m.Group(groupBy, GroupCount("count"))
+	}
+
+	return m
+}
+
+// Group groups the documents by the fields, or all of them when there are no
+// fields. _id of the result has each field, with its dots as "_".
+func (m *Pipeline) Group(by []string, fields ...GroupField) *Pipeline {
+	var id interface{}
+	if len(by) > 0 {
+		keys := bson.D{}
+		for _, field := range by {
+			keys = append(keys, bson.E{Key: strings.ReplaceAll(field, ".", "_"), Value: "$" + field})
+		}
+		id = keys
+	}
+
+	group := bson.D{{Key: "_id", Value: id}}
+	for _, field := range fields {
+		expression, err := field.expression()
+		if err != nil {
+			return m.fail(err)
+		}
+		group = append(group, bson.E{Key: field.Name, Value: expression})
+	}
+
+	return m.add("$group", group)
+}
+
+func (m *Pipeline) Sort(orders ...Order) *Pipeline {
+	if len(orders) == 0 {
+		return m
+	}
+	return m.add("$sort", cursorSort(orders))
+}
+
+func (m *Pipeline) Skip(skip int64) *Pipeline {
+	if skip < 0 {
+		return m.fail(errors.New("Pipeline.Skip: skip can not be negative"))
+	}
+	return m.add("$skip", skip)
+}
+
+func (m *Pipeline) Limit(limit int64) *Pipeline {
+	if limit <= 0 {
+		return m.fail(errors.New("Pipeline.Limit: limit must be positive"))
+	}
+	return m.add("$limit", limit)
+}
+
+// Unwind outputs a document for each item of the array field. Documents with
+// the field missing or empty are kept only with preserveEmpty.
+func (m *Pipeline) Unwind(field string, preserveEmpty bool) *Pipeline {
+	if field == "" {
+		return m.fail(errors.New("Pipeline.Unwind: field can not be empty"))
+	}
+	return m.add("$unwind", bson.D{
+		{Key: "path", Value: "$" + field},
+		{Key: "preserveNullAndEmptyArrays", Value: preserveEmpty},
+	})
+}
+
+// Lookup adds to each document, in the array as, the documents of the
+// collection from whose foreignField equals its localField
+func (m *Pipeline) Lookup(from string, localField string, foreignField string, as string) *Pipeline {
+	if from == "" || localField == "" || foreignField == "" || as == "" {
+		return m.fail(errors.New("Pipeline.Lookup: from, localField, foreignField and as are required"))
+	}
+	return m.add("$lookup", bson.D{
+		{Key: "from", Value: from},
+		{Key: "localField", Value: localField},
+		{Key: "foreignField", Value: foreignField},
+		{Key: "as", Value: as},
+	})
+}
+
+// Facet runs each pipeline over the same documents and returns one document
+// with the results of each one in its name
+func (m *Pipeline) Facet(facets map[string]*Pipeline) *Pipeline {
+	if len(facets) == 0 {
+		return m.fail(errors.New("Pipeline.Facet: facets can not be empty"))
+	}
+
+	facet := bson.M{}
+	for name, pipeline := range facets {
+		if pipeline == nil {
+			return m.fail(errors.New("Pipeline.Facet: " + name + " is nil"))
+		}
+		stages, err := pipeline.Stages()
+		if err != nil {
+			return m.fail(err)
+		}
+		facet[name] = stages
+	}
+
+	return m.add("$facet", facet)
+}
+
+// Stages returns a copy of the stages, or the first error of the builder
+func (m *Pipeline) Stages() (bson.A, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return append(bson.A{}, m.stages...), nil
+}
+
+// getPipelineStages returns the stages of RepoRequest.Pipeline, which can be a
+// *Pipeline or a list of stages
+func getPipelineStages(pipeline interface{}) (bson.A, error) {
+	switch pipeline := pipeline.(type) {
+	case nil:
+		return nil, errors.New("Pipeline is nil")
+	case *Pipeline:
+		if pipeline == nil {
+			return nil, errors.New("Pipeline is nil")
+		}
+		return pipeline.Stages()
+	case Pipeline:
+		return pipeline.Stages()
+	case bson.A:
+		return append(bson.A{}, pipeline...), nil
+	case []interface{}:
+		return append(bson.A{}, pipeline...), nil
+	case mongo.Pipeline:
+		stages := bson.A{}
+		for _, stage := range pipeline {
+			stages = append(stages, stage)
+		}
+		return stages, nil
+	case []bson.D:
+		stages := bson.A{}
+		for _, stage := range pipeline {
+			stages = append(stages, stage)
+		}
+		return stages, nil
+	case []bson.M:
+		stages := bson.A{}
+		for _, stage := range pipeline {
+			stages = append(stages, stage)
+		}
+		return stages, nil
+	default:
+		return nil, errors.New("Pipeline must be a *Pipeline or a list of stages")
+	}
+}
+
+// AddGroupBy groups the results of Pipeline.Match by the fields
+func (m *FindOptions) AddGroupBy(fields ...string) {
+	for _, field := range fields {
+		m.AddComplex(field, FilterOperatorGroupBy, nil)
+	}
+}
+
+func (m *FindOptions) GetGroupBy() []string {
+	fields := []string{}
+	for _, filter := range m.Filters {
+		if filter.Operator == FilterOperatorGroupBy {
+			fields = append(fields, filter.Key)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,203 @@
+package foundation
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/weitecit/pkg/log"
+	"github.com/weitecit/pkg/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Time given to the explain of a slow query
+const slowQueryExplainTimeout = 10 * time.Second
+
+// Explains of slow queries running at once. A slow query that finds them all
+// taken is logged without its explain.
+const maxSlowQueryExplains = 4
+
+var slowQueryExplains = make(chan struct{}, maxSlowQueryExplains)
+
+// Stages of an explain that read an index
+var explainIndexStages = []string{"IXSCAN", "EXPRESS_IXSCAN", "IDHACK", "COUNT_SCAN", "DISTINCT_SCAN"}
+
+// Explains of slow queries running in the background
+var slowQueryExplaining sync.WaitGroup
+
+// SlowQuery is an operation of MongoRepository that took longer than its
+// SlowQueryThreshold. It is logged with log.SlowQuery.
+type SlowQuery struct {
+	Operation  string
+	DataBase   string
+	Collection string
+	// The filter, sort or pipeline the operation sent
+	Filter   interface{}
+	Sort     interface{}
+	Pipeline interface{}
+	Duration time.Duration
+	// Filled when ExplainSlowQueries is set
+	Explain   bson.M
+	IndexUsed bool
+}
+
+func (m SlowQuery) fields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"operation":   m.Operation,
+		"database":    m.DataBase,
+		"collection":  m.Collection,
+		"duration_ms": m.Duration.Milliseconds(),
+	}
+	if m.Filter != nil {
+		fields["filter"] = m.Filter
+	}
+	if m.Sort != nil {
+		fields["sort"] = m.Sort
+	}
+	if m.Pipeline != nil {
+		fields["pipeline"] = m.Pipeline
+	}
+	if m.Explain != nil {
+		fields["explain"] = m.Explain
+		fields["index_used"] = m.IndexUsed
+	}
+	return fields
+}
+
+// queryProfile times an operation of the repository, see profile
+type queryProfile struct {
+	repo       *MongoRepository
+	start      time.Time
+	collection *mongo.Collection
+	query      SlowQuery
+}
+
+// profile times an operation of the repository. The operation passes the
+// query it sends, the one logged and explained when it is slow:
+//
+//	profile := m.profile("Find")
+//	defer profile.done()
+//	...
+//	profile.find(collection, filter, sort)
+func (m *MongoRepository) profile(operation string) *queryProfile {
+	return &queryProfile{
+		repo:  m,
+		start: time.Now(),
+		query: SlowQuery{Operation: operation, DataBase: m.DataBase, Collection: m.Collection},
+	}
+}
+
+// find keeps the filter and sort sent to collection
+func (m *queryProfile) find(collection *mongo.Collection, filter interface{}, sort interface{}) {
+	m.collection = collection
+	m.query.Filter = filter
+	m.query.Sort = sort
+}
+
+// aggregate keeps the pipeline sent to collection
+func (m *queryProfile) aggregate(collection *mongo.Collection, pipeline interface{}) {
+	m.collection = collection
+	m.query.Pipeline = pipeline
+}
+
+func (m *queryProfile) done() {
+	threshold := m.repo.SlowQueryThreshold
+	if threshold <= 0 {
+		return
+	}
+	m.query.Duration = time.Since(m.start)
+	if m.query.Duration < threshold {
+		return
+	}
+
+	query := m.query
+	msg := "MongoRepository." + query.Operation + ": slow query on " + query.DataBase + "." + query.Collection
+	if !m.repo.ExplainSlowQueries || m.collection == nil {
+		log.SlowQuery(msg, query.fields())
+		return
+	}
+
+	// the explain runs apart, so it never adds to the time of the operation.
+	// The database is the one of the operation, the repository is not used
+	// from the goroutine.
+	db := m.collection.Database()
+	collection := m.collection.Name()
+	select {
+	case slowQueryExplains <- struct{}{}:
+		slowQueryExplaining.Add(1)
+		go func() {
+			defer slowQueryExplaining.Done()
+			defer func() { <-slowQueryExplains }()
+			if err := explain(db, collection, &query); err != nil {
+				log.Trace(err)
+			}
+			log.SlowQuery(msg, query.fields())
+		}()
+	default:
+		log.SlowQuery(msg, query.fields())
+	}
+}
+
+// explain runs the query planner on the query, as a find or, when it has a
+// pipeline, as an aggregate
+func explain(db *mongo.Database, collection string, query *SlowQuery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), slowQueryExplainTimeout)
+	defer cancel()
+
+	filter := query.Filter
+	if filter == nil {
+		filter = bson.M{}
+	}
+	command := bson.D{{Key: "find", Value: collection}, {Key: "filter", Value: filter}}
+	if query.Sort != nil {
+		command = append(command, bson.E{Key: "sort", Value: query.Sort})
+	}
+	if query.Pipeline != nil {
+		command = bson.D{{Key: "aggregate", Value: collection}, {Key: "pipeline", Value: query.Pipeline}, {Key: "cursor", Value: bson.M{}}}
+	}
+
+	result := bson.M{}
+	err := db.RunCommand(ctx, bson.D{{Key: "explain", Value: command}, {Key: "verbosity", Value: "queryPlanner"}}).Decode(&result)
+	if err != nil {
+		return err
+	}
+
+	query.Explain = result
+	if planner, ok := result["queryPlanner"].(bson.M); ok {
+		query.Explain = bson.M{"winningPlan": planner["winningPlan"]}
+	}
+	query.IndexUsed = explainUsesIndex(result)
+	return nil
+}
+
+// explainUsesIndex tells whether some stage of an explain output scans an
+// index
+func explainUsesIndex(value interface{}) bool {
+	switch value := value.(type) {
+	case bson.M:
+		if stage, ok := value["stage"].(string); ok && utils.ArrayContentStr(explainIndexStages, stage) {
+			return true
+		}
+		for key, item := range value {
+			// rejected plans did not run
+			if key != "rejectedPlans" && explainUsesIndex(item) {
+				return true
+			}
+		}
+	case bson.D:
+		document := bson.M{}
+		for _, element := range value {
+			document[element.Key] = element.Value
+		}
+		return explainUsesIndex(document)
+	case bson.A:
+		for _, item := range value {
+			if explainUsesIndex(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
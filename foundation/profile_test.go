@@ -0,0 +1,100 @@
+package foundation
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/weitecit/pkg/log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestMongoRepositoryLogsSlowQueries(t *testing.T) {
+	repo := NewMongoRepository("mongodb://localhost", "profile_test", "items", false)
+	repo.SlowQueryThreshold = time.Nanosecond
+
+	output := &bytes.Buffer{}
+	log.AddOutput(output)
+	defer log.RemoveOutput(output)
+
+	filter := bson.M{"name": "Almendro", "deleted_by": nil}
+	profile := repo.profile("Find")
+	profile.find(nil, filter, bson.D{{Key: "amount", Value: -1}})
+	time.Sleep(time.Millisecond)
+	profile.done()
+
+	logged := output.String()
+	for _, want := range []string{`"type":"slow_query"`, `"operation":"Find"`, `"collection":"items"`, `"name":"Almendro"`, `"deleted_by":null`, `"amount"`} {
+		if !strings.Contains(logged, want) {
+			t.Fatalf("slow query log %s does not contain %s", logged, want)
+		}
+	}
+
+	output.Reset()
+	repo.SlowQueryThreshold = time.Hour
+	profile = repo.profile("Find")
+	profile.find(nil, filter, nil)
+	profile.done()
+	if output.Len() > 0 {
+		t.Fatalf("fast query logged: %s", output.String())
+	}
+}
+
+func TestMongoRepositoryExplainsSlowQueriesInTheBackground(t *testing.T) {
+	repo := NewMongoRepository("mongodb://localhost:1", "profile_test", "items", false)
+	repo.SlowQueryThreshold = time.Nanosecond
+	repo.ExplainSlowQueries = true
+
+	// nothing listens on the port, the explain fails once no server is found
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:1").SetServerSelectionTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("mongo.Connect(): %v", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	output := &bytes.Buffer{}
+	log.AddOutput(output)
+	defer log.RemoveOutput(output)
+
+	profile := repo.profile("Find")
+	profile.find(client.Database("profile_test").Collection("items"), bson.M{"name": "Almendro"}, nil)
+	time.Sleep(time.Millisecond)
+	start := time.Now()
+	profile.done()
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("profile waited %s for the explain", elapsed)
+	}
+
+	slowQueryExplaining.Wait()
+	logged := output.String()
+	for _, want := range []string{`"type":"slow_query"`, `"operation":"Find"`, `"name":"Almendro"`} {
+		if !strings.Contains(logged, want) {
+			t.Fatalf("slow query log %s does not contain %s", logged, want)
+		}
+	}
+	if strings.Contains(logged, `"index_used"`) {
+		t.Fatalf("slow query log %s has an explain, want none", logged)
+	}
+}
+
+func TestExplainUsesIndex(t *testing.T) {
+	scan := bson.M{"queryPlanner": bson.M{
+		"winningPlan":   bson.M{"stage": "FETCH", "inputStage": bson.M{"stage": "COLLSCAN"}},
+		"rejectedPlans": bson.A{bson.M{"stage": "IXSCAN"}},
+	}}
+	if explainUsesIndex(scan) {
+		t.Fatalf("explainUsesIndex() of a collection scan = true")
+	}
+
+	index := bson.M{"queryPlanner": bson.M{
+		"winningPlan": bson.D{{Key: "stage", Value: "FETCH"}, {Key: "inputStage", Value: bson.D{{Key: "stage", Value: "IXSCAN"}}}},
+	}}
+	if !explainUsesIndex(index) {
+		t.Fatalf("explainUsesIndex() of an index scan = false")
+	}
+}
@@ -0,0 +1,172 @@
+package foundation
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/weitecit/pkg/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Projection selects the fields returned by the reads: only the Include ones,
+// or all but the Exclude ones. _id is always returned unless excluded.
+type Projection struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// NewProjection includes the fields, or excludes them when prefixed with "-",
+// e.g. "name", "-password"
+func NewProjection(fields ...string) Projection {
+	projection := Projection{}
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if strings.HasPrefix(field, "-") {
+			projection.Exclude = utils.FindOrAppendStrRaw(projection.Exclude, projectionField(field[1:]))
+		} else if field != "" {
+			projection.Include = utils.FindOrAppendStrRaw(projection.Include, projectionField(field))
+		}
+	}
+	return projection
+}
+
+func projectionField(field string) string {
+	if field == "id" {
+		return "_id"
+	}
+	return field
+}
+
+func (m Projection) IsEmpty() bool {
+	return len(m.Include) == 0 && len(m.Exclude) == 0
+}
+
+// Validate fails when fields are included and excluded at once, which MongoDB
+// only allows for _id
+func (m Projection) Validate() error {
+	if len(m.Include) == 0 {
+		return nil
+	}
+	for _, field := range m.Exclude {
+		if field != "_id" {
+			return errors.New("Projection.Validate: can not include and exclude " + field + " at once")
+		}
+	}
+	return nil
+}
+
+// keep makes sure the fields are returned, e.g. the ones a cursor needs
+func (m Projection) keep(fields ...string) Projection {
+	if m.IsEmpty() {
+		return m
+	}
+
+	result := Projection{Include: append([]string{}, m.Include...)}
+	for _, field := range m.Exclude {
+		if !utils.ArrayContentStr(fields, field) {
+			result.Exclude = append(result.Exclude, field)
+		}
+	}
+	if len(result.Include) > 0 {
+		for _, field := range fields {
+			result.Include = utils.FindOrAppendStrRaw(result.Include, field)
+		}
+	}
+	return result
+}
+
+func (m Projection) mongoProjection() bson.M {
+	if m.IsEmpty() {
+		return nil
+	}
+
+	result := bson.M{}
+	for _, field := range m.Include {
+		result[field] = 1
+	}
+	for _, field := range m.Exclude {
+		result[field] = 0
+	}
+	return result
+}
+
+// readProjection is the projection of a read, keeping the fields the
+// repository needs after it: the relevance of a text search and the sort keys
+// of a cursor
+func readProjection(request RepoRequest) (Projection, error) {
+	projection := request.FindOptions.Projection
+	err := projection.Validate()
+	if err != nil {
+		return projection, err
+	}
+
+	if isTextSearch(request) {
+		projection = projection.keep(SearchScoreField)
+	}
+	if request.CursorPaging {
+		for _, order := range cursorOrders(request.FindOptions) {
+			projection = projection.keep(order.Field)
+		}
+	}
+
+	return projection, nil
+}
+
+func (m *FindOptions) IncludeFields(fields ...string) {
+	for _, field := range fields {
+		m.Projection.Include = utils.FindOrAppendStrRaw(m.Projection.Include, projectionField(field))
+	}
+}
+
+func (m *FindOptions) ExcludeFields(fields ...string) {
+	for _, field := range fields {
+		m.Projection.Exclude = utils.FindOrAppendStrRaw(m.Projection.Exclude, projectionField(field))
+	}
+}
+
+// projectMemoryDocuments applies the projection to documents already cloned
+func projectMemoryDocuments(documents []bson.M, projection Projection) []bson.M {
+	if projection.IsEmpty() {
+		return documents
+	}
+
+	for i, document := range documents {
+		if len(projection.Include) == 0 {
+			for _, field := range projection.Exclude {
+				unsetMemoryPath(document, field)
+			}
+			continue
+		}
+
+		projected := bson.M{}
+		if !utils.ArrayContentStr(projection.Exclude, "_id") {
+			if id, ok := document["_id"]; ok {
+				projected["_id"] = id
+			}
+		}
+		for _, field := range projection.Include {
+			if value, ok := lookupMemoryPath(document, field); ok {
+				setMemoryPath(projected, field, value)
+			}
+		}
+		documents[i] = projected
+	}
+
+	return documents
+}
+
+func unsetMemoryPath(document bson.M, path string) {
+	parts := strings.Split(path, ".")
+	current := document
+
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := asMemoryDocument(current[part])
+		if !ok {
+			return
+		}
+		current = next
+	}
+
+	delete(current, parts[len(parts)-1])
+}
@@ -0,0 +1,298 @@
+package foundation
+
+import (
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Fields that refer to documents of the domain, remapped with the IDs
+var defaultProvisionReferenceFields = []string{"parent_id", "family_id"}
+
+// ProvisionOptions of ProvisionDomain
+type ProvisionOptions struct {
+	// Domain copied, and the new one
+	TemplateRepoID string
+	RepoID         string
+	// Models of the collections copied, in order. Global ones are not allowed.
+	Models []RepositoryModel
+	// Copies keep the ID of the template documents, otherwise they get new
+	// ones
+	KeepIDs bool
+	// Fields with the ID of another copied document, rewritten with its new
+	// ID. parent_id and family_id by default.
+	ReferenceFields []string
+	// Called after every batch written
+	Progress func(progress ProvisionProgress)
+}
+
+// ProvisionProgress of a collection, with Done when it is complete
+type ProvisionProgress struct {
+	Collection string
+	Copied     int64
+	Total      int64
+	Done       bool
+}
+
+// ProvisionCollection is returned in RepoResponse.List by ProvisionDomain
+type ProvisionCollection struct {
+	Name      string `json:"name"`
+	Documents int64  `json:"documents"`
+}
+
+func (m ProvisionOptions) Validate() error {
+	if m.TemplateRepoID == "" || m.RepoID == "" {
+		return errors.New("ProvisionOptions.Validate: TemplateRepoID and RepoID are required")
+	}
+	if m.TemplateRepoID == m.RepoID {
+		return errors.New("ProvisionOptions.Validate: the template and the new domain are the same")
+	}
+	if len(m.Models) == 0 {
+		return errors.New("ProvisionOptions.Validate: no models to copy")
+	}
+	collections := map[string]bool{}
+	for _, model := range m.Models {
+		if model == nil {
+			return errors.New("ProvisionOptions.Validate: model is nil")
+		}
+		collection, isGlobal := model.GetCollection()
+		if isGlobal {
+			return errors.New("ProvisionOptions.Validate: " + collection + " is global")
+		}
+		if collections[collection] {
+			return errors.New("ProvisionOptions.Validate: " + collection + " is repeated")
+		}
+		collections[collection] = true
+	}
+	return nil
+}
+
+func (m ProvisionOptions) getReferenceFields() []string {
+	if m.ReferenceFields == nil {
+		return defaultProvisionReferenceFields
+	}
+	return m.ReferenceFields
+}
+
+// provisioner copies the collections of a template domain to a new one
+type provisioner struct {
+	repo    Repository
+	request RepoRequest
+	options ProvisionOptions
+	// New ID of each template document, by hex
+	ids map[string]primitive.ObjectID
+}
+
+func (m *provisioner) repository(repoID string, model RepositoryModel) (Repository, error) {
+	collection, _ := model.GetCollection()
+	repo, err := NewRepository(m.repo.GetConnection(), m.repo.GetType(), repoID, collection, false)
+	if err != nil {
+		return nil, err
+	}
+	repo.SetTimeout(m.repo.GetTimeout())
+	return repo, nil
+}
+
+// stream reads the documents of the template collection that are not deleted
+func (m *provisioner) stream(model RepositoryModel, fn func(document bson.M) error) RepoResponse {
+	source, err := m.repository(m.options.TemplateRepoID, model)
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	return source.FindStream(RepoRequest{Model: model, Context: m.request.Context}, func(item interface{}) error {
+		document, ok := item.(bson.M)
+		if !ok {
+			return errors.New("unexpected row")
+		}
+		return fn(document)
+	})
+}
+
+// check fails if the new domain has documents in the collections, and counts
+// the template ones
+func (m *provisioner) check() (map[string]int64, error) {
+	totals := map[string]int64{}
+	for _, model := range m.options.Models {
+		collection, _ := model.GetCollection()
+
+		target, err := m.repository(m.options.RepoID, model)
+		if err != nil {
+			return nil, err
+		}
+		response := target.Count(RepoRequest{Model: model, Context: m.request.Context, IncludeDeleted: true})
+		if response.Error != nil {
+			return nil, response.Error
+		}
+		if response.TotalRows > 0 {
+			return nil, errors.New(m.options.RepoID + "." + collection + " is not empty")
+		}
+
+		response = m.stream(model, func(document bson.M) error {
+			totals[collection]++
+			if m.options.KeepIDs {
+				return nil
+			}
+			if id, ok := document["_id"].(primitive.ObjectID); ok {
+				m.ids[id.Hex()] = primitive.NewObjectID()
+			}
+			return nil
+		})
+		if response.Error != nil {
+			return nil, response.Error
+		}
+	}
+	return totals, nil
+}
+
+// copyDocument returns the document for the new domain, marked as a clone of
+// the template one
+func (m *provisioner) copyDocument(document bson.M) bson.M {
+	copied := bson.M{}
+	for field, value := range document {
+		copied[field] = value
+	}
+
+	id, _ := document["_id"].(primitive.ObjectID)
+	if !m.options.KeepIDs {
+		if newID, ok := m.ids[id.Hex()]; ok {
+			copied["_id"] = newID
+		}
+		for _, field := range m.options.getReferenceFields() {
+			if value, ok := copied[field]; ok {
+				copied[field] = m.remap(value)
+			}
+		}
+	}
+
+	copied["repo_id"] = m.options.RepoID
+	copied["source_id"] = id.Hex()
+	copied["source_type"] = string(SourceTypeDomainClone)
+	copied["created_by"] = m.request.User.GetUserLog()
+	copied["version"] = 1
+	delete(copied, "updated_by")
+	delete(copied, "last_access")
+	delete(copied, "locked_by")
+
+	return copied
+}
+
+// remap replaces an ID of a copied document by its new one
+func (m *provisioner) remap(value interface{}) interface{} {
+	switch id := value.(type) {
+	case string:
+		if newID, ok := m.ids[id]; ok {
+			return newID.Hex()
+		}
+	case primitive.ObjectID:
+		if newID, ok := m.ids[id.Hex()]; ok {
+			return newID
+		}
+	}
+	return value
+}
+
+func (m *provisioner) copy(model RepositoryModel, total int64) (int64, error) {
+	collection, _ := model.GetCollection()
+
+	target, err := m.repository(m.options.RepoID, model)
+	if err != nil {
+		return 0, err
+	}
+
+	progress := ProvisionProgress{Collection: collection, Total: total}
+	report := func() {
+		if m.options.Progress != nil {
+			m.options.Progress(progress)
+		}
+	}
+
+	batch := []interface{}{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		response := target.BulkWrite(RepoRequest{User: m.request.User, Context: m.request.Context}, BulkList{NewList: batch, Ordered: true})
+		if response.Error != nil {
+			return response.Error
+		}
+		if len(response.Errors) > 0 {
+			return response.Errors[0]
+		}
+		progress.Copied += response.TotalRows
+		batch = []interface{}{}
+		report()
+		return nil
+	}
+
+	response := m.stream(model, func(document bson.M) error {
+		batch = append(batch, m.copyDocument(document))
+		if len(batch) < DefaultBulkBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	err = response.Error
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return progress.Copied, errors.New(collection + ": " + err.Error())
+	}
+
+	progress.Done = true
+	report()
+	return progress.Copied, nil
+}
+
+// ProvisionDomain creates the domain options.RepoID from the collections of
+// options.TemplateRepoID: it ensures the indexes of the models and copies the
+// documents that are not deleted, with SourceType SourceTypeDomainClone and
+// SourceID the template document. The collections of the new domain must be
+// empty. RepoResponse.List has a ProvisionCollection per model.
+func ProvisionDomain(repo Repository, request RepoRequest, options ProvisionOptions) RepoResponse {
+	if repo == nil {
+		return RepoResponse{Error: errors.New("ProvisionDomain: repository is nil")}
+	}
+
+	err := options.Validate()
+	if err != nil {
+		return RepoResponse{Error: err}
+	}
+
+	m := &provisioner{repo: repo, request: request, options: options, ids: map[string]primitive.ObjectID{}}
+
+	totals, err := m.check()
+	if err != nil {
+		return RepoResponse{Error: errors.New("ProvisionDomain: " + err.Error())}
+	}
+
+	target, err := m.repository(options.RepoID, options.Models[0])
+	if err != nil {
+		return RepoResponse{Error: errors.New("ProvisionDomain: " + err.Error())}
+	}
+	indexes := EnsureIndexes(target, options.Models...)
+	if indexes.Error == nil && len(indexes.Errors) > 0 {
+		indexes.Error = indexes.Errors[0]
+	}
+	if indexes.Error != nil {
+		return RepoResponse{Error: errors.New("ProvisionDomain: " + indexes.Error.Error())}
+	}
+
+	response := RepoResponse{}
+	collections := []ProvisionCollection{}
+	for _, model := range options.Models {
+		collection, _ := model.GetCollection()
+		copied, err := m.copy(model, totals[collection])
+		response.TotalRows += copied
+		collections = append(collections, ProvisionCollection{Name: collection, Documents: copied})
+		if err != nil {
+			response.Error = errors.New("ProvisionDomain: " + err.Error())
+			break
+		}
+	}
+	response.List = collections
+
+	return response
+}
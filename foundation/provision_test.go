@@ -0,0 +1,81 @@
+package foundation
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMemoryRepositoryProvisionDomain(t *testing.T) {
+	user := newMemoryTestUser()
+	template := newMemoryTestRepo(t, "memory_test_template", "memory_test", false)
+	models := seedMemoryTestModels(t, template, user)
+	tenant := newMemoryTestRepo(t, "memory_test_tenant", "memory_test", false)
+	kept := newMemoryTestRepo(t, "memory_test_tenant_ids", "memory_test", false)
+
+	child := &memoryTestModel{Name: "Injerto"}
+	child.ParentID = models[0].GetIDStr()
+	if response := template.Update(RepoRequest{Model: child, User: user}); response.Error != nil {
+		t.Fatalf("Update(): %v", response.Error)
+	}
+	findOptions := NewFindOptions()
+	findOptions.AddEquals("_id", models[2].ID)
+	if response := template.DeleteSoft(RepoRequest{FindOptions: *findOptions, User: user}); response.TotalRows != 1 {
+		t.Fatalf("DeleteSoft() = %d, want 1", response.TotalRows)
+	}
+
+	progress := []ProvisionProgress{}
+	options := ProvisionOptions{
+		TemplateRepoID: "memory_test_template",
+		RepoID:         "memory_test_tenant",
+		Models:         []RepositoryModel{&memoryTestModel{}},
+		Progress: func(p ProvisionProgress) {
+			progress = append(progress, p)
+		},
+	}
+	response := ProvisionDomain(template, RepoRequest{User: user}, options)
+	if response.Error != nil || response.TotalRows != 3 {
+		t.Fatalf("ProvisionDomain() = %+v", response)
+	}
+	last := progress[len(progress)-1]
+	if !last.Done || last.Copied != 3 || last.Total != 3 {
+		t.Fatalf("last progress = %+v", last)
+	}
+
+	found := tenant.Find(RepoRequest{Model: &memoryTestModel{}, List: []*memoryTestModel{}})
+	copies := map[string]*memoryTestModel{}
+	for _, model := range found.List.([]*memoryTestModel) {
+		copies[model.Name] = model
+	}
+	almendro, injerto := copies["Almendro"], copies["Injerto"]
+	if almendro == nil || injerto == nil || len(copies) != 3 {
+		t.Fatalf("copies = %v", copies)
+	}
+	if almendro.GetIDStr() == models[0].GetIDStr() || almendro.SourceID != models[0].GetIDStr() || almendro.SourceType != SourceTypeDomainClone || almendro.RepoID != "memory_test_tenant" {
+		t.Fatalf("Almendro copy = %+v", almendro.BaseModel)
+	}
+	if injerto.ParentID != almendro.GetIDStr() {
+		t.Fatalf("Injerto parent = %s, want %s", injerto.ParentID, almendro.GetIDStr())
+	}
+
+	// reference fields missing in the template are not written
+	missing := NewFindOptions()
+	missing.AddEquals("family_id", bson.M{"$exists": true})
+	if response := tenant.Count(RepoRequest{Model: &memoryTestModel{}, FindOptions: *missing}); response.Error != nil || response.TotalRows != 0 {
+		t.Fatalf("Count() of copies with family_id = %+v, want 0", response)
+	}
+
+	if response := ProvisionDomain(template, RepoRequest{User: user}, options); response.Error == nil {
+		t.Fatalf("ProvisionDomain() into a domain with data should fail")
+	}
+
+	options.RepoID = "memory_test_tenant_ids"
+	options.KeepIDs = true
+	options.Progress = nil
+	if response := ProvisionDomain(template, RepoRequest{User: user}, options); response.Error != nil {
+		t.Fatalf("ProvisionDomain() keeping IDs: %v", response.Error)
+	}
+	if response := kept.FindOne(RepoRequest{Model: &memoryTestModel{BaseModel: BaseModel{ID: models[0].ID}}}); response.Error != nil {
+		t.Fatalf("FindOne() of the kept ID: %v", response.Error)
+	}
+}
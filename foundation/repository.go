@@ -1,8 +1,10 @@
 package foundation
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"time"
 
 	"github.com/weitecit/pkg/log"
 	"github.com/weitecit/pkg/utils"
@@ -29,12 +31,21 @@ const (
 	FilterOperatorGroupBy                   FilterOperator = "group_by"
 	FilterOperatorNotNil                    FilterOperator = "not_nil"
 	FilterOperatorNil                       FilterOperator = "nil"
+	// The geo operators take a Geometry, or a GeoNear for near, and need a
+	// 2dsphere index (see NewGeoIndex)
+	FilterOperatorGeoWithin     FilterOperator = "geo_within"
+	FilterOperatorGeoIntersects FilterOperator = "geo_intersects"
+	// Sorts by distance unless the query has an order. MongoDB does not allow
+	// it in a $or. The counts of Find and Count match it with a $geoWithin.
+	FilterOperatorNear FilterOperator = "near"
 )
 
 type Filter struct {
 	Key      string         `json:"key"`
 	Operator FilterOperator `json:"operator"`
 	Value    interface{}    `json:"value"`
+	// How Value is interpreted, used as it is when empty. See NewFilter.
+	Type FilterValueType `json:"type,omitempty"`
 }
 
 type FilterOr []Filter
@@ -102,6 +113,10 @@ type FindOptions struct {
 	FiltersOr []FilterOr  `json:"filters_or"`
 	Order     *Orders     `json:"order"`
 	Pipeline  interface{} `json:"pipeline"`
+	// Fields returned by the reads, all by default
+	Projection Projection `json:"projection,omitempty"`
+	// Nested AND/OR/NOT filters, ANDed with Filters and FiltersOr
+	Tree *FilterNode `json:"tree,omitempty"`
 }
 
 func (m *FindOptions) Remove(key string) {
@@ -137,7 +152,7 @@ func (m *FindOptions) AddComplex(name string, operation FilterOperator, value in
 		m.Filters = []Filter{}
 	}
 
-	m.Filters = append(m.Filters, Filter{Key: name, Value: value, Operator: operation})
+	m.Filters = append(m.Filters, NewFilter(name, operation, value))
 }
 
 func (m *FindOptions) AddNotNil(name string) {
@@ -293,11 +308,7 @@ func (m *FindOptions) AddSearchTerms(fields []string, searchTerms []string, oper
 		filterOr := FilterOr{}
 		for _, term := range searchTerms {
 			for _, field := range fields {
-				filterOr = append(filterOr, Filter{
-					Key:      field,
-					Operator: operator,
-					Value:    term,
-				})
+				filterOr = append(filterOr, NewFilter(field, operator, term))
 			}
 		}
 		m.FiltersOr = append(m.FiltersOr, filterOr)
@@ -305,17 +316,16 @@ func (m *FindOptions) AddSearchTerms(fields []string, searchTerms []string, oper
 		// Default: each field creates its own OR group (one group per field, all terms in that group)
 		// fields: ["title", "reference"], terms: ["texto", "tres"]
 		// Result: group1: (title texto OR title tres), group2: (reference texto OR reference tres)
+		// The groups go to Tree because GetFilter joins all FiltersOr in one OR
+		groups := []FilterNode{}
 		for _, field := range fields {
-			filterOr := FilterOr{}
+			group := NewOrFilter()
 			for _, term := range searchTerms {
-				filterOr = append(filterOr, Filter{
-					Key:      field,
-					Operator: operator,
-					Value:    term,
-				})
+				group.Nodes = append(group.Nodes, NewFilterNode(field, operator, term))
 			}
-			m.FiltersOr = append(m.FiltersOr, filterOr)
+			groups = append(groups, group)
 		}
+		m.AddTree(NewAndFilter(groups...))
 	}
 }
 
@@ -338,10 +348,16 @@ func (m *FindOptions) ToJSON() string {
 
 func (m *FindOptions) filterIsEmpty() bool {
 
-	if m.Filters == nil && m.FiltersOr == nil {
-		return true
+	// group_by filters only group a Pipeline.Match, GetFilter leaves them out
+	if len(m.GetGroupBy()) < len(m.Filters) || !m.Tree.isEmpty() {
+		return false
 	}
-	return false
+	for _, filterOr := range m.FiltersOr {
+		if len(filterOr) > 0 {
+			return false
+		}
+	}
+	return true
 }
 
 type Sort struct {
@@ -377,6 +393,24 @@ type RepoRequest struct {
 	RepoID           string
 	Pipeline         interface{}
 	TargetCollection string
+	// Cancellation and deadline of the operation, nil uses the repository one
+	Context context.Context `json:"-"`
+	// Update only matches the stored model if it still has the version of
+	// request.Model, otherwise it returns a ConflictError
+	CheckVersion bool
+	// Keyset pagination: pages with Cursor instead of CurrentPage. An empty
+	// Cursor returns the first page.
+	CursorPaging bool
+	Cursor       string
+	// Do not count the total rows of the query
+	SkipCount bool
+	// Reads return soft deleted documents too
+	IncludeDeleted bool
+	// Search of the terms in SearchFields, or in the text index with
+	// SearchModeText
+	SearchTerms  SearchTerms
+	SearchFields []string
+	SearchMode   SearchMode
 }
 
 func (m *RepoRequest) ToJSON() string {
@@ -396,6 +430,8 @@ type RepoResponse struct {
 	PageSize    int64
 	CurrentPage int64
 	List        interface{}
+	// Continuation token of the next page, empty on the last one
+	NextCursor string
 }
 
 func (m *RepoResponse) ToJSON() string {
@@ -413,11 +449,17 @@ func NewRepoResponse() (*RepoResponse, error) {
 
 type Repository interface {
 	Aggregate(request RepoRequest) RepoResponse
+	AggregateStream(request RepoRequest, fn StreamFunc) RepoResponse
 	Find(request RepoRequest) RepoResponse
+	FindStream(request RepoRequest, fn StreamFunc) RepoResponse
+	Watch(request RepoRequest, watch WatchOptions, fn WatchFunc) RepoResponse
 	Count(request RepoRequest) RepoResponse
+	Distinct(request RepoRequest, field string) RepoResponse
+	CountFacets(request RepoRequest, facets FacetOptions) RepoResponse
 	FindOne(request RepoRequest) RepoResponse
 	Update(request RepoRequest) RepoResponse
 	UpdateMany(request RepoRequest, values map[string]interface{}) RepoResponse
+	BulkWrite(request RepoRequest, list BulkList) RepoResponse
 	UpdateField(request RepoRequest, field string, value interface{}) RepoResponse
 	SwitchItemInArray(request RepoRequest, field string, value string) RepoResponse
 	AddItemInArray(request RepoRequest, field string, value string) RepoResponse
@@ -425,6 +467,7 @@ type Repository interface {
 	Move(request RepoRequest) RepoResponse
 	Delete(request RepoRequest) RepoResponse
 	DeleteSoft(request RepoRequest) RepoResponse
+	Restore(request RepoRequest) RepoResponse
 	RemoveField(request RepoRequest, field string) RepoResponse
 	GetFilter(filterOptions FindOptions) (map[string]interface{}, error)
 	GetOrder(filterOptions FindOptions) map[string]interface{}
@@ -433,9 +476,13 @@ type Repository interface {
 	GetDataBase() string
 	GetConnection() string
 	SetRepoID(value string) error
-	RepoBackup(request RepoRequest, backupID string) RepoResponse
-	RepoRestore(request RepoRequest, backupID string) RepoResponse
+	RepoBackup(request RepoRequest, backup BackupOptions) RepoResponse
+	RepoRestore(request RepoRequest, backup BackupOptions) RepoResponse
 	DeleteDatabase(connection string, database string) error
+	EnsureIndexes(request RepoRequest, indexes []Index) RepoResponse
+	SetTimeout(timeout time.Duration)
+	GetTimeout() time.Duration
+	Transaction(ctx context.Context, fn func(ctx context.Context) error) error
 }
 
 type RepoType uint64
@@ -443,6 +490,7 @@ type RepoType uint64
 const (
 	RepoTypeUnknown RepoType = iota
 	RepoTypeMongoDB
+	RepoTypeMemory
 )
 
 func NewRepository(connection string, repoType RepoType, database string, collection string, isGlobal bool) (Repository, error) {
@@ -454,6 +502,12 @@ func NewRepository(connection string, repoType RepoType, database string, collec
 			return nil, repo.Error
 		}
 		return &repo, nil
+	case RepoTypeMemory:
+		repo := NewMemoryRepository(connection, database, collection, isGlobal)
+		if repo.Error != nil {
+			return nil, repo.Error
+		}
+		return &repo, nil
 	default:
 		return nil, errors.New("NewRepository: RepoType is not supported")
 	}
@@ -481,5 +535,11 @@ func CloneRepository(repo Repository, model RepositoryModel) (Repository, error)
 		repoID = repo.GetRepoID()
 	}
 
-	return NewRepository(repo.GetConnection(), repo.GetType(), repoID, collection, isGlobal)
+	clone, err := NewRepository(repo.GetConnection(), repo.GetType(), repoID, collection, isGlobal)
+	if err != nil {
+		return nil, err
+	}
+	clone.SetTimeout(repo.GetTimeout())
+
+	return clone, nil
 }
@@ -0,0 +1,243 @@
+package foundation
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/weitecit/pkg/log"
+	"github.com/weitecit/pkg/utils"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RetryPolicy of the operations of MongoRepository that fail with a
+// transient error
+type RetryPolicy struct {
+	// Attempts of an operation, 1 disables the retries
+	MaxAttempts int
+	// Delay before the first retry, doubled on every retry up to MaxDelay.
+	// The delays have jitter.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// NewRetryPolicy returns the policy of MONGO_RETRY_ATTEMPTS, 3 by default
+func NewRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: utils.GetEnvInt("MONGO_RETRY_ATTEMPTS", 3),
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    2 * time.Second,
+	}
+}
+
+// delay before the retry after attempt, between half and all of the backoff
+func (m RetryPolicy) delay(attempt int) time.Duration {
+	backoff := m.BaseDelay
+	for i := 1; i < attempt && backoff < m.MaxDelay; i++ {
+		backoff *= 2
+	}
+	if m.MaxDelay > 0 && backoff > m.MaxDelay {
+		backoff = m.MaxDelay
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// Server errors of a primary step-down or shutdown: the operation was not
+// applied and can be sent again
+var transientErrorCodes = []int{
+	6,     // HostUnreachable
+	7,     // HostNotFound
+	89,    // NetworkTimeout
+	91,    // ShutdownInProgress
+	112,   // WriteConflict
+	189,   // PrimarySteppedDown
+	262,   // ExceededTimeLimit
+	9001,  // SocketException
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// IsTransientError tells whether err may not happen if the operation is
+// tried again: network errors, primary step-downs and write conflicts
+func IsTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if mongo.IsNetworkError(err) {
+		return true
+	}
+	return isRejectedError(err)
+}
+
+// isRejectedError tells whether the server rejected the operation without
+// applying it, so even a write that is not idempotent can be retried
+func isRejectedError(err error) bool {
+	var serverError mongo.ServerError
+	if !errors.As(err, &serverError) {
+		return false
+	}
+	if serverError.HasErrorLabel("RetryableWriteError") || serverError.HasErrorLabel("TransientTransactionError") {
+		return true
+	}
+	for _, code := range transientErrorCodes {
+		if serverError.HasErrorCode(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// retry runs fn until it succeeds, fails with an error that is not
+// transient or runs out of attempts. A write that is not idempotent is only
+// retried when the server rejected it, since after a network error it may
+// have been applied. Operations in a transaction are not retried, the whole
+// transaction is.
+func (m *MongoRepository) retry(ctx context.Context, operation string, idempotent bool, fn func() error) error {
+	policy := m.Retry
+	if policy.MaxAttempts <= 0 {
+		policy = NewRetryPolicy()
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= policy.MaxAttempts || mongo.SessionFromContext(ctx) != nil {
+			return err
+		}
+		retryable := isRejectedError(err)
+		if idempotent {
+			retryable = IsTransientError(err)
+		}
+		if !retryable {
+			return err
+		}
+
+		log.Trace(errors.New("MongoRepository." + operation + ": attempt " + strconv.Itoa(attempt) + " failed, retrying: " + err.Error()))
+
+		timer := time.NewTimer(policy.delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// retryCollection runs the operations of a collection with the RetryPolicy
+// of the repository. Writes are retried as idempotent or not.
+type retryCollection struct {
+	*mongo.Collection
+	repo       *MongoRepository
+	operation  string
+	idempotent bool
+}
+
+func (m *MongoRepository) retrying(collection *mongo.Collection, operation string, idempotent bool) retryCollection {
+	return retryCollection{Collection: collection, repo: m, operation: operation, idempotent: idempotent}
+}
+
+func (m retryCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (cursor *mongo.Cursor, err error) {
+	err = m.repo.retry(ctx, m.operation, true, func() error {
+		cursor, err = m.Collection.Find(ctx, filter, opts...)
+		return err
+	})
+	return cursor, err
+}
+
+func (m retryCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) (result *mongo.SingleResult) {
+	m.repo.retry(ctx, m.operation, true, func() error {
+		result = m.Collection.FindOne(ctx, filter, opts...)
+		return result.Err()
+	})
+	return result
+}
+
+func (m retryCollection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (count int64, err error) {
+	err = m.repo.retry(ctx, m.operation, true, func() error {
+		count, err = m.Collection.CountDocuments(ctx, filter, opts...)
+		return err
+	})
+	return count, err
+}
+
+func (m retryCollection) Distinct(ctx context.Context, field string, filter interface{}, opts ...*options.DistinctOptions) (values []interface{}, err error) {
+	err = m.repo.retry(ctx, m.operation, true, func() error {
+		values, err = m.Collection.Distinct(ctx, field, filter, opts...)
+		return err
+	})
+	return values, err
+}
+
+func (m retryCollection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (cursor *mongo.Cursor, err error) {
+	err = m.repo.retry(ctx, m.operation, m.idempotent, func() error {
+		cursor, err = m.Collection.Aggregate(ctx, pipeline, opts...)
+		return err
+	})
+	return cursor, err
+}
+
+func (m retryCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (result *mongo.InsertOneResult, err error) {
+	err = m.repo.retry(ctx, m.operation, m.idempotent, func() error {
+		result, err = m.Collection.InsertOne(ctx, document, opts...)
+		return err
+	})
+	return result, err
+}
+
+func (m retryCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (result *mongo.UpdateResult, err error) {
+	err = m.repo.retry(ctx, m.operation, m.idempotent, func() error {
+		result, err = m.Collection.UpdateOne(ctx, filter, update, opts...)
+		return err
+	})
+	return result, err
+}
+
+func (m retryCollection) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (result *mongo.UpdateResult, err error) {
+	err = m.repo.retry(ctx, m.operation, m.idempotent, func() error {
+		result, err = m.Collection.UpdateMany(ctx, filter, update, opts...)
+		return err
+	})
+	return result, err
+}
+
+func (m retryCollection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (result *mongo.DeleteResult, err error) {
+	err = m.repo.retry(ctx, m.operation, m.idempotent, func() error {
+		result, err = m.Collection.DeleteOne(ctx, filter, opts...)
+		return err
+	})
+	return result, err
+}
+
+func (m retryCollection) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (result *mongo.DeleteResult, err error) {
+	err = m.repo.retry(ctx, m.operation, m.idempotent, func() error {
+		result, err = m.Collection.DeleteMany(ctx, filter, opts...)
+		return err
+	})
+	return result, err
+}
+
+func (m retryCollection) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (result *mongo.BulkWriteResult, err error) {
+	err = m.repo.retry(ctx, m.operation, m.idempotent, func() error {
+		result, err = m.Collection.BulkWrite(ctx, models, opts...)
+		return err
+	})
+	return result, err
+}
+
+func (m retryCollection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (result *mongo.InsertManyResult, err error) {
+	err = m.repo.retry(ctx, m.operation, m.idempotent, func() error {
+		result, err = m.Collection.InsertMany(ctx, documents, opts...)
+		return err
+	})
+	return result, err
+}
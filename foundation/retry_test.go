@@ -0,0 +1,58 @@
+package foundation
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestMongoRepositoryRetry(t *testing.T) {
+	repo := NewMongoRepository("mongodb://localhost", "retry_test", "items", false)
+	repo.Retry = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+
+	stepDown := mongo.CommandError{Code: 189, Message: "primary stepped down"}
+	network := mongo.CommandError{Message: "connection reset", Labels: []string{"NetworkError"}}
+
+	tests := []struct {
+		name       string
+		idempotent bool
+		errs       []error
+		attempts   int
+		fails      bool
+	}{
+		{"transient then success", true, []error{stepDown, network}, 3, false},
+		{"out of attempts", true, []error{network, network, network, network}, 3, true},
+		{"not transient", true, []error{errors.New("invalid")}, 1, true},
+		{"write rejected by the server", false, []error{stepDown}, 2, false},
+		{"write with a network error", false, []error{network}, 1, true},
+	}
+
+	for _, test := range tests {
+		attempts := 0
+		err := repo.retry(context.Background(), "Test", test.idempotent, func() error {
+			attempts++
+			if attempts <= len(test.errs) {
+				return test.errs[attempts-1]
+			}
+			return nil
+		})
+		if attempts != test.attempts || (err != nil) != test.fails {
+			t.Fatalf("%s: attempts = %d, err = %v", test.name, attempts, err)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+
+	for attempt, max := range map[int]time.Duration{1: 100, 2: 200, 3: 300, 4: 300} {
+		max *= time.Millisecond
+		delay := policy.delay(attempt)
+		if delay < max/2 || delay > max {
+			t.Fatalf("delay(%d) = %v, want between %v and %v", attempt, delay, max/2, max)
+		}
+	}
+}
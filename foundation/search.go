@@ -0,0 +1,177 @@
+package foundation
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/weitecit/pkg/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type SearchMode utils.Enum
+
+const (
+	// Every word of the terms must be contained in one of the search fields
+	SearchModeRegex SearchMode = "regex"
+	// MongoDB $text over the text index of the collection, sorted by relevance
+	SearchModeText SearchMode = "text"
+)
+
+// SearchScoreField is where SearchModeText leaves the relevance of each
+// document. Models that want it declare a field with this bson name.
+const SearchScoreField = "search_score"
+
+const searchLanguage = "spanish"
+
+// SearchableModel is implemented by the models that can be searched with
+// BaseRequest.SearchTerms
+type SearchableModel interface {
+	GetSearchFields() []string
+}
+
+func getSearchFields(model RepositoryModel) []string {
+	searchable, ok := model.(SearchableModel)
+	if !ok {
+		return nil
+	}
+	return searchable.GetSearchFields()
+}
+
+// searchWords splits the terms in words normalized without accents nor case
+func searchWords(terms SearchTerms) []string {
+	words := []string{}
+	for _, term := range terms {
+		for _, word := range strings.Fields(term) {
+			word = utils.Normalize(word)
+			if word != "" {
+				words = utils.FindOrAppendStrRaw(words, word)
+			}
+		}
+	}
+	return words
+}
+
+var searchAccents = map[rune]string{
+	'a': "aáàâäã",
+	'e': "eéèêë",
+	'i': "iíìîï",
+	'o': "oóòôöõ",
+	'u': "uúùûü",
+	'n': "nñ",
+	'c': "cç",
+}
+
+// searchPattern matches a normalized word with or without accents
+func searchPattern(word string) string {
+	pattern := strings.Builder{}
+	for _, r := range word {
+		if accents, ok := searchAccents[r]; ok {
+			pattern.WriteString("[" + accents + "]")
+			continue
+		}
+		pattern.WriteString(regexp.QuoteMeta(string(r)))
+	}
+	return pattern.String()
+}
+
+// searchRegexFilter matches the documents with all the words (or any of them)
+// in some of the fields
+func searchRegexFilter(fields []string, words []string, all bool) bson.M {
+	conditions := bson.A{}
+	for _, word := range words {
+		regex := primitive.Regex{Pattern: searchPattern(word), Options: "i"}
+		fieldsOr := bson.A{}
+		for _, field := range fields {
+			fieldsOr = append(fieldsOr, bson.M{field: regex})
+		}
+		conditions = append(conditions, bson.M{"$or": fieldsOr})
+	}
+
+	if all {
+		return bson.M{"$and": conditions}
+	}
+	return bson.M{"$or": conditions}
+}
+
+// searchFilter adds to filter the search of request.SearchTerms
+func searchFilter(filter map[string]interface{}, request RepoRequest) map[string]interface{} {
+	words := searchWords(request.SearchTerms)
+	if len(words) == 0 {
+		return filter
+	}
+
+	var search bson.M
+	if request.SearchMode == SearchModeText {
+		search = bson.M{"$text": bson.M{
+			"$search":             strings.Join(words, " "),
+			"$language":           searchLanguage,
+			"$diacriticSensitive": false,
+		}}
+	} else {
+		if len(request.SearchFields) == 0 {
+			return filter
+		}
+		search = searchRegexFilter(request.SearchFields, words, true)
+	}
+
+	if len(filter) == 0 {
+		return search
+	}
+
+	return bson.M{"$and": bson.A{filter, search}}
+}
+
+func isTextSearch(request RepoRequest) bool {
+	return request.SearchMode == SearchModeText && len(searchWords(request.SearchTerms)) > 0
+}
+
+// searchOrders returns the orders of the query, by relevance first when it is
+// a text search
+func searchOrders(request RepoRequest) []Order {
+	orders := []Order{}
+	if isTextSearch(request) {
+		orders = append(orders, Order{Field: SearchScoreField, Direction: -1})
+	}
+	if request.FindOptions.Order != nil {
+		orders = append(orders, request.FindOptions.Order.List()...)
+	}
+	return orders
+}
+
+// textSearchSort is the sort of a MongoDB text search: the relevance and then
+// the orders of the query
+func textSearchSort(orders []Order) bson.D {
+	sort := bson.D{}
+	for _, order := range orders {
+		if order.Field == SearchScoreField {
+			sort = append(sort, bson.E{Key: SearchScoreField, Value: bson.M{"$meta": "textScore"}})
+			continue
+		}
+		if order.Field == "id" {
+			order.Field = "_id"
+		}
+		sort = append(sort, bson.E{Key: order.Field, Value: order.Direction})
+	}
+	return sort
+}
+
+// searchScore emulates the relevance of a text search: the number of words
+// found in the fields
+func searchScore(document bson.M, fields []string, words []string) (float64, error) {
+	score := 0.0
+	for _, word := range words {
+		for _, field := range fields {
+			value, _ := lookupMemoryPath(document, field)
+			matched, err := matchMemoryRegex(value, searchPattern(word), "i")
+			if err != nil {
+				return 0, err
+			}
+			if matched {
+				score++
+			}
+		}
+	}
+	return score, nil
+}
@@ -0,0 +1,37 @@
+package foundation
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// notDeletedFilter adds to filter the condition that excludes soft deleted
+// documents, unless the request includes them or already filters by
+// deleted_by (e.g. to list the deleted ones).
+func notDeletedFilter(filter map[string]interface{}, request RepoRequest) map[string]interface{} {
+	if request.IncludeDeleted || filtersDeleted(request.FindOptions) {
+		return filter
+	}
+
+	notDeleted := bson.M{"deleted_by": nil}
+	if len(filter) == 0 {
+		return notDeleted
+	}
+
+	return bson.M{"$and": bson.A{filter, notDeleted}}
+}
+
+func filtersDeleted(findOptions FindOptions) bool {
+	for _, filter := range findOptions.Filters {
+		if filter.Key == "deleted_by" {
+			return true
+		}
+	}
+	for _, filterOr := range findOptions.FiltersOr {
+		for _, filter := range filterOr {
+			if filter.Key == "deleted_by" {
+				return true
+			}
+		}
+	}
+	return findOptions.Tree != nil && findOptions.Tree.hasKey("deleted_by")
+}
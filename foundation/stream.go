@@ -0,0 +1,83 @@
+package foundation
+
+import (
+	"errors"
+	"reflect"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrStopStream can be returned by a StreamFunc to end the stream early
+// without an error
+var ErrStopStream = errors.New("Repository.Stream: stopped")
+
+// StreamFunc receives the rows of FindStream and AggregateStream one at a
+// time. The next row is not read until it returns. Returning an error other
+// than ErrStopStream ends the stream and sets RepoResponse.Error.
+type StreamFunc func(item interface{}) error
+
+// streamDecoder decodes every row into a new item of the element type of
+// RepoRequest.List, as cursor.All would, or into bson.M when there is none.
+type streamDecoder struct {
+	elemType reflect.Type
+}
+
+func newStreamDecoder(list interface{}) streamDecoder {
+	decoder := streamDecoder{}
+
+	value := reflect.ValueOf(list)
+	if value.IsValid() && value.Kind() == reflect.Slice && value.Type().Elem().Kind() != reflect.Interface {
+		decoder.elemType = value.Type().Elem()
+	}
+
+	return decoder
+}
+
+func (m streamDecoder) decode(raw []byte) (interface{}, error) {
+
+	if m.elemType == nil {
+		document := bson.M{}
+		err := bson.Unmarshal(raw, &document)
+		return document, err
+	}
+
+	if m.elemType.Kind() == reflect.Ptr {
+		item := reflect.New(m.elemType.Elem())
+		err := bson.Unmarshal(raw, item.Interface())
+		return item.Interface(), err
+	}
+
+	item := reflect.New(m.elemType)
+	err := bson.Unmarshal(raw, item.Interface())
+	return item.Elem().Interface(), err
+}
+
+// streamRows calls fn with every decoded row until next returns false. It
+// returns the number of rows passed to fn.
+func streamRows(decoder streamDecoder, next func() ([]byte, bool, error), fn StreamFunc) (int64, error) {
+	total := int64(0)
+
+	for {
+		raw, ok, err := next()
+		if err != nil {
+			return total, err
+		}
+		if !ok {
+			return total, nil
+		}
+
+		item, err := decoder.decode(raw)
+		if err != nil {
+			return total, err
+		}
+
+		total++
+		err = fn(item)
+		if errors.Is(err, ErrStopStream) {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package foundation
+
+import (
+	"context"
+	"errors"
+)
+
+// UnitOfWork runs several repository operations, possibly on different
+// collections of the same database, as a single transaction: they are all
+// committed when the work succeeds and all rolled back when it fails.
+type UnitOfWork struct {
+	request *BaseRequest
+}
+
+func NewUnitOfWork(request *BaseRequest) (*UnitOfWork, error) {
+
+	if request == nil || request.Repo == nil {
+		return &UnitOfWork{}, errors.New("UnitOfWork.NewUnitOfWork: request needs a repository")
+	}
+
+	return &UnitOfWork{request: request}, nil
+}
+
+// Run executes fn inside a transaction. Requests obtained from uow.Request
+// share the transaction; returning an error from fn rolls everything back
+// and the same error is returned. Nested units of work join the outer one.
+func (m *UnitOfWork) Run(fn func(uow *UnitOfWork) error) error {
+
+	if m.request == nil || m.request.Repo == nil {
+		return errors.New("UnitOfWork.Run: request needs a repository")
+	}
+
+	return m.request.Repo.Transaction(m.request.GetContext(), func(ctx context.Context) error {
+		request := *m.request
+		request.SetContext(ctx)
+		return fn(&UnitOfWork{request: &request})
+	})
+}
+
+// Request returns a request for model bound to the transaction of the unit of work
+func (m *UnitOfWork) Request(model RepositoryModel) (*BaseRequest, error) {
+
+	if m.request == nil {
+		return &BaseRequest{}, errors.New("UnitOfWork.Request: unit of work has no request")
+	}
+
+	return m.request.Clone(model)
+}
@@ -17,6 +17,8 @@ type ActionLog utils.Enum
 type UserLog struct {
 	User string    `json:"user" bson:"user"`
 	Time time.Time `json:"time" bson:"time"`
+	// Set on LockedBy, when the lock expires
+	ExpiresAt *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
 }
 
 type SysNotify utils.Enum
@@ -89,6 +91,12 @@ func (m *User) GetCollection() (name string, isGlobal bool) {
 	return "users", true
 }
 
+func (m *User) GetIndexes() []Index {
+	return []Index{
+		{Keys: []IndexKey{{Field: "username", Type: IndexKeyAsc}}, Unique: true},
+	}
+}
+
 func (m *User) ToJSON() string {
 	o, err := json.MarshalIndent(&m, "", "\t")
 	if err != nil {
@@ -235,45 +243,79 @@ func (m *User) Update(request *BaseRequest) BaseResponse {
 		m.Language = "es-ES"
 	}
 
-	userNameChanged := false
+	unitOfWork, err := NewUnitOfWork(request)
+	if err != nil {
+		return NewBaseResponseFromError(err)
+	}
 
-	if !m.IsNew() {
-		user := &User{}
-		user.ID = m.ID
-		userRequest, err := request.Clone(user)
-		if err != nil {
-			return NewBaseResponseFromError(err)
-		}
+	// The uniqueness check gives a clear error in the usual case. Two
+	// concurrent writes can both pass it, even in a transaction: the unique
+	// index of username rejects the second one. Standalone servers do not
+	// support transactions, there it runs without one.
+	response := BaseResponse{}
+	save := func(uow *UnitOfWork) error {
 
-		user, err = user.GetOne(userRequest)
-		if err != nil {
-			return NewBaseResponseFromError(err)
-		}
+		userNameChanged := false
+
+		if !m.IsNew() {
+			user := &User{}
+			user.ID = m.ID
+			userRequest, err := uow.Request(user)
+			if err != nil {
+				return err
+			}
+
+			user, err = user.GetOne(userRequest)
+			if err != nil {
+				return err
+			}
+
+			if user.Username != m.Username {
+				userNameChanged = true
+			}
 
-		if user.Username != m.Username {
-			userNameChanged = true
 		}
 
-	}
+		if m.IsNew() || userNameChanged {
+			user := &User{}
+			user.Username = m.Username
+			userRequest, err := uow.Request(user)
+			if err != nil {
+				return err
+			}
+			_, err = user.GetOne(userRequest)
+			if err == nil {
+				return errors.New("User.Update: user already exists")
+			}
 
-	if m.IsNew() || userNameChanged {
-		user := &User{}
-		user.Username = m.Username
-		userRequest, err := request.Clone(user)
-		if err != nil {
-			return NewBaseResponseFromError(err)
+			if err.Error() != "User.GetOne: no results" {
+				return err
+			}
 		}
-		_, err = user.GetOne(userRequest)
-		if err == nil {
-			return NewBaseResponseFromError(errors.New("User.Update: user already exists"))
+
+		updateRequest, err := uow.Request(m)
+		if err != nil {
+			return err
 		}
 
-		if err.Error() != "User.GetOne: no results" {
-			return NewBaseResponseFromError(err)
+		response = m.UpdateRaw(updateRequest)
+		// the unique index of username caught a concurrent insert
+		if IsDuplicateKeyError(response.Error) {
+			response = NewBaseResponseFromError(errors.New("User.Update: user already exists"))
 		}
+		return response.Error
+	}
+	err = unitOfWork.Run(save)
+	if IsTransactionNotSupportedError(err) {
+		log.Trace(errors.New("User.Update: transactions not supported, updating without them"))
+		response = BaseResponse{}
+		err = save(&UnitOfWork{request: request})
+	}
+	if err != nil && response.Error == nil {
+		return NewBaseResponseFromError(err)
 	}
 
-	return m.UpdateRaw(request)
+	return response
 }
 
 func (m *User) EncryptPassword() error {
@@ -0,0 +1,82 @@
+package foundation
+
+import (
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Versionable is implemented by models whose Version is increased on every
+// Update, so concurrent writers can be detected (see RepoRequest.CheckVersion)
+type Versionable interface {
+	GetVersion() int
+	SetVersion(version int)
+}
+
+// ConflictError is returned by Update when the stored model no longer has the
+// version the caller read, because another writer updated it first
+type ConflictError struct {
+	Collection string
+	ID         string
+	Version    int
+}
+
+func (m *ConflictError) Error() string {
+	return fmt.Sprintf("Repository.Update: version conflict in %s, ID: %s, expected version: %d", m.Collection, m.ID, m.Version)
+}
+
+func NewConflictError(collection string, id interface{}, version int) *ConflictError {
+	return &ConflictError{
+		Collection: collection,
+		ID:         formatID(id),
+		Version:    version,
+	}
+}
+
+// formatID returns an ID of the errors, ObjectIDs as hex
+func formatID(id interface{}) string {
+	switch value := id.(type) {
+	case *primitive.ObjectID:
+		return value.Hex()
+	case primitive.ObjectID:
+		return value.Hex()
+	}
+	return fmt.Sprint(id)
+}
+
+func IsConflictError(err error) bool {
+	var conflict *ConflictError
+	return errors.As(err, &conflict)
+}
+
+// increaseVersion increases the version of a Versionable model and returns the
+// version it had before
+func increaseVersion(model RepositoryModel) (version int, ok bool) {
+	versionable, ok := model.(Versionable)
+	if !ok {
+		return 0, false
+	}
+
+	version = versionable.GetVersion()
+	versionable.SetVersion(version + 1)
+
+	return version, true
+}
+
+// restoreVersion undoes increaseVersion when the update did not happen
+func restoreVersion(model RepositoryModel, version int) {
+	if versionable, ok := model.(Versionable); ok {
+		versionable.SetVersion(version)
+	}
+}
+
+// versionFilter matches the stored version. Version is omitted when empty,
+// so version 0 also matches documents without the field.
+func versionFilter(version int) interface{} {
+	if version == 0 {
+		return bson.M{"$in": bson.A{0, nil}}
+	}
+	return version
+}
@@ -0,0 +1,220 @@
+package foundation
+
+import (
+	"errors"
+	"time"
+
+	"github.com/weitecit/pkg/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type ChangeOperation utils.Enum
+
+const (
+	ChangeOperationInsert  ChangeOperation = "insert"
+	ChangeOperationUpdate  ChangeOperation = "update"
+	ChangeOperationReplace ChangeOperation = "replace"
+	ChangeOperationDelete  ChangeOperation = "delete"
+)
+
+var defaultChangeOperations = []ChangeOperation{
+	ChangeOperationInsert,
+	ChangeOperationUpdate,
+	ChangeOperationReplace,
+	ChangeOperationDelete,
+}
+
+// ChangeEvent is a change of a watched collection
+type ChangeEvent struct {
+	Operation  ChangeOperation
+	Collection string
+	ID         string
+	// The document after the change, decoded like the rows of FindStream.
+	// Nil for deletes.
+	Document      interface{}
+	UpdatedFields bson.M
+	RemovedFields []string
+	// Position of the event, a Watch with it resumes after the event
+	ResumeToken string
+	Time        time.Time
+}
+
+// WatchFunc receives the changes of Watch one at a time. The resume token of
+// the event is saved when it returns nil or ErrStopStream, which also ends
+// the Watch. Any other error ends the Watch and the event is delivered again
+// when it resumes.
+type WatchFunc func(event ChangeEvent) error
+
+type WatchOptions struct {
+	// Subscriber whose resume token is kept in Store
+	Name  string
+	Store ResumeTokenStore
+	// Resume after this token instead of the stored one
+	ResumeToken string
+	// Operations delivered, all by default
+	Operations []ChangeOperation
+}
+
+// ResumeTokenStore persists the position of the Watch subscribers so they
+// resume where they stopped after a restart
+type ResumeTokenStore interface {
+	GetResumeToken(name string) (string, error)
+	SaveResumeToken(name string, token string) error
+}
+
+func (m WatchOptions) getResumeToken() (string, error) {
+	if m.ResumeToken != "" || m.Store == nil {
+		return m.ResumeToken, nil
+	}
+	if m.Name == "" {
+		return "", errors.New("Repository.Watch: a Store needs the Name of the subscriber")
+	}
+	return m.Store.GetResumeToken(m.Name)
+}
+
+func (m WatchOptions) getOperations() []ChangeOperation {
+	if len(m.Operations) == 0 {
+		return defaultChangeOperations
+	}
+	return m.Operations
+}
+
+// deliver passes the event to fn and saves its token. It tells whether the
+// Watch has to stop.
+func (m WatchOptions) deliver(event ChangeEvent, fn WatchFunc) (bool, error) {
+	err := fn(event)
+	stop := errors.Is(err, ErrStopStream)
+	if err != nil && !stop {
+		return true, err
+	}
+
+	if m.Store != nil && event.ResumeToken != "" {
+		err = m.Store.SaveResumeToken(m.Name, event.ResumeToken)
+		if err != nil {
+			return true, errors.New("Repository.Watch: " + err.Error())
+		}
+	}
+
+	return stop, nil
+}
+
+// ResumeToken is the position of a Watch subscriber saved by RepoResumeTokenStore
+type ResumeToken struct {
+	BaseModel `bson:",inline"`
+	Name      string `json:"name" bson:"name"`
+	Token     string `json:"token" bson:"token"`
+}
+
+func (m *ResumeToken) GetCollection() (name string, isGlobal bool) {
+	return "resume_tokens", true
+}
+
+func (m *ResumeToken) GetRepoType() RepoType {
+	return RepoTypeMongoDB
+}
+
+// RepoResumeTokenStore keeps the resume tokens in the resume_tokens collection
+// of a repository
+type RepoResumeTokenStore struct {
+	repo Repository
+	user User
+}
+
+func NewRepoResumeTokenStore(repo Repository, user User) (RepoResumeTokenStore, error) {
+	if repo == nil {
+		return RepoResumeTokenStore{}, errors.New("RepoResumeTokenStore: repository is nil")
+	}
+
+	tokenRepo, err := CloneRepository(repo, &ResumeToken{})
+	if err != nil {
+		return RepoResumeTokenStore{}, err
+	}
+
+	return RepoResumeTokenStore{repo: tokenRepo, user: user}, nil
+}
+
+func (m RepoResumeTokenStore) GetResumeToken(name string) (string, error) {
+	findOptions := NewFindOptions()
+	findOptions.AddEquals("name", name)
+
+	response := m.repo.Find(RepoRequest{Model: &ResumeToken{}, FindOptions: *findOptions, List: []*ResumeToken{}})
+	if response.Error != nil {
+		return "", response.Error
+	}
+
+	list, _ := response.List.([]*ResumeToken)
+	if len(list) == 0 {
+		return "", nil
+	}
+	return list[0].Token, nil
+}
+
+// SaveResumeToken upserts the token by name, kept as the ExternalID
+func (m RepoResumeTokenStore) SaveResumeToken(name string, token string) error {
+	model := &ResumeToken{Name: name, Token: token}
+	model.ExternalID = name
+
+	response := m.repo.BulkWrite(RepoRequest{User: m.user}, BulkList{UpdateList: []interface{}{model}})
+	if response.Error != nil {
+		return response.Error
+	}
+	if len(response.Errors) > 0 {
+		return response.Errors[0]
+	}
+	return nil
+}
+
+// watchFilter returns the filter of the changes: filter applies to the
+// document after the change, in the field prefix. Deletes have no document
+// and always pass it.
+func watchFilter(filter map[string]interface{}, prefix string, operations []ChangeOperation) (bson.M, error) {
+	types := bson.A{}
+	for _, operation := range operations {
+		types = append(types, string(operation))
+	}
+	match := bson.M{"operationType": bson.M{"$in": types}}
+
+	if len(filter) == 0 {
+		return match, nil
+	}
+
+	document, err := toMemoryDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return bson.M{"$and": bson.A{match, bson.M{"$or": bson.A{
+		bson.M{"operationType": string(ChangeOperationDelete)},
+		prefixFilterFields(document, prefix),
+	}}}}, nil
+}
+
+// prefixFilterFields moves the fields of a filter under prefix, keeping its
+// operators
+func prefixFilterFields(filter bson.M, prefix string) bson.M {
+	result := bson.M{}
+	for key, value := range filter {
+		if len(key) == 0 || key[0] != '$' {
+			result[prefix+"."+key] = value
+			continue
+		}
+
+		array, ok := asMemoryArray(value)
+		if !ok {
+			result[key] = value
+			continue
+		}
+
+		clauses := bson.A{}
+		for _, item := range array {
+			if clause, ok := asMemoryDocument(item); ok {
+				clauses = append(clauses, prefixFilterFields(clause, prefix))
+			} else {
+				clauses = append(clauses, item)
+			}
+		}
+		result[key] = clauses
+	}
+	return result
+}
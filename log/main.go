@@ -169,6 +169,12 @@ func Infof(format string, v ...interface{}) {
 	log.Info().Msgf(format, v...)
 }
 
+// SlowQuery logs a warning of type LogTypeSlowQuery with the fields of the
+// query, listed later by MongoDBLogger.GetLogsByType
+func SlowQuery(msg string, fields map[string]interface{}) {
+	log.Warn().Str("type", string(LogTypeSlowQuery)).Fields(fields).Msg(msg)
+}
+
 func Panic(err error) {
 	log.Panic().Err(err).Send()
 }
@@ -26,6 +26,8 @@ const (
 	LogTypeAuth LogType = "auth"
 	// LogTypeAPI represents API access logs
 	LogTypeAPI LogType = "api"
+	// LogTypeSlowQuery represents the slow queries of the repositories
+	LogTypeSlowQuery LogType = "slow_query"
 )
 
 // LogEntry represents a log entry in MongoDB
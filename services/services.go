@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -43,6 +44,20 @@ type ServiceRequest struct {
 	RefreshToken string
 	User         foundation.User
 	SpaceID      string
+	// Context of the incoming request, passed down to the repositories
+	Context context.Context
+	// Updates fail with foundation.ConflictError if the model version changed
+	CheckVersion bool
+	// Keyset pagination, see foundation.RepoRequest.CursorPaging
+	CursorPaging bool
+	Cursor       string
+	SkipCount    bool
+	// Reads return soft deleted models too
+	IncludeDeleted bool
+	// How SearchTerms are searched, see foundation.SearchMode
+	SearchMode foundation.SearchMode
+	// Fields returned by the reads, see foundation.NewProjection
+	Fields []string
 }
 
 type ExerciseClusterRequest struct {
@@ -168,9 +183,15 @@ func NewFoundationBaseRequest(request *ServiceRequest) (*foundation.BaseRequest,
 	baseRequest.Language = request.Language
 	baseRequest.CurrentPage = request.CurrentPage
 	baseRequest.PageSize = request.PageSize
+	baseRequest.CursorPaging = request.CursorPaging
+	baseRequest.Cursor = request.Cursor
+	baseRequest.SkipCount = request.SkipCount
+	baseRequest.IncludeDeleted = request.IncludeDeleted
 	baseRequest.Model.SetRepoID(repoID)
 	baseRequest.Model.LabelFromStrings(request.Labels...)
 	baseRequest.SearchTerms = request.SearchTerms
+	baseRequest.SearchMode = request.SearchMode
+	baseRequest.Fields = request.Fields
 	if utils.HasValidID(request.ID) {
 		baseRequest.ID = request.ID
 	}
@@ -178,6 +199,8 @@ func NewFoundationBaseRequest(request *ServiceRequest) (*foundation.BaseRequest,
 	baseRequest.IDs = request.IDs
 	baseRequest.QueryField = request.QueryField
 	baseRequest.SpaceID = request.SpaceID
+	baseRequest.SetContext(request.Context)
+	baseRequest.CheckVersion = request.CheckVersion
 
 	return baseRequest, nil
 